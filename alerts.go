@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/sys/unix"
+)
+
+var alertsLog = newLogger("alerts")
+
+// how often the rules are checked
+const alertInterval = 15 * time.Second
+
+// resolved alerts stay on the api this long
+const resolvedRetention = time.Hour
+
+// size of a finished k32 plot, free space is turned into plots with it
+const k32PlotBytes = 108.8e9
+
+// HarvesterPlotsDropping compares to the highest plot count this far back
+const plotDropWindow = time.Hour
+
+const (
+	alertPending  = "pending"
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+)
+
+var alertsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "alerts",
+	Help: "1 for every pending or firing alert, by rule, subject and state",
+}, []string{
+	"alert",
+	"subject",
+	"state",
+})
+
+// Alert is the state of a rule for one subject, a drive, plotter or
+// destination, or empty for the host
+type Alert struct {
+	Name     string     `json:"name"`
+	Subject  string     `json:"subject,omitempty"`
+	State    string     `json:"state"`
+	Value    float64    `json:"value"`
+	Message  string     `json:"message"`
+	Since    time.Time  `json:"since"` // when the condition was first seen
+	Fired    *time.Time `json:"fired,omitempty"`
+	Resolved *time.Time `json:"resolved,omitempty"`
+
+	event Event // details of the subject for the alert events
+}
+
+// alertCondition is a subject a rule currently matches
+type alertCondition struct {
+	subject string
+	value   float64
+	message string
+	event   Event
+}
+
+type alertRule struct {
+	name   string
+	config func(AlertsConfig) AlertRule
+	check  func(a *AlertEngine, r AlertRule, now time.Time) []alertCondition
+}
+
+var alertRules = []alertRule{
+	{"final_drive_low", func(c AlertsConfig) AlertRule { return c.FinalDriveLow }, checkFinalDriveLow},
+	{"temp_drive_full", func(c AlertsConfig) AlertRule { return c.TempDriveFull }, checkTempDriveFull},
+	{"swap_high", func(c AlertsConfig) AlertRule { return c.SwapHigh }, checkSwapHigh},
+	{"plotter_stalled", func(c AlertsConfig) AlertRule { return c.PlotterStalled }, checkPlotterStalled},
+	{"farm_summary_failing", func(c AlertsConfig) AlertRule { return c.FarmSummaryFailing }, checkFarmSummaryFailing},
+	{"harvester_plots_dropping", func(c AlertsConfig) AlertRule { return c.HarvesterPlotsDropping }, checkHarvesterPlots},
+	{"uhaul_destination_down", func(c AlertsConfig) AlertRule { return c.UhaulDestinationDown }, checkUhaulDestinations},
+}
+
+type plotCountSample struct {
+	at    time.Time
+	plots int
+}
+
+// AlertEngine checks the built-in rules and tracks which alerts are firing,
+// alerts are published as events when they fire and resolve
+type AlertEngine struct {
+	lock   sync.Mutex
+	alerts map[string]*Alert // by rule and subject
+
+	harvesterPlots []plotCountSample // within plotDropWindow
+	failedMoves    map[string]string // last uhaul error by destination
+}
+
+var alerts = NewAlertEngine()
+
+func NewAlertEngine() *AlertEngine {
+	return &AlertEngine{alerts: map[string]*Alert{}, failedMoves: map[string]string{}}
+}
+
+// Run checks the rules every alertInterval until ctx is done, config is read
+// each time so reloads apply right away. The first check waits an interval,
+// so the monitors have values and the notifiers are listening
+func (a *AlertEngine) Run(ctx context.Context, config func() AlertsConfig) {
+	moves := events.SubscribeContext(ctx, "alerts", TransferFinished, TransferFailed)
+	tick := time.NewTicker(alertInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e, ok := <-moves:
+			if ok {
+				a.recordMove(e)
+			}
+		case <-tick.C:
+			a.evaluate(config(), time.Now())
+		}
+	}
+}
+
+func (a *AlertEngine) recordMove(e Event) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if e.Type == TransferFailed {
+		a.failedMoves[e.Destination] = e.Error
+	} else {
+		delete(a.failedMoves, e.Destination)
+	}
+}
+
+// evaluate moves alerts between pending, firing and resolved by what the
+// rules match at now
+func (a *AlertEngine) evaluate(cfg AlertsConfig, now time.Time) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	matched := map[string]bool{}
+	for _, r := range alertRules {
+		rule := r.config(cfg)
+		if rule.Disabled {
+			continue // its alerts resolve below
+		}
+		for _, c := range r.check(a, rule, now) {
+			key := r.name + "\x00" + c.subject
+			matched[key] = true
+
+			alert, exists := a.alerts[key]
+			if !exists || alert.State == alertResolved {
+				alert = &Alert{Name: r.name, Subject: c.subject, Since: now}
+				a.alerts[key] = alert
+				a.setState(alert, alertPending)
+			}
+			alert.Value, alert.Message, alert.event = c.value, c.message, c.event
+			if alert.State == alertPending && now.Sub(alert.Since) >= rule.For {
+				alert.Fired = &now
+				a.setState(alert, alertFiring)
+				a.publish(AlertFiring, alert)
+			}
+		}
+	}
+
+	for key, alert := range a.alerts {
+		if matched[key] {
+			continue
+		}
+		switch alert.State {
+		case alertPending:
+			alertsGauge.DeleteLabelValues(alert.Name, alert.Subject, alert.State)
+			delete(a.alerts, key)
+		case alertFiring:
+			alert.Resolved = &now
+			a.setState(alert, alertResolved)
+			a.publish(AlertResolved, alert)
+		case alertResolved:
+			if now.Sub(*alert.Resolved) > resolvedRetention {
+				delete(a.alerts, key)
+			}
+		}
+	}
+}
+
+// setState moves alert to state, only pending and firing alerts are exported
+func (a *AlertEngine) setState(alert *Alert, state string) {
+	if alert.State != "" {
+		alertsGauge.DeleteLabelValues(alert.Name, alert.Subject, alert.State)
+	}
+	alert.State = state
+	if state != alertResolved {
+		alertsGauge.WithLabelValues(alert.Name, alert.Subject, alert.State).Set(1)
+	}
+}
+
+func (a *AlertEngine) publish(t EventType, alert *Alert) {
+	e := alert.event
+	e.Type, e.Alert, e.Message = t, alert.Name, alert.Message
+	events.Publish(e)
+}
+
+// Snapshot returns every alert, firing ones first
+func (a *AlertEngine) Snapshot() []Alert {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	order := map[string]int{alertFiring: 0, alertPending: 1, alertResolved: 2}
+	list := make([]Alert, 0, len(a.alerts))
+	for _, alert := range a.alerts {
+		list = append(list, *alert)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if order[list[i].State] != order[list[j].State] {
+			return order[list[i].State] < order[list[j].State]
+		}
+		return list[i].Since.Before(list[j].Since)
+	})
+	return list
+}
+
+func driveKind(d DriveInfo, kind string) bool {
+	for _, k := range d.Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func checkFinalDriveLow(a *AlertEngine, r AlertRule, now time.Time) []alertCondition {
+	var matches []alertCondition
+	for _, d := range DriveSnapshot() {
+		if !driveKind(d, "final") || d.Error != "" || d.Updated.IsZero() {
+			continue
+		}
+		if plots := float64(d.FreeBytes) / k32PlotBytes; plots < r.Threshold {
+			matches = append(matches, alertCondition{
+				subject: d.Path,
+				value:   plots,
+				message: fmt.Sprintf("'%s' has room for %d more plot(s), %s free", d.Path, int(plots), formatBytes(d.FreeBytes)),
+				event:   Event{Path: d.Path, FreeBytes: d.FreeBytes},
+			})
+		}
+	}
+	return matches
+}
+
+func checkTempDriveFull(a *AlertEngine, r AlertRule, now time.Time) []alertCondition {
+	var matches []alertCondition
+	for _, d := range DriveSnapshot() {
+		total := d.UsedBytes + d.FreeBytes
+		if !driveKind(d, "temp") || d.Error != "" || total == 0 {
+			continue
+		}
+		if used := float64(d.UsedBytes) / float64(total) * 100; used > r.Threshold {
+			matches = append(matches, alertCondition{
+				subject: d.Path,
+				value:   used,
+				message: fmt.Sprintf("'%s' is %.0f%% full, %s free", d.Path, used, formatBytes(d.FreeBytes)),
+				event:   Event{Path: d.Path, FreeBytes: d.FreeBytes},
+			})
+		}
+	}
+	return matches
+}
+
+func checkSwapHigh(a *AlertEngine, r AlertRule, now time.Time) []alertCondition {
+	m := memStatus()
+	if m.SwapTotalBytes == 0 {
+		return nil
+	}
+	used := float64(m.SwapUsedBytes) / float64(m.SwapTotalBytes) * 100
+	if used <= r.Threshold {
+		return nil
+	}
+	return []alertCondition{{
+		value:   used,
+		message: fmt.Sprintf("%.0f%% of swap is used, %s of %s", used, formatBytes(m.SwapUsedBytes), formatBytes(m.SwapTotalBytes)),
+	}}
+}
+
+func checkPlotterStalled(a *AlertEngine, r AlertRule, now time.Time) []alertCondition {
+	var matches []alertCondition
+	for _, p := range plotterStatus() {
+		idle := now.Sub(p.LastSeen)
+		if p.LastSeen.IsZero() || idle.Minutes() <= r.Threshold {
+			continue
+		}
+		matches = append(matches, alertCondition{
+			subject: strconv.Itoa(p.Pid),
+			value:   idle.Seconds(),
+			message: fmt.Sprintf("plotter %d (%s) has printed nothing for %s in phase %s", p.Pid, p.Tag, formatDuration(idle), p.Phase),
+			event:   Event{Tag: p.Tag, PlotID: p.PlotID, Pid: p.Pid, Phase: p.Phase, Path: p.TempDir},
+		})
+	}
+	return matches
+}
+
+func checkFarmSummaryFailing(a *AlertEngine, r AlertRule, now time.Time) []alertCondition {
+	s := CurrentFarmSummary()
+	if !subsystemRunning("farm") || s.Error == "" {
+		return nil
+	}
+	return []alertCondition{{
+		value:   1,
+		message: fmt.Sprintf("'chia farm summary' is failing: %s", s.Error),
+		event:   Event{Error: s.Error},
+	}}
+}
+
+// checkHarvesterPlots compares the harvesters' plot count to the highest
+// within plotDropWindow, so plots that vanish are noticed even if replotting
+// adds others later
+func checkHarvesterPlots(a *AlertEngine, r AlertRule, now time.Time) []alertCondition {
+	s := CurrentFarmSummary()
+	if !subsystemRunning("farm") {
+		a.harvesterPlots = nil
+		return nil
+	}
+	if s.Plots != nil && s.Error == "" {
+		if n := len(a.harvesterPlots); n == 0 || s.Updated.After(a.harvesterPlots[n-1].at) {
+			a.harvesterPlots = append(a.harvesterPlots, plotCountSample{at: s.Updated, plots: *s.Plots})
+		}
+	}
+	for len(a.harvesterPlots) > 0 && now.Sub(a.harvesterPlots[0].at) > plotDropWindow {
+		a.harvesterPlots = a.harvesterPlots[1:]
+	}
+	if len(a.harvesterPlots) == 0 {
+		return nil
+	}
+
+	peak, current := 0, a.harvesterPlots[len(a.harvesterPlots)-1].plots
+	for _, p := range a.harvesterPlots {
+		if p.plots > peak {
+			peak = p.plots
+		}
+	}
+	if dropped := peak - current; dropped > 0 && float64(dropped) >= r.Threshold {
+		return []alertCondition{{
+			value:   float64(dropped),
+			message: fmt.Sprintf("the harvesters lost %d plot(s) within the last hour, %d left", dropped, current),
+		}}
+	}
+	return nil
+}
+
+// checkUhaulDestinations matches final paths that can't be written to or the
+// last move to failed, paused paths are left out
+func checkUhaulDestinations(a *AlertEngine, r AlertRule, now time.Time) []alertCondition {
+	if !subsystemRunning("uhaul") {
+		return nil
+	}
+	var matches []alertCondition
+	for _, o := range uhaulOutdirs() {
+		if uhaulPaused(o.path) {
+			continue
+		}
+		msg := ""
+		if err := unix.Access(o.path, unix.W_OK); err != nil {
+			msg = fmt.Sprintf("can't write to '%s': %v", o.path, err)
+		} else if e, failed := a.failedMoves[o.path]; failed {
+			msg = fmt.Sprintf("the last move to '%s' failed: %s", o.path, e)
+		}
+		if msg != "" {
+			matches = append(matches, alertCondition{
+				subject: o.path,
+				value:   1,
+				message: msg,
+				event:   Event{Destination: o.path},
+			})
+		}
+	}
+	return matches
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAlertStates(t *testing.T) {
+	type step struct {
+		at       time.Duration
+		match    bool
+		disabled bool
+		state    string // "" once the alert is gone
+		events   []EventType
+	}
+	for _, c := range []struct {
+		name    string
+		pending time.Duration
+		steps   []step
+	}{
+		{"fires after For and resolves", 5 * time.Minute, []step{
+			{at: 0, match: true, state: alertPending},
+			{at: 4 * time.Minute, match: true, state: alertPending},
+			{at: 5 * time.Minute, match: true, state: alertFiring, events: []EventType{AlertFiring}},
+			{at: 6 * time.Minute, match: true, state: alertFiring},
+			{at: 7 * time.Minute, state: alertResolved, events: []EventType{AlertResolved}},
+			{at: 7*time.Minute + resolvedRetention, state: alertResolved},
+			{at: 7*time.Minute + resolvedRetention + time.Second, state: ""},
+		}},
+		{"fires right away without For", 0, []step{
+			{at: 0, match: true, state: alertFiring, events: []EventType{AlertFiring}},
+		}},
+		{"pending clears quietly", 5 * time.Minute, []step{
+			{at: 0, match: true, state: alertPending},
+			{at: time.Minute, state: ""},
+			{at: 2 * time.Minute, match: true, state: alertPending},
+			{at: 6 * time.Minute, match: true, state: alertPending},
+			{at: 7 * time.Minute, match: true, state: alertFiring, events: []EventType{AlertFiring}},
+		}},
+		{"fires again after resolving", time.Minute, []step{
+			{at: 0, match: true, state: alertPending},
+			{at: time.Minute, match: true, state: alertFiring, events: []EventType{AlertFiring}},
+			{at: 2 * time.Minute, state: alertResolved, events: []EventType{AlertResolved}},
+			{at: 3 * time.Minute, match: true, state: alertPending},
+			{at: 4 * time.Minute, match: true, state: alertFiring, events: []EventType{AlertFiring}},
+		}},
+		{"disabling resolves", 0, []step{
+			{at: 0, match: true, state: alertFiring, events: []EventType{AlertFiring}},
+			{at: time.Minute, match: true, disabled: true, state: alertResolved, events: []EventType{AlertResolved}},
+		}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var s step
+			saved := alertRules
+			t.Cleanup(func() { alertRules = saved })
+			alertRules = []alertRule{{
+				"alerttest",
+				func(AlertsConfig) AlertRule { return AlertRule{Disabled: s.disabled, For: c.pending} },
+				func(a *AlertEngine, r AlertRule, now time.Time) []alertCondition {
+					if !s.match {
+						return nil
+					}
+					return []alertCondition{{subject: "/mnt/test", value: 1, message: "test"}}
+				},
+			}}
+			ch := events.Subscribe("alerttest", AlertFiring, AlertResolved)
+			t.Cleanup(func() { events.Unsubscribe(ch) })
+
+			a := NewAlertEngine()
+			start := time.Date(2021, 6, 9, 10, 0, 0, 0, time.UTC)
+			for _, s = range c.steps {
+				a.evaluate(AlertsConfig{}, start.Add(s.at))
+
+				state := ""
+				if alert, exists := a.alerts["alerttest\x00/mnt/test"]; exists {
+					state = alert.State
+				}
+				if state != s.state {
+					t.Errorf("at %v got state %q, want %q", s.at, state, s.state)
+				}
+				var got []EventType
+				for len(ch) > 0 {
+					got = append(got, (<-ch).Type)
+				}
+				if !reflect.DeepEqual(got, s.events) {
+					t.Errorf("at %v got events %v, want %v", s.at, got, s.events)
+				}
+			}
+		})
+	}
+}
+
+func TestHarvesterPlotsWindow(t *testing.T) {
+	startSubsystem("farm", func(ctx context.Context) { <-ctx.Done() })
+	t.Cleanup(func() {
+		stopSubsystem("farm")
+		farmSummaryLock.Lock()
+		farmSummary = FarmSummary{}
+		farmSummaryLock.Unlock()
+	})
+
+	start := time.Date(2021, 6, 9, 10, 0, 0, 0, time.UTC)
+	a := NewAlertEngine()
+	for _, s := range []struct {
+		at        time.Duration
+		updated   time.Duration
+		plots     int
+		err       string
+		threshold float64
+		dropped   float64 // 0 if the rule doesn't match
+	}{
+		{at: 0, updated: 0, plots: 100, threshold: 1},
+		{at: 10 * time.Minute, updated: 10 * time.Minute, plots: 95, threshold: 1, dropped: 5},
+		{at: 10 * time.Minute, updated: 10 * time.Minute, plots: 95, threshold: 10},
+		// the same summary isn't counted twice
+		{at: 20 * time.Minute, updated: 10 * time.Minute, plots: 95, threshold: 1, dropped: 5},
+		{at: 30 * time.Minute, updated: 30 * time.Minute, plots: 105, threshold: 1},
+		// failed summaries are left out
+		{at: 40 * time.Minute, updated: 40 * time.Minute, plots: 0, err: "timeout", threshold: 1},
+		{at: 50 * time.Minute, updated: 50 * time.Minute, plots: 100, threshold: 1, dropped: 5},
+		// the peak of 105 fell out of the window
+		{at: 91 * time.Minute, updated: 50 * time.Minute, plots: 100, threshold: 1},
+		{at: 95 * time.Minute, updated: 95 * time.Minute, plots: 90, threshold: 1, dropped: 10},
+	} {
+		plots := s.plots
+		farmSummaryLock.Lock()
+		farmSummary = FarmSummary{Plots: &plots, Updated: start.Add(s.updated), Error: s.err}
+		farmSummaryLock.Unlock()
+
+		got := float64(0)
+		if c := checkHarvesterPlots(a, AlertRule{Threshold: s.threshold}, start.Add(s.at)); len(c) > 0 {
+			got = c[0].value
+		}
+		if got != s.dropped {
+			t.Errorf("at %v got %v plots dropped, want %v", s.at, got, s.dropped)
+		}
+	}
+
+	// samples are dropped while the farm monitor is stopped
+	stopSubsystem("farm")
+	if c := checkHarvesterPlots(a, AlertRule{Threshold: 1}, start.Add(96*time.Minute)); c != nil || a.harvesterPlots != nil {
+		t.Errorf("got %v with %v kept, want nothing while the farm monitor is stopped", c, a.harvesterPlots)
+	}
+}
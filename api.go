@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var apiLog = newLogger("api")
+
+type schedulerEntry struct {
+	Config       PlotterConfig      `json:"config"`
+	MinDelay     string             `json:"minDelay"`
+	StartDelay   string             `json:"startDelay"`
+	Drained      bool               `json:"drained"`
+	LastDecision *SchedulerDecision `json:"lastDecision,omitempty"`
+}
+
+type memoryStatus struct {
+	TotalBytes     uint64 `json:"totalBytes"`
+	AvailableBytes uint64 `json:"availableBytes"`
+	UsedBytes      uint64 `json:"usedBytes"`
+	SwapTotalBytes uint64 `json:"swapTotalBytes"`
+	SwapUsedBytes  uint64 `json:"swapUsedBytes"`
+}
+
+type transferStatus struct {
+	Active []TransferInfo `json:"active"`
+	Queue  []string       `json:"queue"`
+	Paused []string       `json:"paused"`
+}
+
+// registerStatusAPI adds the read-only json endpoints under /api/v1/
+func registerStatusAPI(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/plotters", jsonHandler(func() interface{} {
+		return map[string]interface{}{"plotters": plotterStatus()}
+	}))
+	mux.HandleFunc("/api/v1/scheduler", jsonHandler(func() interface{} {
+		return map[string]interface{}{"plotters": schedulerStatus()}
+	}))
+	mux.HandleFunc("/api/v1/drives", jsonHandler(func() interface{} {
+		return map[string]interface{}{"drives": DriveSnapshot()}
+	}))
+	mux.HandleFunc("/api/v1/transfers", jsonHandler(func() interface{} {
+		return transferStatus{Active: ActiveTransfers(), Queue: UhaulQueue(), Paused: PausedPaths()}
+	}))
+	mux.HandleFunc("/api/v1/memory", jsonHandler(func() interface{} {
+		return memStatus()
+	}))
+	mux.HandleFunc("/api/v1/farm", jsonHandler(func() interface{} {
+		return CurrentFarmSummary()
+	}))
+	mux.HandleFunc("/api/v1/alerts", jsonHandler(func() interface{} {
+		return map[string]interface{}{"alerts": alerts.Snapshot()}
+	}))
+	mux.HandleFunc("/api/v1/logging", jsonHandler(func() interface{} {
+		return LogLevels()
+	}))
+	mux.HandleFunc("/api/v1/history", func(w http.ResponseWriter, r *http.Request) {
+		since := 6 * time.Hour
+		if v := r.URL.Query().Get("since"); v != "" {
+			d, err := parseSince(v)
+			if err != nil {
+				http.Error(w, "invalid since: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			since = d
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"samples": History(time.Now().Add(-since))})
+	})
+	mux.HandleFunc("/api/v1/lifecycle", func(w http.ResponseWriter, r *http.Request) {
+		limit := 50
+		since := time.Time{}
+		if v := r.URL.Query().Get("since"); v != "" {
+			d, err := parseSince(v)
+			if err != nil {
+				http.Error(w, "invalid since: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			since, limit = time.Now().Add(-d), maxLifecycleRecords
+		}
+		if v := r.URL.Query().Get("limit"); v != "" {
+			l, err := strconv.Atoi(v)
+			if err != nil || l < 0 {
+				http.Error(w, "invalid limit", http.StatusBadRequest)
+				return
+			}
+			limit = l
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"plots": recentPlots(limit, since)})
+	})
+	mux.HandleFunc("/api/v1/report", func(w http.ResponseWriter, r *http.Request) {
+		since := 24 * time.Hour
+		if v := r.URL.Query().Get("since"); v != "" {
+			d, err := parseSince(v)
+			if err != nil {
+				http.Error(w, "invalid since: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			since = d
+		}
+		now := time.Now()
+		report := buildReport("Report", now.Add(-since), now)
+
+		var body string
+		var err error
+		switch r.URL.Query().Get("format") {
+		case "", "json":
+			writeJSON(w, http.StatusOK, report)
+			return
+		case "text":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			body, err = report.Text()
+		case "html":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			body, err = report.HTML()
+		default:
+			http.Error(w, "format is json, text or html", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			apiLog.Errorf("Error rendering the report: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, body)
+	})
+	mux.HandleFunc("/api/v1/status", jsonHandler(func() interface{} {
+		return map[string]interface{}{
+			"time":      time.Now(),
+			"plotters":  plotterStatus(),
+			"scheduler": schedulerStatus(),
+			"drives":    DriveSnapshot(),
+			"transfers": transferStatus{Active: ActiveTransfers(), Queue: UhaulQueue(), Paused: PausedPaths()},
+			"memory":    memStatus(),
+			"farm":      CurrentFarmSummary(),
+			"alerts":    alerts.Snapshot(),
+		}
+	}))
+}
+
+func jsonHandler(f func() interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, f())
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		apiLog.Errorf("Error writing response: %v", err)
+	}
+}
+
+func plotterStatus() []PlotterInfo {
+	if processMonitor == nil {
+		return []PlotterInfo{}
+	}
+	return processMonitor.Snapshot()
+}
+
+func schedulerStatus() []schedulerEntry {
+	configs, decisions := SchedulerStatus()
+	entries := []schedulerEntry{}
+	for _, cfg := range configs {
+		entry := schedulerEntry{
+			Config:     cfg,
+			MinDelay:   cfg.MinCooldown.String(),
+			StartDelay: cfg.StartDelay.String(),
+			Drained:    Drained(cfg.Tag),
+		}
+		if d, exists := decisions[cfg.Tag]; exists {
+			entry.LastDecision = &d
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+type lifecycleEntry struct {
+	PlotLifecycle
+	Stage string `json:"stage"`
+}
+
+// recentPlots returns up to limit lifecycle records updated after since,
+// newest first
+func recentPlots(limit int, since time.Time) []lifecycleEntry {
+	records := lifecycle.Records()
+	entries := []lifecycleEntry{}
+	for i := len(records) - 1; i >= 0 && len(entries) < limit; i-- {
+		if records[i].updated().Before(since) {
+			continue
+		}
+		entries = append(entries, lifecycleEntry{PlotLifecycle: records[i], Stage: records[i].Stage()})
+	}
+	return entries
+}
+
+// parseSince parses a duration like time.ParseDuration, also accepting whole
+// days and weeks, ie 7d or 2w
+func parseSince(v string) (time.Duration, error) {
+	units := map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour}
+	if unit, exists := units[v[len(v)-1:]]; exists {
+		n, err := strconv.Atoi(v[:len(v)-1])
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration '%s'", v)
+		}
+		return time.Duration(n) * unit, nil
+	}
+	return time.ParseDuration(v)
+}
+
+func memStatus() memoryStatus {
+	m := currentMeminfo()
+	return memoryStatus{
+		TotalBytes:     m["MemTotal"] * 1024,
+		AvailableBytes: m["MemAvailable"] * 1024,
+		UsedBytes:      (m["MemTotal"] - m["MemAvailable"]) * 1024,
+		SwapTotalBytes: m["SwapTotal"] * 1024,
+		SwapUsedBytes:  (m["SwapTotal"] - m["SwapFree"]) * 1024,
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// test vectors from BIP-350
+func TestDecodeBech32mValid(t *testing.T) {
+	for _, s := range []string{
+		"A1LQFN3A",
+		"a1lqfn3a",
+		"an83characterlonghumanreadablepartthatcontainsthetheexcludedcharactersbioandnumber11sg7hg6",
+		"abcdef1l7aum6echk45nj3s0wdvt2fg8x9yrzpqzd3ryx",
+		"split1checkupstagehandshakeupstreamerranterredcaperredlc445v",
+		"?1v759aa",
+	} {
+		hrp, _, err := decodeBech32m(s)
+		if err != nil {
+			t.Errorf("%s: %v", s, err)
+			continue
+		}
+		if want := strings.ToLower(s[:strings.LastIndexByte(s, '1')]); hrp != want {
+			t.Errorf("%s: prefix is '%s', want '%s'", s, hrp, want)
+		}
+	}
+
+	// valid checksum, but 82 words don't regroup into whole bytes
+	if _, _, err := decodeBech32m("11llllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllludsr8"); err == nil || err.Error() != "invalid padding" {
+		t.Errorf("got %v, want invalid padding", err)
+	}
+}
+
+func TestDecodeBech32mInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		s      string
+		reason string
+	}{
+		{"\x201xj0phk", "prefix character out of range"},
+		{"\x7f1g6xzxy", "prefix character out of range"},
+		{"\x801vctc34", "prefix character out of range"},
+		{"an84characterslonghumanreadablepartthatcontainsthetheexcludedcharactersbioandnumber11d6pts4", "overall max length exceeded"},
+		{"qyrz8wqd2c9m", "no separator"},
+		{"1qyrz8wqd2c9m", "empty prefix"},
+		{"y1b0jsk6g", "invalid data character"},
+		{"lt1igcx5c0", "invalid data character"},
+		{"in1muywd", "too short checksum"},
+		{"mm1crxm3i", "invalid character in checksum"},
+		{"au1s5cgom", "invalid character in checksum"},
+		{"M1VUXWEZ", "checksum calculated with uppercase prefix"},
+		{"16plkw9", "empty prefix"},
+		{"1p2gdwpf", "empty prefix"},
+		{"A1lqfn3a", "mixed case"},
+		// bech32 (BIP-173) checksum rather than bech32m
+		{"a12uel5l", "bech32 checksum"},
+	} {
+		if hrp, data, err := decodeBech32m(tc.s); err == nil {
+			t.Errorf("%q (%s) decoded to '%s' %x", tc.s, tc.reason, hrp, data)
+		}
+	}
+}
+
+// puzzle hashes encoded with the BIP-350 reference implementation
+func TestDecodeBech32mAddress(t *testing.T) {
+	for _, tc := range []struct {
+		address string
+		hrp     string
+		hash    string
+	}{
+		{"xch1qqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqq2u30kz", "xch", "0000000000000000000000000000000000000000000000000000000000000000"},
+		{"xch1tvwkrtfm3cd2tlga8vkjlxeak03ddudj5lydnc8352euf40x7uyqxhyswk", "xch", "5b1d61ad3b8e1aa5fd1d3b2d2f9b3db3e2d6f1b2a7c8d9e0f1a2b3c4d5e6f708"},
+		{"txch1tvwkrtfm3cd2tlga8vkjlxeak03ddudj5lydnc8352euf40x7uyqtsrx09", "txch", "5b1d61ad3b8e1aa5fd1d3b2d2f9b3db3e2d6f1b2a7c8d9e0f1a2b3c4d5e6f708"},
+	} {
+		hrp, data, err := decodeBech32m(tc.address)
+		if err != nil {
+			t.Errorf("%s: %v", tc.address, err)
+			continue
+		}
+		want, _ := hex.DecodeString(tc.hash)
+		if hrp != tc.hrp || !bytes.Equal(data, want) {
+			t.Errorf("%s decoded to '%s' %x, want '%s' %s", tc.address, hrp, data, tc.hrp, tc.hash)
+		}
+		if err := checkPoolKey(tc.address); err != nil {
+			t.Errorf("checkPoolKey(%s): %v", tc.address, err)
+		}
+	}
+
+	// one character changed
+	if err := checkPoolKey("xch1tvwkrtfm3cd2tlga8vkjlxeak03ddudj5lydnc8352euf40x7uyqxhyswq"); err == nil {
+		t.Errorf("checkPoolKey accepted an address with a bad checksum")
+	}
+}
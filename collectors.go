@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var collectorsLog = newLogger("collectors")
+
+// values read by a collector are reused for this long, so several scrapers
+// and the status api don't all hit /proc and the drives
+const collectorCacheTTL = 2 * time.Second
+
+var (
+	scrapeDurationDesc = prometheus.NewDesc(
+		"collector_scrape_duration_seconds",
+		"How long the last read of each collector took",
+		[]string{"collector"}, nil)
+
+	scrapeErrorsDesc = prometheus.NewDesc(
+		"collector_scrape_errors_total",
+		"Reads of each collector that failed or were incomplete",
+		[]string{"collector"}, nil)
+)
+
+func init() {
+	prometheus.MustRegister(
+		newCachedCollector("meminfo", collectMeminfo),
+		newCachedCollector("drives", collectDrives),
+	)
+
+	// the default go_ and process_ metrics are moved under chia_monitor_ so
+	// they don't clash with other exporters on the host
+	prometheus.Unregister(prometheus.NewGoCollector())
+	prometheus.Unregister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	prometheus.WrapRegistererWithPrefix("chia_monitor_", prometheus.DefaultRegisterer).MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+}
+
+// cachedCollector reads its metrics when scraped, at most once every
+// collectorCacheTTL. An error still returns whatever metrics could be read
+type cachedCollector struct {
+	name    string
+	collect func() ([]prometheus.Metric, error)
+
+	lock     sync.Mutex
+	metrics  []prometheus.Metric
+	at       time.Time
+	duration time.Duration
+	errors   float64
+	lastErr  string
+}
+
+func newCachedCollector(name string, collect func() ([]prometheus.Metric, error)) *cachedCollector {
+	return &cachedCollector{name: name, collect: collect}
+}
+
+// Describe sends nothing, the drive metrics depend on the configured paths so
+// these are unchecked collectors
+func (c *cachedCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (c *cachedCollector) Collect(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if time.Since(c.at) >= collectorCacheTTL {
+		start := time.Now()
+		metrics, err := c.collect()
+		c.metrics, c.at, c.duration = metrics, time.Now(), time.Since(start)
+
+		// only log when the problem changes, scrapes come every few seconds
+		msg := ""
+		if err != nil {
+			c.errors++
+			msg = err.Error()
+		}
+		if msg != c.lastErr {
+			if msg != "" {
+				collectorsLog.Warnf("Error reading %s: %s", c.name, msg)
+			} else {
+				collectorsLog.Infof("Reading %s again", c.name)
+			}
+			c.lastErr = msg
+		}
+	}
+
+	for _, m := range c.metrics {
+		ch <- m
+	}
+	ch <- prometheus.MustNewConstMetric(scrapeDurationDesc, prometheus.GaugeValue, c.duration.Seconds(), c.name)
+	ch <- prometheus.MustNewConstMetric(scrapeErrorsDesc, prometheus.CounterValue, c.errors, c.name)
+}
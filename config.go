@@ -1,11 +1,15 @@
 package main
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
 	"time"
 
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
 )
 
 type UhaulConfig struct {
@@ -14,29 +18,257 @@ type UhaulConfig struct {
 }
 
 type PlotterConfig struct {
-	TempPath         string        `yaml:"tempPath"`
-	FinalPath        string        `yaml:"finalPath"`
-	Ram              string        `yaml:"ram"`
-	Tag              string        `yaml:"tag"`
-	Buckets          string        `yaml:"buckets"`
-	Cores            string        `yaml:"cores"`
-	PoolKey          string        `yaml:"poolKey"`
-	StageConcurrency int           `yaml:"maxActivePlotters"`
-	MaxPhase1        int           `yaml:"maxPhase1"`
-	MinCooldown      time.Duration `yaml:"minDelay"`
-	StartDelay       time.Duration `yaml:"startDelay"`
+	TempPath         string        `yaml:"tempPath" json:"tempPath"`
+	FinalPath        string        `yaml:"finalPath" json:"finalPath"`
+	Ram              string        `yaml:"ram" json:"ram"`
+	Tag              string        `yaml:"tag" json:"tag"`
+	Buckets          string        `yaml:"buckets" json:"buckets"`
+	Cores            string        `yaml:"cores" json:"cores"`
+	PoolKey          string        `yaml:"poolKey" json:"-"`
+	StageConcurrency int           `yaml:"maxActivePlotters" json:"maxActivePlotters"`
+	MaxPhase1        int           `yaml:"maxPhase1" json:"maxPhase1"`
+	MinCooldown      time.Duration `yaml:"minDelay" json:"-"`
+	StartDelay       time.Duration `yaml:"startDelay" json:"-"`
 }
 
 type DriveMonitorConfig struct {
 	TempPaths    []string `yaml:"TempPaths"`
 	FinalPaths   []string `yaml:"FinalPaths"`
 	StagingPaths []string `yaml:"StagingPaths"`
+	LowSpaceGB   uint64   `yaml:"LowSpaceGB"`
+}
+
+// ControlToken authenticates a control api client, only admin tokens can
+// change anything
+type ControlToken struct {
+	Name  string `yaml:"name"`
+	Token string `yaml:"token"`
+	Admin bool   `yaml:"admin"`
+}
+
+type ControlConfig struct {
+	Listen string         `yaml:"Listen"` // ie 127.0.0.1:2113
+	Socket string         `yaml:"Socket"` // unix socket path
+	Tokens []ControlToken `yaml:"Tokens"`
+}
+
+// MetricsUser is a basic auth login for the metrics listener
+type MetricsUser struct {
+	Name     string `yaml:"name"`
+	Password string `yaml:"password"`
+}
+
+// MetricsConfig is the listener for /metrics, the status api and the
+// dashboard. When Users or Tokens are set every request needs one of them
+type MetricsConfig struct {
+	Listen  string        `yaml:"Listen"` // default :2112, or -listen
+	Socket  string        `yaml:"Socket"` // unix socket path
+	TLSCert string        `yaml:"TLSCert"`
+	TLSKey  string        `yaml:"TLSKey"`
+	Users   []MetricsUser `yaml:"Users"`  // basic auth
+	Tokens  []string      `yaml:"Tokens"` // bearer tokens
+}
+
+const defaultMetricsListen = ":2112"
+
+// set by -listen, overrides Metrics.Listen
+var listenFlag string
+
+// setMetricsDefaults applies -listen, and listens on the default port unless
+// only a socket was asked for
+func setMetricsDefaults(cfg *MetricsConfig) {
+	if listenFlag != "" {
+		cfg.Listen = listenFlag
+	} else if cfg.Listen == "" && cfg.Socket == "" {
+		cfg.Listen = defaultMetricsListen
+	}
+}
+
+// PushConfig sends metrics to a remote_write endpoint and/or a Pushgateway,
+// for hosts prometheus can't scrape
+type PushConfig struct {
+	RemoteWrite string            `yaml:"RemoteWrite"` // ie https://prometheus:9090/api/v1/write
+	Pushgateway string            `yaml:"Pushgateway"` // ie http://pushgateway:9091
+	Job         string            `yaml:"Job"`         // default chia_monitor
+	Interval    time.Duration     `yaml:"Interval"`    // default 30s
+	Buffer      int               `yaml:"Buffer"`      // remote_write pushes kept while the endpoint is down, default 120
+	Username    string            `yaml:"Username"`
+	Password    string            `yaml:"Password"`
+	BearerToken string            `yaml:"BearerToken"`
+	Labels      map[string]string `yaml:"Labels"` // added to every series along with job and instance
+	Influx      InfluxConfig      `yaml:"Influx"`
+	Graphite    GraphiteConfig    `yaml:"Graphite"`
+}
+
+// InfluxConfig sends line protocol over http and/or udp, series get a host
+// tag and Push.Labels
+type InfluxConfig struct {
+	URL      string `yaml:"URL"`   // ie http://influx:8086/write?db=chia or .../api/v2/write?org=farm&bucket=chia
+	UDP      string `yaml:"UDP"`   // ie telegraf:8089
+	Token    string `yaml:"Token"` // influxdb 2
+	Username string `yaml:"Username"`
+	Password string `yaml:"Password"`
+}
+
+// GraphiteConfig sends the plaintext protocol over tcp
+type GraphiteConfig struct {
+	Address string `yaml:"Address"` // ie graphite:2003
+	Prefix  string `yaml:"Prefix"`  // default chia_monitor
+	Tagged  bool   `yaml:"Tagged"`  // name;tag=value series for graphite 1.1+
+}
+
+func (c PushConfig) enabled() bool {
+	return c.RemoteWrite != "" || c.Pushgateway != "" || c.Influx.URL != "" || c.Influx.UDP != "" || c.Graphite.Address != ""
+}
+
+// MQTTConfig publishes plotter, drive, farm and memory state and plot events
+// for home automation
+type MQTTConfig struct {
+	Broker          string        `yaml:"Broker"`   // ie tcp://mqtt:1883, ssl://mqtt:8883 for TLS
+	ClientID        string        `yaml:"ClientID"` // default chia-monitor-<hostname>
+	Username        string        `yaml:"Username"`
+	Password        string        `yaml:"Password"`
+	Prefix          string        `yaml:"Prefix"`   // default chia_monitor, topics are <Prefix>/<hostname>/...
+	QoS             int           `yaml:"QoS"`      // 0, 1 or 2
+	Interval        time.Duration `yaml:"Interval"` // how often state is published, default 30s
+	Discovery       bool          `yaml:"Discovery"`
+	DiscoveryPrefix string        `yaml:"DiscoveryPrefix"` // default homeassistant
+}
+
+// NotifyConfig is a chat or webhook channel events are sent to
+type NotifyConfig struct {
+	Name      string            `yaml:"Name"`      // in the logs and metrics, default the type
+	Type      string            `yaml:"Type"`      // discord, slack, telegram, webhook or email
+	URL       string            `yaml:"URL"`       // webhook url, or the bot api for telegram (default https://api.telegram.org)
+	Token     string            `yaml:"Token"`     // telegram bot token
+	ChatID    string            `yaml:"ChatID"`    // telegram chat
+	To        []string          `yaml:"To"`        // email recipients, default Email.To
+	Headers   map[string]string `yaml:"Headers"`   // sent with every webhook request
+	Events    []string          `yaml:"Events"`    // event types sent, default plot_completed, plot_failed, transfer_failed, alert_firing and alert_resolved
+	Tags      []string          `yaml:"Tags"`      // only plots of these tags, events without a tag still pass
+	Alerts    []string          `yaml:"Alerts"`    // only these alert rules
+	Templates map[string]string `yaml:"Templates"` // text/template by event type, or digest
+	Batch     time.Duration     `yaml:"Batch"`     // events this close together are sent as one message
+	RateLimit int               `yaml:"RateLimit"` // messages per hour, default 30, the rest wait and are sent as one
+	Digest    []string          `yaml:"Digest"`    // event types collected into a daily digest instead
+	DigestAt  string            `yaml:"DigestAt"`  // local time of the digest, default 08:00
+}
+
+var defaultNotifyEvents = []string{
+	string(PlotCompleted), string(PlotFailed), string(TransferFailed), string(AlertFiring), string(AlertResolved),
+}
+
+// EmailConfig is the smtp server used by email notifications and the report
+type EmailConfig struct {
+	Server   string       `yaml:"Server"` // host:port
+	TLS      string       `yaml:"TLS"`    // starttls (default), tls for implicit tls, usually port 465, or none
+	Username string       `yaml:"Username"`
+	Password string       `yaml:"Password"`
+	From     string       `yaml:"From"`
+	To       []string     `yaml:"To"`
+	Report   ReportConfig `yaml:"Report"`
+}
+
+// ReportConfig schedules the summary report mailed to Email.To
+type ReportConfig struct {
+	Every   string `yaml:"Every"`   // daily or weekly, no report if empty
+	At      string `yaml:"At"`      // local time, default 07:00
+	Weekday string `yaml:"Weekday"` // of weekly reports, default Monday
+}
+
+// HookConfig runs Command with sh -c for every event of Events, the event is
+// passed in CHIA_MONITOR_* environment variables and as json on stdin
+type HookConfig struct {
+	Name        string        `yaml:"Name"` // in the logs and metrics, default the command's file name
+	Command     string        `yaml:"Command"`
+	Events      []string      `yaml:"Events"`
+	Tags        []string      `yaml:"Tags"`        // only plots of these tags, events without a tag still run
+	Dir         string        `yaml:"Dir"`         // working dir, default the monitor's
+	Timeout     time.Duration `yaml:"Timeout"`     // default 5m, then it's killed
+	Concurrency int           `yaml:"Concurrency"` // runs at once, default 1, later events wait their turn
+}
+
+// AlertRule is a built-in alert, it fires once its condition held for For
+type AlertRule struct {
+	Disabled  bool          `yaml:"Disabled"`
+	Threshold float64       `yaml:"Threshold"`
+	For       time.Duration `yaml:"For"`
+}
+
+// AlertsConfig holds the built-in rules, what Threshold means depends on the
+// rule
+type AlertsConfig struct {
+	FinalDriveLow          AlertRule `yaml:"FinalDriveLow"`          // room for fewer than Threshold plots
+	TempDriveFull          AlertRule `yaml:"TempDriveFull"`          // more than Threshold percent used
+	SwapHigh               AlertRule `yaml:"SwapHigh"`               // more than Threshold percent of swap used
+	PlotterStalled         AlertRule `yaml:"PlotterStalled"`         // no plotter output for Threshold minutes
+	FarmSummaryFailing     AlertRule `yaml:"FarmSummaryFailing"`     // 'chia farm summary' keeps failing
+	HarvesterPlotsDropping AlertRule `yaml:"HarvesterPlotsDropping"` // Threshold plots fewer than within the last hour
+	UhaulDestinationDown   AlertRule `yaml:"UhaulDestinationDown"`   // a final path can't be written or the last move to it failed
+}
+
+var defaultAlertsConfig = AlertsConfig{
+	FinalDriveLow:          AlertRule{Threshold: 2, For: 5 * time.Minute},
+	TempDriveFull:          AlertRule{Threshold: 95, For: 10 * time.Minute},
+	SwapHigh:               AlertRule{Threshold: 50, For: 10 * time.Minute},
+	PlotterStalled:         AlertRule{Threshold: 20},
+	FarmSummaryFailing:     AlertRule{For: 10 * time.Minute},
+	HarvesterPlotsDropping: AlertRule{Threshold: 1},
+	UhaulDestinationDown:   AlertRule{For: 2 * time.Minute},
+}
+
+// LogRotateConfig controls when monitor.log is rotated and how many rotated
+// files are kept
+type LogRotateConfig struct {
+	MaxSizeMB int           `yaml:"MaxSizeMB"`
+	MaxAge    time.Duration `yaml:"MaxAge"`
+	Keep      int           `yaml:"Keep"`
+	Compress  bool          `yaml:"Compress"`
+}
+
+// PlotterLogsConfig controls clean up of plotter_logs. Logs are kept for the
+// timing model, so nothing is removed unless MaxAge or MaxSizeMB are set
+type PlotterLogsConfig struct {
+	CompressAfter time.Duration `yaml:"CompressAfter"`
+	MaxAge        time.Duration `yaml:"MaxAge"`
+	MaxSizeMB     int           `yaml:"MaxSizeMB"`
+}
+
+type LoggingConfig struct {
+	Format      string            `yaml:"Format"` // text or json
+	Level       string            `yaml:"Level"`
+	Levels      map[string]string `yaml:"Levels"` // by subsystem
+	File        LogRotateConfig   `yaml:"File"`
+	PlotterLogs PlotterLogsConfig `yaml:"PlotterLogs"`
+}
+
+var defaultLoggingConfig = LoggingConfig{
+	Format: "text",
+	Level:  "info",
+	File: LogRotateConfig{
+		MaxSizeMB: 100,
+		MaxAge:    7 * 24 * time.Hour,
+		Keep:      10,
+		Compress:  true,
+	},
+	PlotterLogs: PlotterLogsConfig{
+		CompressAfter: 2 * 24 * time.Hour,
+	},
 }
 
 type MonitorConfig struct {
 	UhaulConfig         UhaulConfig        `yaml:"UHaul"`
 	DriveMonitorConfig  DriveMonitorConfig `yaml:"DriveMonitor"`
 	PlotterConfig       []*PlotterConfig   `yaml:"Plotter"`
+	ControlConfig       ControlConfig      `yaml:"Control"`
+	MetricsConfig       MetricsConfig      `yaml:"Metrics"`
+	PushConfig          PushConfig         `yaml:"Push"`
+	MQTTConfig          MQTTConfig         `yaml:"MQTT"`
+	AlertsConfig        AlertsConfig       `yaml:"Alerts"`
+	NotifyConfig        []*NotifyConfig    `yaml:"Notify"`
+	EmailConfig         EmailConfig        `yaml:"Email"`
+	HooksConfig         []*HookConfig      `yaml:"Hooks"`
+	LoggingConfig       LoggingConfig      `yaml:"Logging"`
 	ChiaPath            string             `yaml:"ChiaPath"`
 	FarmMonitorEnabled  bool               `yaml:"FarmMonitorEnabled"`
 	UhaulEnabled        bool               `yaml:"UhaulEnabled"`
@@ -45,15 +277,173 @@ type MonitorConfig struct {
 }
 
 func parseConfig(path string) (MonitorConfig, error) {
-	b, err := os.ReadFile(path)
+	config, _, err := decodeConfig(path)
+	return config, err
+}
+
+// loadConfig parses and validates the config at path, validation problems
+// are returned as ConfigErrors along with the parsed config
+func loadConfig(path string) (MonitorConfig, error) {
+	config, root, err := decodeConfig(path)
 	if err != nil {
-		return MonitorConfig{}, err
+		return config, err
+	}
+	if errs := validateConfig(config, root); len(errs) > 0 {
+		return config, errs
 	}
+	return config, nil
+}
 
-	config := MonitorConfig{}
-	err = yaml.Unmarshal(b, &config)
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// migrateDurations handles durations written as bare numbers, which yaml.v2
+// read as nanoseconds and yaml.v3 refuses. 0 still means 0, anything else
+// was most likely meant to have a unit and is an error naming the field
+func migrateDurations(n *yaml.Node, t reflect.Type, path []interface{}) ConfigErrors {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	var errs ConfigErrors
+	switch {
+	case n.Kind == yaml.DocumentNode:
+		for _, c := range n.Content {
+			errs = append(errs, migrateDurations(c, t, path)...)
+		}
+	case t == durationType:
+		if n.Kind != yaml.ScalarNode || n.Tag != "!!int" {
+			break
+		}
+		if v, err := strconv.ParseInt(n.Value, 0, 64); err == nil && v == 0 {
+			n.Tag, n.Value = "!!str", "0s"
+			break
+		}
+		errs = append(errs, ConfigError{
+			Line:  n.Line,
+			Field: fieldName(path),
+			Msg:   fmt.Sprintf("'%s' needs a unit, ie %ss or %sm (older versions read a bare number as nanoseconds)", n.Value, n.Value, n.Value),
+		})
+	case n.Kind == yaml.SequenceNode && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array):
+		for i, c := range n.Content {
+			errs = append(errs, migrateDurations(c, t.Elem(), append(path[:len(path):len(path)], i))...)
+		}
+	case n.Kind == yaml.MappingNode && t.Kind() == reflect.Map:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i].Value
+			errs = append(errs, migrateDurations(n.Content[i+1], t.Elem(), append(path[:len(path):len(path)], key))...)
+		}
+	case n.Kind == yaml.MappingNode && t.Kind() == reflect.Struct:
+		fields := map[string]reflect.Type{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = strings.ToLower(f.Name)
+			}
+			fields[name] = f.Type
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i].Value
+			if ft, known := fields[key]; known {
+				errs = append(errs, migrateDurations(n.Content[i+1], ft, append(path[:len(path):len(path)], key))...)
+			}
+		}
+	}
+	return errs
+}
+
+// decodeConfig reads the config at path and fills in the defaults, the yaml
+// document is returned so problems can be traced back to their line
+func decodeConfig(path string) (MonitorConfig, *yaml.Node, error) {
+	b, err := os.ReadFile(path)
 	if err != nil {
-		return MonitorConfig{}, err
+		return MonitorConfig{}, nil, err
+	}
+
+	root := &yaml.Node{}
+	if err := yaml.Unmarshal(b, root); err != nil {
+		return MonitorConfig{}, nil, err
+	}
+
+	config := MonitorConfig{LoggingConfig: defaultLoggingConfig, AlertsConfig: defaultAlertsConfig}
+	if errs := migrateDurations(root, reflect.TypeOf(config), nil); len(errs) > 0 {
+		return MonitorConfig{}, root, errs
+	}
+	if len(root.Content) > 0 { // empty file
+		if err := root.Decode(&config); err != nil {
+			return MonitorConfig{}, nil, err
+		}
+	}
+
+	setMetricsDefaults(&config.MetricsConfig)
+	if config.PushConfig.Job == "" {
+		config.PushConfig.Job = "chia_monitor"
+	}
+	if config.PushConfig.Interval == 0 {
+		config.PushConfig.Interval = 30 * time.Second
+	}
+	if config.PushConfig.Graphite.Prefix == "" {
+		config.PushConfig.Graphite.Prefix = "chia_monitor"
+	}
+	if config.MQTTConfig.Prefix == "" {
+		config.MQTTConfig.Prefix = "chia_monitor"
+	}
+	if config.MQTTConfig.Interval == 0 {
+		config.MQTTConfig.Interval = 30 * time.Second
+	}
+	if config.MQTTConfig.DiscoveryPrefix == "" {
+		config.MQTTConfig.DiscoveryPrefix = "homeassistant"
+	}
+	if config.PushConfig.Buffer == 0 {
+		config.PushConfig.Buffer = 120 // an hour at 30s
+	}
+	if config.DriveMonitorConfig.LowSpaceGB == 0 {
+		config.DriveMonitorConfig.LowSpaceGB = 110 // a bit more than a k32 plot
+	}
+
+	if config.EmailConfig.TLS == "" {
+		config.EmailConfig.TLS = "starttls"
+	}
+	if config.EmailConfig.Report.At == "" {
+		config.EmailConfig.Report.At = "07:00"
+	}
+	if config.EmailConfig.Report.Weekday == "" {
+		config.EmailConfig.Report.Weekday = "Monday"
+	}
+
+	for _, h := range config.HooksConfig {
+		if h.Name == "" {
+			if fields := strings.Fields(h.Command); len(fields) > 0 {
+				h.Name = filepath.Base(fields[0])
+			}
+		}
+		if h.Timeout == 0 {
+			h.Timeout = 5 * time.Minute
+		}
+		if h.Concurrency == 0 {
+			h.Concurrency = 1
+		}
+	}
+
+	for _, n := range config.NotifyConfig {
+		if n.Name == "" {
+			n.Name = n.Type
+		}
+		if n.Events == nil {
+			n.Events = append([]string{}, defaultNotifyEvents...)
+		}
+		if n.RateLimit == 0 {
+			n.RateLimit = 30
+		}
+		if n.DigestAt == "" {
+			n.DigestAt = "08:00"
+		}
+		if n.Type == "telegram" && n.URL == "" {
+			n.URL = "https://api.telegram.org"
+		}
 	}
 
 	for _, v := range config.PlotterConfig {
@@ -69,13 +459,13 @@ func parseConfig(path string) (MonitorConfig, error) {
 			v.Cores = "2"
 		}
 
-		v.TempPath = filepath.Clean(v.TempPath)
-		v.FinalPath = filepath.Clean(v.FinalPath)
-
 		if v.TempPath == "" {
 			v.TempPath = v.FinalPath
 		}
+
+		v.TempPath = filepath.Clean(v.TempPath)
+		v.FinalPath = filepath.Clean(v.FinalPath)
 	}
 
-	return config, err
+	return config, root, nil
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, yaml string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// configs written for yaml.v2 often had bare zeros for durations
+func TestDecodeConfigOldStyleDurations(t *testing.T) {
+	path := writeConfig(t, `
+Plotter:
+  - tag: ssd0
+    tempPath: /tmp
+    finalPath: /tmp
+    startDelay: 0
+    minDelay: 0
+Push:
+  Interval: 0
+Logging:
+  PlotterLogs:
+    MaxAge: 0
+Alerts:
+  SwapHigh:
+    For: 0
+`)
+
+	cfg, _, err := decodeConfig(path)
+	if err != nil {
+		t.Fatalf("decodeConfig: %v", err)
+	}
+	if len(cfg.PlotterConfig) != 1 {
+		t.Fatalf("got %d plotters, want 1", len(cfg.PlotterConfig))
+	}
+	p := cfg.PlotterConfig[0]
+	if p.StartDelay != 0 || p.MinCooldown != 0 {
+		t.Errorf("startDelay/minDelay = %v/%v, want 0", p.StartDelay, p.MinCooldown)
+	}
+	if cfg.PushConfig.Interval != 30*time.Second {
+		t.Errorf("Push.Interval = %v, want the 30s default", cfg.PushConfig.Interval)
+	}
+	if cfg.LoggingConfig.PlotterLogs.MaxAge != 0 {
+		t.Errorf("PlotterLogs.MaxAge = %v, want 0", cfg.LoggingConfig.PlotterLogs.MaxAge)
+	}
+	if cfg.AlertsConfig.SwapHigh.For != 0 || cfg.AlertsConfig.SwapHigh.Threshold != 50 {
+		t.Errorf("SwapHigh = %+v, want For 0 and the default threshold", cfg.AlertsConfig.SwapHigh)
+	}
+}
+
+func TestDecodeConfigBareDurationIsAnError(t *testing.T) {
+	path := writeConfig(t, `Plotter:
+  - tag: ssd0
+    startDelay: 90m
+    minDelay: 3600
+Notify:
+  - Type: webhook
+    URL: http://127.0.0.1/hook
+    Batch: 5
+`)
+
+	_, _, err := decodeConfig(path)
+	var errs ConfigErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("got %v, want ConfigErrors", err)
+	}
+	want := []struct {
+		line  int
+		field string
+	}{
+		{4, "Plotter[0].minDelay"},
+		{8, "Notify[0].Batch"},
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("got %d errors, want %d: %v", len(errs), len(want), errs)
+	}
+	for i, w := range want {
+		if errs[i].Line != w.line || errs[i].Field != w.field {
+			t.Errorf("error %d is line %d %s, want line %d %s", i, errs[i].Line, errs[i].Field, w.line, w.field)
+		}
+		if !strings.Contains(errs[i].Msg, "needs a unit") {
+			t.Errorf("error %d doesn't explain the fix: %s", i, errs[i].Msg)
+		}
+	}
+}
@@ -0,0 +1,554 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gopkg.in/yaml.v3"
+)
+
+var labelNameRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// ConfigError is a single problem found in the config, Line is 0 when the
+// setting isn't in the file
+type ConfigError struct {
+	Line  int
+	Field string
+	Msg   string
+}
+
+func (e ConfigError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("line %d: %s: %s", e.Line, e.Field, e.Msg)
+	}
+	return fmt.Sprintf("%s: %s", e.Field, e.Msg)
+}
+
+// ConfigErrors is every problem found in a config, ordered by line
+type ConfigErrors []ConfigError
+
+func (e ConfigErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+type configValidator struct {
+	root *yaml.Node
+	errs ConfigErrors
+}
+
+// validateConfig checks the config for problems the monitor would otherwise
+// only hit at runtime, root is the yaml document the config came from
+func validateConfig(cfg MonitorConfig, root *yaml.Node) ConfigErrors {
+	v := &configValidator{root: root}
+
+	tags := map[string]int{}
+	temps := map[string]int{}
+	for i, p := range cfg.PlotterConfig {
+		field := func(name string) []interface{} { return []interface{}{"Plotter", i, name} }
+
+		if p.Tag == "" {
+			v.errorf(field("tag"), "is required")
+		} else if first, exists := tags[p.Tag]; exists {
+			v.errorf(field("tag"), "'%s' is already used by Plotter[%d]", p.Tag, first)
+		} else {
+			tags[p.Tag] = i
+		}
+
+		if first, exists := temps[p.TempPath]; exists {
+			v.errorf(field("tempPath"), "'%s' is already used by Plotter[%d], only one plotter entry can use a temp path", p.TempPath, first)
+		} else {
+			temps[p.TempPath] = i
+		}
+
+		v.number(field("ram"), p.Ram, 1)
+		v.number(field("cores"), p.Cores, 1)
+		if n, ok := v.number(field("buckets"), p.Buckets, 16); ok && (n > 128 || n&(n-1) != 0) {
+			v.errorf(field("buckets"), "%d is not a power of 2 between 16 and 128", n)
+		}
+
+		if p.StageConcurrency < 1 {
+			v.errorf(field("maxActivePlotters"), "must be at least 1")
+		}
+		if p.MaxPhase1 < 1 {
+			v.errorf(field("maxPhase1"), "must be at least 1")
+		}
+
+		if p.FinalPath == "." {
+			v.errorf(field("finalPath"), "is required")
+		} else {
+			v.dir(field("finalPath"), p.FinalPath)
+		}
+		if p.TempPath != p.FinalPath {
+			v.dir(field("tempPath"), p.TempPath)
+		}
+		if p.PoolKey != "" {
+			if err := checkPoolKey(p.PoolKey); err != nil {
+				v.errorf(field("poolKey"), "%v", err)
+			}
+		}
+	}
+
+	if cfg.PlotterEnabled || cfg.FarmMonitorEnabled {
+		if cfg.ChiaPath == "" {
+			v.errorf([]interface{}{"ChiaPath"}, "is required when the plotter or farm monitor is enabled")
+		} else {
+			v.dir([]interface{}{"ChiaPath"}, cfg.ChiaPath)
+		}
+	}
+
+	uhaul := cfg.UhaulConfig
+	for i, path := range uhaul.StagingPaths {
+		v.dir([]interface{}{"UHaul", "StagingPaths", i}, path)
+	}
+	for i, path := range uhaul.FinalPaths {
+		v.dir([]interface{}{"UHaul", "FinalPaths", i}, path)
+	}
+
+	drives := cfg.DriveMonitorConfig
+	for i, path := range drives.TempPaths {
+		v.dir([]interface{}{"DriveMonitor", "TempPaths", i}, path)
+	}
+	for i, path := range drives.StagingPaths {
+		v.dir([]interface{}{"DriveMonitor", "StagingPaths", i}, path)
+	}
+	for i, path := range drives.FinalPaths {
+		v.dir([]interface{}{"DriveMonitor", "FinalPaths", i}, path)
+	}
+
+	if cfg.UhaulEnabled && cfg.DriveMonitorEnabled {
+		for i, path := range uhaul.StagingPaths {
+			if !containsPath(drives.StagingPaths, path) {
+				v.errorf([]interface{}{"UHaul", "StagingPaths", i}, "'%s' is missing from DriveMonitor.StagingPaths", path)
+			}
+		}
+		for i, path := range uhaul.FinalPaths {
+			if !containsPath(drives.FinalPaths, path) {
+				v.errorf([]interface{}{"UHaul", "FinalPaths", i}, "'%s' is missing from DriveMonitor.FinalPaths", path)
+			}
+		}
+	}
+
+	if cfg.ControlConfig.Listen != "" && len(cfg.ControlConfig.Tokens) == 0 {
+		v.errorf([]interface{}{"Control", "Listen"}, "needs at least one token in Control.Tokens")
+	}
+	for i, t := range cfg.ControlConfig.Tokens {
+		if t.Token == "" {
+			v.errorf([]interface{}{"Control", "Tokens", i}, "token is empty")
+		}
+	}
+
+	metrics := cfg.MetricsConfig
+	if metrics.Listen != "" {
+		if _, _, err := net.SplitHostPort(metrics.Listen); err != nil {
+			v.errorf([]interface{}{"Metrics", "Listen"}, "%v", err)
+		}
+	}
+	if (metrics.TLSCert == "") != (metrics.TLSKey == "") {
+		v.errorf([]interface{}{"Metrics"}, "TLSCert and TLSKey have to be set together")
+	} else if metrics.TLSCert != "" {
+		if _, err := tls.LoadX509KeyPair(metrics.TLSCert, metrics.TLSKey); err != nil {
+			v.errorf([]interface{}{"Metrics", "TLSCert"}, "%v", err)
+		}
+	}
+	for i, u := range metrics.Users {
+		if u.Name == "" || u.Password == "" {
+			v.errorf([]interface{}{"Metrics", "Users", i}, "name and password are required")
+		}
+	}
+	for i, t := range metrics.Tokens {
+		if t == "" {
+			v.errorf([]interface{}{"Metrics", "Tokens", i}, "token is empty")
+		}
+	}
+
+	push := cfg.PushConfig
+	urls := map[string][]interface{}{
+		push.RemoteWrite: {"Push", "RemoteWrite"},
+		push.Pushgateway: {"Push", "Pushgateway"},
+		push.Influx.URL:  {"Push", "Influx", "URL"},
+	}
+	for u, path := range urls {
+		if parsed, err := url.Parse(u); u != "" && (err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "") {
+			v.errorf(path, "'%s' is not an http(s) url", u)
+		}
+	}
+	addrs := map[string][]interface{}{
+		push.Influx.UDP:       {"Push", "Influx", "UDP"},
+		push.Graphite.Address: {"Push", "Graphite", "Address"},
+	}
+	for addr, path := range addrs {
+		if _, _, err := net.SplitHostPort(addr); addr != "" && err != nil {
+			v.errorf(path, "%v", err)
+		}
+	}
+	if strings.ContainsAny(push.Graphite.Prefix, " ;") {
+		v.errorf([]interface{}{"Push", "Graphite", "Prefix"}, "'%s' can't contain spaces or ;", push.Graphite.Prefix)
+	}
+	if push.Interval < time.Second {
+		v.errorf([]interface{}{"Push", "Interval"}, "%v is less than 1s", push.Interval)
+	}
+	if push.Buffer < 1 {
+		v.errorf([]interface{}{"Push", "Buffer"}, "must be at least 1")
+	}
+	if push.BearerToken != "" && push.Username != "" {
+		v.errorf([]interface{}{"Push"}, "use either Username/Password or BearerToken")
+	}
+	for name := range push.Labels {
+		if !labelNameRegex.MatchString(name) || strings.HasPrefix(name, "__") {
+			v.errorf([]interface{}{"Push", "Labels", name}, "'%s' is not a valid label name", name)
+		} else if name == "job" || name == "instance" {
+			v.errorf([]interface{}{"Push", "Labels", name}, "'%s' is set by the monitor, use Job or leave it out", name)
+		}
+	}
+
+	mqtt := cfg.MQTTConfig
+	if mqtt.Broker != "" {
+		u, err := url.Parse(mqtt.Broker)
+		schemes := map[string]bool{"tcp": true, "mqtt": true, "ssl": true, "tls": true, "mqtts": true}
+		if err != nil || !schemes[u.Scheme] || u.Hostname() == "" {
+			v.errorf([]interface{}{"MQTT", "Broker"}, "'%s' is not a tcp://, mqtt://, ssl://, tls:// or mqtts:// url", mqtt.Broker)
+		}
+	}
+	if mqtt.QoS < 0 || mqtt.QoS > 2 {
+		v.errorf([]interface{}{"MQTT", "QoS"}, "%d is not 0, 1 or 2", mqtt.QoS)
+	}
+	if mqtt.Interval < time.Second {
+		v.errorf([]interface{}{"MQTT", "Interval"}, "%v is less than 1s", mqtt.Interval)
+	}
+	if mqtt.Password != "" && mqtt.Username == "" {
+		v.errorf([]interface{}{"MQTT", "Password"}, "needs a Username")
+	}
+	for name, topic := range map[string]string{"Prefix": mqtt.Prefix, "DiscoveryPrefix": mqtt.DiscoveryPrefix} {
+		if strings.ContainsAny(topic, "+#") {
+			v.errorf([]interface{}{"MQTT", name}, "'%s' can't contain the wildcards + or #", topic)
+		}
+	}
+
+	names := map[string]int{}
+	for i, n := range cfg.NotifyConfig {
+		field := func(name string) []interface{} { return []interface{}{"Notify", i, name} }
+
+		if first, exists := names[n.Name]; exists {
+			v.errorf(field("Name"), "'%s' is already used by Notify[%d]", n.Name, first)
+		} else {
+			names[n.Name] = i
+		}
+		switch n.Type {
+		case "discord", "slack", "telegram", "webhook":
+			if parsed, err := url.Parse(n.URL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				// the url isn't repeated, chat webhook urls hold their token
+				v.errorf(field("URL"), "is not an http(s) url")
+			}
+		case "email":
+			if cfg.EmailConfig.Server == "" {
+				v.errorf(field("Type"), "email needs an Email Server")
+			} else if len(n.To) == 0 && len(cfg.EmailConfig.To) == 0 {
+				v.errorf(field("To"), "no recipients, set To here or under Email")
+			}
+		default:
+			v.errorf(field("Type"), "'%s' is not discord, slack, telegram, webhook or email", n.Type)
+		}
+		for j, addr := range n.To {
+			if _, err := mail.ParseAddress(addr); err != nil {
+				v.errorf(append(field("To"), j), "'%s' is not an email address", addr)
+			}
+		}
+		if n.Type == "telegram" && (n.Token == "" || n.ChatID == "") {
+			v.errorf(field("Type"), "telegram needs a Token and ChatID")
+		}
+		for j, t := range append(append([]string{}, n.Events...), n.Digest...) {
+			key := field("Events")
+			if j >= len(n.Events) {
+				key = field("Digest")
+			}
+			if !knownEventType(t) {
+				v.errorf(key, "unknown event type '%s'", t)
+			}
+		}
+		for name := range n.Templates {
+			if _, known := defaultNotifyTemplates[name]; !known {
+				v.errorf(append(field("Templates"), name), "'%s' is neither an event type nor digest", name)
+			}
+		}
+		if _, err := parseNotifyTemplates(*n); err != nil {
+			v.errorf(field("Templates"), "%v", err)
+		}
+		if n.Batch < 0 {
+			v.errorf(field("Batch"), "can't be negative")
+		}
+		if n.RateLimit < 1 {
+			v.errorf(field("RateLimit"), "must be at least 1 message an hour")
+		}
+		if _, err := time.Parse("15:04", n.DigestAt); err != nil {
+			v.errorf(field("DigestAt"), "'%s' is not a time like 08:00", n.DigestAt)
+		}
+	}
+
+	hooks := map[string]int{}
+	for i, h := range cfg.HooksConfig {
+		field := func(name string) []interface{} { return []interface{}{"Hooks", i, name} }
+
+		if strings.TrimSpace(h.Command) == "" {
+			v.errorf(field("Command"), "is required")
+		} else if first, exists := hooks[h.Name]; exists {
+			v.errorf(field("Name"), "'%s' is already used by Hooks[%d]", h.Name, first)
+		} else {
+			hooks[h.Name] = i
+		}
+		if len(h.Events) == 0 {
+			v.errorf(field("Events"), "at least one event type is required")
+		}
+		for j, t := range h.Events {
+			if !knownEventType(t) {
+				v.errorf(append(field("Events"), j), "unknown event type '%s'", t)
+			}
+		}
+		if h.Dir != "" {
+			if info, err := os.Stat(h.Dir); err != nil || !info.IsDir() {
+				v.errorf(field("Dir"), "'%s' is not a directory", h.Dir)
+			}
+		}
+		if h.Timeout < 0 {
+			v.errorf(field("Timeout"), "can't be negative")
+		}
+		if h.Concurrency < 0 {
+			v.errorf(field("Concurrency"), "can't be negative")
+		}
+	}
+
+	email := cfg.EmailConfig
+	if email.Server != "" || email.Report.Every != "" {
+		field := func(name ...interface{}) []interface{} { return append([]interface{}{"Email"}, name...) }
+
+		host, port, err := net.SplitHostPort(email.Server)
+		if err != nil || host == "" || port == "" {
+			v.errorf(field("Server"), "'%s' is not host:port", email.Server)
+		}
+		if email.TLS != "starttls" && email.TLS != "tls" && email.TLS != "none" {
+			v.errorf(field("TLS"), "'%s' is not starttls, tls or none", email.TLS)
+		} else if email.TLS == "none" && email.Username != "" && host != "localhost" && !net.ParseIP(host).IsLoopback() {
+			v.errorf(field("TLS"), "the password would be sent unencrypted, use starttls or tls")
+		}
+		if _, err := mail.ParseAddress(email.From); err != nil {
+			v.errorf(field("From"), "'%s' is not an email address", email.From)
+		}
+		for i, addr := range email.To {
+			if _, err := mail.ParseAddress(addr); err != nil {
+				v.errorf(field("To", i), "'%s' is not an email address", addr)
+			}
+		}
+
+		report := email.Report
+		switch report.Every {
+		case "":
+		case "daily", "weekly":
+			if len(email.To) == 0 {
+				v.errorf(field("To"), "the report needs at least one recipient")
+			}
+		default:
+			v.errorf(field("Report", "Every"), "'%s' is neither daily nor weekly", report.Every)
+		}
+		if _, err := time.Parse("15:04", report.At); err != nil {
+			v.errorf(field("Report", "At"), "'%s' is not a time like 07:00", report.At)
+		}
+		if _, valid := parseWeekday(report.Weekday); !valid {
+			v.errorf(field("Report", "Weekday"), "'%s' is not a day of the week", report.Weekday)
+		}
+	}
+
+	rules := cfg.AlertsConfig
+	for name, r := range map[string]AlertRule{
+		"FinalDriveLow": rules.FinalDriveLow, "TempDriveFull": rules.TempDriveFull, "SwapHigh": rules.SwapHigh,
+		"PlotterStalled": rules.PlotterStalled, "FarmSummaryFailing": rules.FarmSummaryFailing,
+		"HarvesterPlotsDropping": rules.HarvesterPlotsDropping, "UhaulDestinationDown": rules.UhaulDestinationDown,
+	} {
+		if r.For < 0 {
+			v.errorf([]interface{}{"Alerts", name, "For"}, "can't be negative")
+		}
+	}
+	if rules.FinalDriveLow.Threshold <= 0 {
+		v.errorf([]interface{}{"Alerts", "FinalDriveLow", "Threshold"}, "must be more than 0 plots")
+	}
+	for name, r := range map[string]AlertRule{"TempDriveFull": rules.TempDriveFull, "SwapHigh": rules.SwapHigh} {
+		if r.Threshold <= 0 || r.Threshold >= 100 {
+			v.errorf([]interface{}{"Alerts", name, "Threshold"}, "%v is not a percentage between 0 and 100", r.Threshold)
+		}
+	}
+	// plotters are dropped after 30 minutes without output
+	if t := rules.PlotterStalled.Threshold; t <= 0 || t >= 30 {
+		v.errorf([]interface{}{"Alerts", "PlotterStalled", "Threshold"}, "%v is not between 0 and 30 minutes", t)
+	}
+	if rules.HarvesterPlotsDropping.Threshold < 1 {
+		v.errorf([]interface{}{"Alerts", "HarvesterPlotsDropping", "Threshold"}, "must be at least 1 plot")
+	}
+
+	logging := cfg.LoggingConfig
+	if logging.Format != "text" && logging.Format != "json" {
+		v.errorf([]interface{}{"Logging", "Format"}, "'%s' is neither text nor json", logging.Format)
+	}
+	if _, err := parseLevel(logging.Level); err != nil {
+		v.errorf([]interface{}{"Logging", "Level"}, "%v", err)
+	}
+	for subsystem, level := range logging.Levels {
+		if _, err := parseLevel(level); err != nil {
+			v.errorf([]interface{}{"Logging", "Levels", subsystem}, "%v", err)
+		} else if !LogLevels().known(subsystem) {
+			v.errorf([]interface{}{"Logging", "Levels", subsystem}, "unknown subsystem '%s'", subsystem)
+		}
+	}
+	if logging.File.MaxSizeMB < 0 || logging.File.Keep < 0 || logging.PlotterLogs.MaxSizeMB < 0 {
+		v.errorf([]interface{}{"Logging"}, "sizes and Keep can't be negative")
+	}
+
+	sort.SliceStable(v.errs, func(i, j int) bool { return v.errs[i].Line < v.errs[j].Line })
+	return v.errs
+}
+
+func (v *configValidator) errorf(path []interface{}, format string, a ...interface{}) {
+	v.errs = append(v.errs, ConfigError{
+		Line:  nodeLine(v.root, path),
+		Field: fieldName(path),
+		Msg:   fmt.Sprintf(format, a...),
+	})
+}
+
+// number checks s is a whole number of at least min
+func (v *configValidator) number(path []interface{}, s string, min int) (int, bool) {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		v.errorf(path, "'%s' is not a number", s)
+		return 0, false
+	}
+	if n < min {
+		v.errorf(path, "%d is less than %d", n, min)
+		return n, false
+	}
+	return n, true
+}
+
+// dir checks path is an existing directory, and that it isn't sitting on the
+// root filesystem when it looks like it should be on its own drive
+func (v *configValidator) dir(path []interface{}, dir string) {
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		v.errorf(path, "'%s' does not exist", dir)
+		return
+	}
+	if err != nil {
+		v.errorf(path, "%v", err)
+		return
+	}
+	if !info.IsDir() {
+		v.errorf(path, "'%s' is not a directory", dir)
+		return
+	}
+
+	abs, _ := filepath.Abs(dir)
+	if !strings.HasPrefix(abs, "/media/") && !strings.HasPrefix(abs, "/mnt/") {
+		return
+	}
+	var rootStat, dirStat unix.Stat_t
+	if unix.Stat("/", &rootStat) == nil && unix.Stat(dir, &dirStat) == nil && rootStat.Dev == dirStat.Dev {
+		v.errorf(path, "'%s' is on the root filesystem, is the drive mounted?", dir)
+	}
+}
+
+func containsPath(paths []string, path string) bool {
+	for _, p := range paths {
+		if filepath.Clean(p) == filepath.Clean(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPoolKey accepts an xch1 pool contract address or a hex encoded pool
+// public key
+func checkPoolKey(key string) error {
+	if strings.HasPrefix(key, "xch1") || strings.HasPrefix(key, "txch1") {
+		_, data, err := decodeBech32m(key)
+		if err != nil {
+			return fmt.Errorf("'%s' is not a valid address: %v", key, err)
+		}
+		if len(data) != 32 {
+			return fmt.Errorf("'%s' decodes to %d bytes, expected a 32 byte puzzle hash", key, len(data))
+		}
+		return nil
+	}
+
+	b, err := hex.DecodeString(strings.TrimPrefix(key, "0x"))
+	if err != nil {
+		return fmt.Errorf("'%s' is neither an xch1 contract address nor a hex pool public key", key)
+	}
+	if len(b) != 48 {
+		return fmt.Errorf("pool public key is %d bytes, expected 48", len(b))
+	}
+	return nil
+}
+
+// nodeLine finds the line of the setting at path (map keys and list
+// indexes), or of its closest parent when it isn't in the file
+func nodeLine(root *yaml.Node, path []interface{}) int {
+	if root == nil {
+		return 0
+	}
+	n := root
+	if n.Kind == yaml.DocumentNode && len(n.Content) > 0 {
+		n = n.Content[0]
+	}
+
+	line := 0
+	for _, p := range path {
+		var next *yaml.Node
+		switch p := p.(type) {
+		case string:
+			for i := 0; n.Kind == yaml.MappingNode && i+1 < len(n.Content); i += 2 {
+				if n.Content[i].Value == p {
+					line, next = n.Content[i].Line, n.Content[i+1]
+				}
+			}
+		case int:
+			if n.Kind == yaml.SequenceNode && p < len(n.Content) {
+				next = n.Content[p]
+				line = next.Line
+			}
+		}
+		if next == nil {
+			break
+		}
+		n = next
+	}
+	return line
+}
+
+func fieldName(path []interface{}) string {
+	name := ""
+	for _, p := range path {
+		switch p := p.(type) {
+		case string:
+			if name != "" {
+				name += "."
+			}
+			name += p
+		case int:
+			name += fmt.Sprintf("[%d]", p)
+		}
+	}
+	return name
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+var controlLog = newLogger("control")
+
+type controlClient struct {
+	name  string
+	admin bool
+}
+
+type controlClientKey struct{}
+
+// controlServer wraps the status and control endpoints with token auth.
+// Read-only tokens can GET, changing anything needs an admin token
+type controlServer struct {
+	cfg    ControlConfig
+	mux    *http.ServeMux
+	socket bool
+}
+
+type controlRequest struct {
+	Tag       string `json:"tag,omitempty"`
+	Pid       int    `json:"pid,omitempty"`
+	Path      string `json:"path,omitempty"`
+	Subsystem string `json:"subsystem,omitempty"`
+	Level     string `json:"level,omitempty"`
+}
+
+type controlResponse struct {
+	OK      bool   `json:"ok"`
+	Message string `json:"message"`
+}
+
+// startControlAPI serves the control api until ctx is done
+func startControlAPI(ctx context.Context, cfg ControlConfig) {
+	mux := http.NewServeMux()
+	registerStatusAPI(mux)
+	registerControlActions(mux)
+
+	var wg sync.WaitGroup
+	serve := func(l net.Listener, s *controlServer) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := serveHTTP(ctx, l, s); err != nil {
+				controlLog.Errorf("Server stopped: %v", err)
+			}
+		}()
+	}
+
+	if cfg.Socket != "" {
+		os.Remove(cfg.Socket) // left over from a previous run
+		l, err := net.Listen("unix", cfg.Socket)
+		if err != nil {
+			controlLog.Errorf("Error listening on '%s': %v", cfg.Socket, err)
+		} else {
+			os.Chmod(cfg.Socket, 0660)
+			if len(cfg.Tokens) == 0 {
+				controlLog.Warnf("No tokens configured, anyone who can open '%s' has admin access", cfg.Socket)
+			}
+			controlLog.Infof("Listening on unix socket '%s'", cfg.Socket)
+			serve(l, &controlServer{cfg: cfg, mux: mux, socket: true})
+		}
+	}
+
+	if cfg.Listen != "" && len(cfg.Tokens) == 0 {
+		controlLog.Warnf("Not listening on %s, no tokens configured", cfg.Listen)
+	} else if cfg.Listen != "" {
+		l, err := net.Listen("tcp", cfg.Listen)
+		if err != nil {
+			controlLog.Errorf("Error listening on %s: %v", cfg.Listen, err)
+		} else {
+			controlLog.Infof("Listening on %s", cfg.Listen)
+			serve(l, &controlServer{cfg: cfg, mux: mux})
+		}
+	}
+
+	wg.Wait()
+}
+
+func (s *controlServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	client, ok := s.authenticate(r)
+	if !ok {
+		controlLog.Warnf("Rejected %s %s from %s, invalid token", r.Method, r.URL.Path, r.RemoteAddr)
+		writeJSON(w, http.StatusUnauthorized, controlResponse{Message: "invalid or missing token"})
+		return
+	}
+	if r.Method != http.MethodGet && !client.admin {
+		controlLog.Warnf("Rejected %s %s by '%s', token is read-only", r.Method, r.URL.Path, client.name)
+		writeJSON(w, http.StatusForbidden, controlResponse{Message: "token is read-only"})
+		return
+	}
+	s.mux.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), controlClientKey{}, client)))
+}
+
+func (s *controlServer) authenticate(r *http.Request) (controlClient, bool) {
+	if s.socket && len(s.cfg.Tokens) == 0 {
+		return controlClient{name: "socket", admin: true}, true
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		return controlClient{}, false
+	}
+	for _, t := range s.cfg.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) == 1 {
+			return controlClient{name: t.Name, admin: t.Admin}, true
+		}
+	}
+	return controlClient{}, false
+}
+
+// registerControlActions adds the endpoints that change what the monitor is
+// doing, each takes a json controlRequest
+func registerControlActions(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/control/launch", controlAction("launch", func(req controlRequest) (string, error) {
+		return fmt.Sprintf("launched a plot for '%s'", req.Tag), LaunchPlot(req.Tag)
+	}))
+	mux.HandleFunc("/api/v1/control/drain", controlAction("drain", func(req controlRequest) (string, error) {
+		return fmt.Sprintf("'%s' won't launch new plots", req.Tag), DrainTag(req.Tag, true)
+	}))
+	mux.HandleFunc("/api/v1/control/resume", controlAction("resume", func(req controlRequest) (string, error) {
+		return fmt.Sprintf("'%s' is scheduling plots again", req.Tag), DrainTag(req.Tag, false)
+	}))
+	mux.HandleFunc("/api/v1/control/cancel", controlAction("cancel", func(req controlRequest) (string, error) {
+		if processMonitor == nil {
+			return "", fmt.Errorf("process monitor is not running")
+		}
+		return fmt.Sprintf("cancelled plot with pid %d", req.Pid), processMonitor.CancelPlot(req.Pid)
+	}))
+	mux.HandleFunc("/api/v1/control/uhaul/pause", controlAction("uhaul pause", func(req controlRequest) (string, error) {
+		return fmt.Sprintf("uhaul paused for '%s'", req.Path), PauseUhaul(req.Path, true)
+	}))
+	mux.HandleFunc("/api/v1/control/uhaul/resume", controlAction("uhaul resume", func(req controlRequest) (string, error) {
+		return fmt.Sprintf("uhaul resumed for '%s'", req.Path), PauseUhaul(req.Path, false)
+	}))
+	mux.HandleFunc("/api/v1/control/rescan", controlAction("rescan", func(req controlRequest) (string, error) {
+		RescanDrives()
+		return "drive rescan triggered", nil
+	}))
+	mux.HandleFunc("/api/v1/control/report", controlAction("report", func(req controlRequest) (string, error) {
+		return SendReport()
+	}))
+	// lasts until the next config reload
+	mux.HandleFunc("/api/v1/control/loglevel", controlAction("loglevel", func(req controlRequest) (string, error) {
+		level, err := parseLevel(req.Level)
+		if err != nil {
+			return "", err
+		}
+		if req.Subsystem == "" {
+			return fmt.Sprintf("default log level set to %s", level), SetLogLevel("", level)
+		}
+		return fmt.Sprintf("log level of '%s' set to %s", req.Subsystem, level), SetLogLevel(req.Subsystem, level)
+	}))
+}
+
+func controlAction(name string, f func(req controlRequest) (string, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, controlResponse{Message: "method not allowed"})
+			return
+		}
+
+		req := controlRequest{}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeJSON(w, http.StatusBadRequest, controlResponse{Message: "invalid request: " + err.Error()})
+				return
+			}
+		}
+
+		client, _ := r.Context().Value(controlClientKey{}).(controlClient)
+		msg, err := f(req)
+		if err != nil {
+			controlLog.Errorf("%s %+v by '%s' failed: %v", name, req, client.name, err)
+			status := http.StatusConflict
+			if errors.Is(err, errNotFound) {
+				status = http.StatusNotFound
+			}
+			writeJSON(w, status, controlResponse{Message: err.Error()})
+			return
+		}
+		controlLog.Infof("%s %+v by '%s': %s", name, req, client.name, msg)
+		writeJSON(w, http.StatusOK, controlResponse{OK: true, Message: msg})
+	}
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const ctlUsage = `usage: chia-monitor ctl [flags] <command>
+
+commands:
+  status              plotters, scheduler, memory and farm summary
+  plots               running plots
+  drives              monitored drives
+  transfers           uhaul transfers in flight and queued
+  history             plot lifecycle history, ie history --since 7d
+  alerts              pending, firing and recently resolved alerts
+  report [send]       summary report for --since, or mail the scheduled report now
+  launch <tag>        launch a plot for tag now
+  drain <tag>         stop launching new plots for tag
+  resume <tag>        start launching plots for tag again
+  cancel <pid>        kill a plotter and remove its temp files
+  pause <path>        stop uhaul moving plots from/to path
+  unpause <path>      resume uhaul for path
+  rescan              refresh drive space and plot counts
+  loglevel [[subsystem] <level>]
+                      show log levels, or set the default or a subsystem's level
+
+flags:
+`
+
+type ctlClient struct {
+	http  *http.Client
+	base  string
+	token string
+}
+
+// runCtl implements `chia-monitor ctl`, a client for the status and control
+// apis of a running monitor
+func runCtl(args []string) {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "monitor config to find the control socket/listener in")
+	socket := fs.String("socket", "", "control unix socket, overrides the config")
+	addr := fs.String("url", "", "control api url, ie http://127.0.0.1:2113, overrides the config")
+	token := fs.String("token", os.Getenv("CHIA_MONITOR_TOKEN"), "api token, defaults to $CHIA_MONITOR_TOKEN")
+	asJSON := fs.Bool("json", false, "print the raw json response")
+	since := fs.String("since", "7d", "how far back history goes, ie 12h, 7d or 2w")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), ctlUsage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	// flags can come before or after the command and its argument
+	var positional []string
+	for rest := fs.Args(); len(rest) > 0; rest = fs.Args() {
+		positional = append(positional, rest[0])
+		fs.Parse(rest[1:])
+	}
+	if len(positional) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	setLogOutput(ioutil.Discard)
+	client := newCtlClient(*configPath, *socket, *addr, *token)
+
+	cmd, arg := positional[0], ""
+	if len(positional) > 1 {
+		arg = positional[1]
+	}
+	needsArg := map[string]bool{"launch": true, "drain": true, "resume": true, "cancel": true, "pause": true, "unpause": true}
+	if needsArg[cmd] && arg == "" {
+		fmt.Fprintf(os.Stderr, "%s needs an argument\n", cmd)
+		os.Exit(2)
+	}
+
+	var err error
+	switch cmd {
+	case "status":
+		err = client.show("/api/v1/status", *asJSON, printStatus)
+	case "plots":
+		err = client.show("/api/v1/plotters", *asJSON, printPlots)
+	case "drives":
+		err = client.show("/api/v1/drives", *asJSON, printDrives)
+	case "transfers":
+		err = client.show("/api/v1/transfers", *asJSON, printTransfers)
+	case "history":
+		err = client.show("/api/v1/lifecycle?since="+url.QueryEscape(*since), *asJSON, printHistory)
+	case "alerts":
+		err = client.show("/api/v1/alerts", *asJSON, printAlerts)
+	case "report":
+		switch arg {
+		case "":
+			path := "/api/v1/report?since=" + url.QueryEscape(*since)
+			if *asJSON {
+				err = client.show(path, true, nil)
+			} else {
+				err = client.print(path + "&format=text")
+			}
+		case "send":
+			err = client.act("/api/v1/control/report", controlRequest{}, *asJSON)
+		default:
+			fmt.Fprintf(os.Stderr, "unknown report command '%s'\n", arg)
+			os.Exit(2)
+		}
+	case "launch", "drain", "resume":
+		err = client.act("/api/v1/control/"+cmd, controlRequest{Tag: arg}, *asJSON)
+	case "cancel":
+		pid, perr := strconv.Atoi(arg)
+		if perr != nil {
+			fmt.Fprintf(os.Stderr, "invalid pid '%s'\n", arg)
+			os.Exit(2)
+		}
+		err = client.act("/api/v1/control/cancel", controlRequest{Pid: pid}, *asJSON)
+	case "pause":
+		err = client.act("/api/v1/control/uhaul/pause", controlRequest{Path: arg}, *asJSON)
+	case "unpause":
+		err = client.act("/api/v1/control/uhaul/resume", controlRequest{Path: arg}, *asJSON)
+	case "rescan":
+		err = client.act("/api/v1/control/rescan", controlRequest{}, *asJSON)
+	case "loglevel":
+		switch len(positional) {
+		case 1:
+			err = client.show("/api/v1/logging", *asJSON, printLogLevels)
+		case 2:
+			err = client.act("/api/v1/control/loglevel", controlRequest{Level: arg}, *asJSON)
+		default:
+			err = client.act("/api/v1/control/loglevel", controlRequest{Subsystem: arg, Level: positional[2]}, *asJSON)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command '%s'\n\n", cmd)
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// newCtlClient talks to the control socket if there is one, then the control
+// listener, falling back to the read-only status api on the metrics socket
+// or listener
+func newCtlClient(configPath, socket, addr, token string) *ctlClient {
+	if socket == "" && addr == "" {
+		if cfg, err := parseConfig(configPath); err == nil {
+			metrics := cfg.MetricsConfig
+			if _, err := os.Stat(cfg.ControlConfig.Socket); cfg.ControlConfig.Socket != "" && err == nil {
+				socket = cfg.ControlConfig.Socket
+			} else if cfg.ControlConfig.Listen != "" {
+				addr = "http://" + cfg.ControlConfig.Listen
+			} else if _, err := os.Stat(metrics.Socket); metrics.Socket != "" && err == nil {
+				socket = metrics.Socket
+			} else if metrics.Listen != "" {
+				addr = "http://" + metrics.Listen
+				if metrics.TLSCert != "" {
+					addr = "https://" + metrics.Listen
+				}
+			}
+		}
+	}
+
+	client := &ctlClient{http: &http.Client{Timeout: 30 * time.Second}, token: token}
+	if socket != "" {
+		client.base = "http://unix"
+		client.http.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		}
+		return client
+	}
+	if addr == "" {
+		addr = "http://localhost:2112"
+	}
+	client.base = strings.TrimSuffix(addr, "/")
+	return client
+}
+
+func (c *ctlClient) do(method, path string, body interface{}) ([]byte, error) {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, c.base+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		msg := controlResponse{}
+		if json.Unmarshal(b, &msg) == nil && msg.Message != "" {
+			return b, fmt.Errorf("%s: %s", resp.Status, msg.Message)
+		}
+		return b, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	return b, nil
+}
+
+// show fetches path and prints it either as indented json or with print
+func (c *ctlClient) show(path string, asJSON bool, print func(w io.Writer, b []byte) error) error {
+	b, err := c.do(http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		return printJSON(b)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if err := print(tw, b); err != nil {
+		return err
+	}
+	return tw.Flush()
+}
+
+// print fetches path and writes the response as is
+func (c *ctlClient) print(path string) error {
+	b, err := c.do(http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(b)
+	return err
+}
+
+func (c *ctlClient) act(path string, req controlRequest, asJSON bool) error {
+	b, err := c.do(http.MethodPost, path, req)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		return printJSON(b)
+	}
+	resp := controlResponse{}
+	if err := json.Unmarshal(b, &resp); err != nil {
+		return err
+	}
+	fmt.Println(resp.Message)
+	return nil
+}
+
+func printJSON(b []byte) error {
+	out := bytes.Buffer{}
+	if err := json.Indent(&out, b, "", "  "); err != nil {
+		return err
+	}
+	_, err := out.WriteTo(os.Stdout)
+	return err
+}
+
+func printStatus(w io.Writer, b []byte) error {
+	var status struct {
+		Time      time.Time        `json:"time"`
+		Plotters  []PlotterInfo    `json:"plotters"`
+		Scheduler []schedulerEntry `json:"scheduler"`
+		Transfers transferStatus   `json:"transfers"`
+		Memory    memoryStatus     `json:"memory"`
+		Farm      FarmSummary      `json:"farm"`
+		Alerts    []Alert          `json:"alerts"`
+	}
+	if err := json.Unmarshal(b, &status); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "time:\t%s\n", status.Time.Local().Format("2006-01-02 15:04:05"))
+	fmt.Fprintf(w, "plots:\t%d running\n", len(status.Plotters))
+	fmt.Fprintf(w, "transfers:\t%d active, %d queued, %d paused\n", len(status.Transfers.Active), len(status.Transfers.Queue), len(status.Transfers.Paused))
+	fmt.Fprintf(w, "ram:\t%s / %s\n", formatBytes(status.Memory.UsedBytes), formatBytes(status.Memory.TotalBytes))
+	fmt.Fprintf(w, "swap:\t%s / %s\n", formatBytes(status.Memory.SwapUsedBytes), formatBytes(status.Memory.SwapTotalBytes))
+	if !status.Farm.Updated.IsZero() {
+		fmt.Fprintf(w, "farm:\t%.2f XCH farmed, %.0f PiB netspace\n", status.Farm.Farmed, status.Farm.NetspacePiB)
+	}
+
+	firing := 0
+	for _, a := range status.Alerts {
+		if a.State == alertFiring {
+			firing++
+		}
+	}
+	fmt.Fprintf(w, "alerts:\t%d firing\n", firing)
+
+	if len(status.Scheduler) > 0 {
+		fmt.Fprintln(w, "\nTAG\tTEMP\tACTIVE\tPHASE 1\tDRAINED\tLAST DECISION")
+		for _, s := range status.Scheduler {
+			active, phase1, reason := "-", "-", "-"
+			if d := s.LastDecision; d != nil {
+				active = fmt.Sprintf("%d/%d", d.Active, s.Config.StageConcurrency)
+				phase1 = fmt.Sprintf("%d/%d", d.Phase1, s.Config.MaxPhase1)
+				reason = fmt.Sprintf("%s (%s)", d.Reason, d.Time.Local().Format("15:04"))
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\t%s\n", s.Config.Tag, s.Config.TempPath, active, phase1, s.Drained, reason)
+		}
+	}
+	return nil
+}
+
+func printPlots(w io.Writer, b []byte) error {
+	var resp struct {
+		Plotters []PlotterInfo `json:"plotters"`
+	}
+	if err := json.Unmarshal(b, &resp); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, "PID\tTAG\tPHASE\tTABLE\tPROGRESS\tETA\tTEMP")
+	for _, p := range resp.Plotters {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", p.Pid, p.Tag, p.Phase, p.Table,
+			progressBar(p.Progress, 20), formatDuration(time.Duration(p.EtaSeconds)*time.Second), p.TempDir)
+	}
+	return nil
+}
+
+func printDrives(w io.Writer, b []byte) error {
+	var resp struct {
+		Drives []DriveInfo `json:"drives"`
+	}
+	if err := json.Unmarshal(b, &resp); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, "PATH\tKIND\tFREE\tUSED\tPLOTS\tREAD/s\tWRITE/s\tLOW")
+	for _, d := range resp.Drives {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%t\n", d.Path, strings.Join(d.Kinds, ","), formatBytes(d.FreeBytes),
+			formatBytes(d.UsedBytes), d.Plots, formatBytes(uint64(d.ReadRate)), formatBytes(uint64(d.WriteRate)), d.Low)
+	}
+	return nil
+}
+
+func printTransfers(w io.Writer, b []byte) error {
+	var resp transferStatus
+	if err := json.Unmarshal(b, &resp); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, "SOURCE\tDESTINATION\tSIZE\tELAPSED")
+	for _, t := range resp.Active {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", t.Source, t.Destination, formatBytes(uint64(t.Bytes)), formatDuration(time.Since(t.Started)))
+	}
+	fmt.Fprintf(w, "\n%d plot(s) queued in staging\n", len(resp.Queue))
+	for _, p := range resp.Paused {
+		fmt.Fprintf(w, "paused: %s\n", p)
+	}
+	return nil
+}
+
+func printAlerts(w io.Writer, b []byte) error {
+	var resp struct {
+		Alerts []Alert `json:"alerts"`
+	}
+	if err := json.Unmarshal(b, &resp); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, "ALERT\tSTATE\tFOR\tMESSAGE")
+	for _, a := range resp.Alerts {
+		elapsed := time.Since(a.Since)
+		if a.Resolved != nil {
+			elapsed = time.Since(*a.Resolved)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", a.Name, a.State, formatDuration(elapsed), a.Message)
+	}
+	return nil
+}
+
+func printLogLevels(w io.Writer, b []byte) error {
+	var resp logLevelStatus
+	if err := json.Unmarshal(b, &resp); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(resp.Levels))
+	for s := range resp.Levels {
+		names = append(names, s)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(w, "format: %s, default level: %s\n\n", resp.Format, resp.Default)
+	fmt.Fprintln(w, "SUBSYSTEM\tLEVEL")
+	for _, s := range names {
+		fmt.Fprintf(w, "%s\t%s\n", s, resp.Levels[s])
+	}
+	return nil
+}
+
+func printHistory(w io.Writer, b []byte) error {
+	var resp struct {
+		Plots []lifecycleEntry `json:"plots"`
+	}
+	if err := json.Unmarshal(b, &resp); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, "PLOT\tTAG\tSTAGE\tSTARTED\tSTAGED\tFARMED\tDESTINATION\tTOTAL")
+	at := func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.Local().Format("01-02 15:04")
+	}
+	for _, p := range resp.Plots {
+		id := p.ID
+		if len(id) > 12 {
+			id = id[:12]
+		}
+		total := time.Duration(0)
+		if !p.Farmed.IsZero() && !p.started().IsZero() {
+			total = p.Farmed.Sub(p.started())
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", id, p.Tag, p.Stage, at(p.started()), at(p.Staged),
+			at(p.Farmed), p.Destination, formatDuration(total))
+	}
+	return nil
+}
@@ -1,15 +1,17 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
 	"strconv"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -17,21 +19,9 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-var (
-	driveUsage = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "drive_used_mb",
-		Help: "drive used space in mb",
-	}, []string{
-		"path",
-	})
-
-	driveFree = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "drive_free_mb",
-		Help: "drive free space in mb",
-	}, []string{
-		"path",
-	})
+var drivesLog = newLogger("drives")
 
+var (
 	plotCount = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "plot_count",
 		Help: "number of plots in each final folder",
@@ -39,21 +29,11 @@ var (
 		"path",
 	})
 
-	driveWrites = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "drive_writes",
-		Help: "drive writes per second, mb",
-	}, []string{
-		"device",
-		"path",
-	})
-
-	driveReads = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "drive_reads",
-		Help: "drive reads per second, mb",
-	}, []string{
-		"device",
-		"path",
-	})
+	driveUpDesc    = prometheus.NewDesc("drive_up", "1 if the path could be read on the last scrape, 0 if not", []string{"path"}, nil)
+	driveUsageDesc = prometheus.NewDesc("drive_used_mb", "drive used space in mb", []string{"path"}, nil)
+	driveFreeDesc  = prometheus.NewDesc("drive_free_mb", "drive free space in mb", []string{"path"}, nil)
+	driveWrites    = prometheus.NewDesc("drive_writes", "drive bytes written, use rate() for bytes per second", []string{"device", "path"}, nil)
+	driveReads     = prometheus.NewDesc("drive_reads", "drive bytes read, use rate() for bytes per second", []string{"device", "path"}, nil)
 )
 
 // https://www.kernel.org/doc/html/latest/block/stat.html
@@ -76,72 +56,228 @@ type DriveStats struct {
 	//flushTicks    int64 // ms
 }
 
-type mountMapping struct {
-	mount string
-	path  string
+// DriveInfo is the latest known state of a monitored path
+type DriveInfo struct {
+	Path      string    `json:"path"`
+	Kinds     []string  `json:"kinds"` // temp, staging and/or final
+	Device    string    `json:"device,omitempty"`
+	FreeBytes uint64    `json:"freeBytes"`
+	UsedBytes uint64    `json:"usedBytes"`
+	Plots     int       `json:"plots"`
+	ReadRate  float64   `json:"readBytesPerSec"`
+	WriteRate float64   `json:"writeBytesPerSec"`
+	Low       bool      `json:"low"`
+	Error     string    `json:"error,omitempty"` // why the path couldn't be read
+	Updated   time.Time `json:"updated"`
 }
 
 var mountStats = map[string]*DriveStats{}
+var mountStatsAt = map[string]time.Time{}
+var lowDrives = map[string]bool{}
+var fullDrives = map[string]bool{}
 var numberRegex = regexp.MustCompile(`\d+`)
 
-func monitorDrives(dev mountMapping) {
-	fname := fmt.Sprintf("/sys/block/%s/stat", dev.mount)
-	b, err := os.ReadFile(fname)
-	if err != nil {
-		return
+// wake the plot count loop up early
+var plotRescan = make(chan struct{}, 1)
+
+// RescanDrives refreshes free space, I/O and plot counts right away
+func RescanDrives() {
+	driveInfoLock.Lock()
+	drivesSampledAt = time.Time{}
+	driveInfoLock.Unlock()
+
+	select {
+	case plotRescan <- struct{}{}:
+	default: // scan already pending
 	}
+}
 
-	vals := numberRegex.FindAllString(string(b), -1)
-	if len(vals) < 11 {
-		return
+// guards driveInfos and mountStats
+var driveInfoLock sync.Mutex
+var driveInfos = map[string]*DriveInfo{}
+
+// space and I/O are read on demand, at most every collectorCacheTTL
+var drivesSampledAt time.Time
+var driveErrors = map[string]error{}
+
+// updateDriveInfo applies f to the info for path under the lock
+func updateDriveInfo(path string, f func(*DriveInfo)) {
+	driveInfoLock.Lock()
+	defer driveInfoLock.Unlock()
+
+	info, exists := driveInfos[path]
+	if !exists {
+		info = &DriveInfo{Path: path}
+		driveInfos[path] = info
+		drivesSampledAt = time.Time{} // not sampled yet
 	}
+	f(info)
+}
 
-	stats := &DriveStats{}
-	stats.readIOs, _ = strconv.ParseInt(vals[1], 10, 64)
-	stats.readMerges, _ = strconv.ParseInt(vals[2], 10, 64)
-	stats.readSectors, _ = strconv.ParseInt(vals[3], 10, 64)
-	stats.readTicks, _ = strconv.ParseInt(vals[4], 10, 64)
-	stats.writeIOs, _ = strconv.ParseInt(vals[5], 10, 64)
-	stats.writeMerges, _ = strconv.ParseInt(vals[6], 10, 64)	
-	stats.writeSectors, _ = strconv.ParseInt(vals[7], 10, 64)
-	stats.writeTicks, _ = strconv.ParseInt(vals[8], 10, 64)
-	stats.inFlight, _ = strconv.ParseInt(vals[9], 10, 64)
-	stats.ioTicks, _ = strconv.ParseInt(vals[10], 10, 64)
-	stats.waitQueue, _ = strconv.ParseInt(vals[11], 10, 64)
-
-	if previous, exists := mountStats[dev.path]; exists {
-		//reads/writes are in UNIX 512-byte sectors
-		writesBytes := (stats.writeSectors - previous.writeSectors) * 512
-		readsBytes := (stats.readSectors - previous.readSectors) * 512
-
-		// prevent rollover issues when the linux counters rollover
-		if writesBytes < 0 {
-			writesBytes = 0
+// DriveSnapshot returns a copy of every monitored path, ordered by path
+func DriveSnapshot() []DriveInfo {
+	driveInfoLock.Lock()
+	defer driveInfoLock.Unlock()
+	sampleDrives()
+
+	infos := make([]DriveInfo, 0, len(driveInfos))
+	for _, v := range driveInfos {
+		info := *v
+		info.Kinds = append([]string{}, v.Kinds...)
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Path < infos[j].Path })
+	return infos
+}
+
+// sampleDrives reads space and I/O of every monitored path unless that was
+// done within collectorCacheTTL, and returns the paths that couldn't be read.
+// Must be called with driveInfoLock held
+func sampleDrives() map[string]error {
+	if time.Since(drivesSampledAt) < collectorCacheTTL {
+		return driveErrors
+	}
+
+	now, errs := time.Now(), map[string]error{}
+	for path, info := range driveInfos {
+		var stat unix.Statfs_t
+		if err := unix.Statfs(path, &stat); err != nil {
+			errs[path] = err
+			info.Error = err.Error()
+			continue
 		}
+		info.Error = ""
+		info.FreeBytes = stat.Bavail * uint64(stat.Bsize)
+		info.UsedBytes = (stat.Blocks - stat.Bfree) * uint64(stat.Bsize)
+		info.Updated = now
 
-		if readsBytes < 0 {
-			readsBytes = 0
+		if info.Device == "" {
+			continue
+		}
+		stats, err := readBlockStats(info.Device)
+		if err != nil {
+			errs[path] = err
+			info.Error = err.Error()
+			continue
 		}
+		if previous, exists := mountStats[path]; exists {
+			//reads/writes are in UNIX 512-byte sectors
+			writesBytes := (stats.writeSectors - previous.writeSectors) * 512
+			readsBytes := (stats.readSectors - previous.readSectors) * 512
+
+			// prevent rollover issues when the linux counters rollover
+			if writesBytes < 0 {
+				writesBytes = 0
+			}
+			if readsBytes < 0 {
+				readsBytes = 0
+			}
 
-		driveWrites.WithLabelValues(dev.mount, dev.path).Add(float64(writesBytes))
-		driveReads.WithLabelValues(dev.mount, dev.path).Add(float64(readsBytes))
+			if elapsed := now.Sub(mountStatsAt[path]).Seconds(); elapsed > 0 {
+				info.ReadRate = float64(readsBytes) / elapsed
+				info.WriteRate = float64(writesBytes) / elapsed
+			}
+		}
+		mountStats[path], mountStatsAt[path] = stats, now
 	}
 
-	mountStats[dev.path] = stats
+	drivesSampledAt, driveErrors = now, errs
+	return errs
 }
 
-func validatePaths(paths []string) []string {
-	var validPaths []string
-	for _, v := range paths {
-		if _, err := os.Stat(v); os.IsNotExist(err) {
-			log.Printf("Monitor path '%s' does not exist", v)
-			// path does not exist
-			continue
+// collectDrives reports space and I/O of every monitored path, a path that
+// can't be read reports drive_up 0 and fails the scrape
+func collectDrives() ([]prometheus.Metric, error) {
+	driveInfoLock.Lock()
+	defer driveInfoLock.Unlock()
+	errs := sampleDrives()
+
+	var metrics []prometheus.Metric
+	var failed []string
+	for path, info := range driveInfos {
+		up := 1.0
+		if err, bad := errs[path]; bad {
+			up = 0
+			failed = append(failed, fmt.Sprintf("'%s': %v", path, err))
 		}
+		metrics = append(metrics, prometheus.MustNewConstMetric(driveUpDesc, prometheus.GaugeValue, up, path))
+		if info.Updated.IsZero() {
+			continue // never read, don't report zero space
+		}
+		metrics = append(metrics,
+			prometheus.MustNewConstMetric(driveFreeDesc, prometheus.GaugeValue, float64(info.FreeBytes)/1024/1024, path),
+			prometheus.MustNewConstMetric(driveUsageDesc, prometheus.GaugeValue, float64(info.UsedBytes)/1024/1024, path))
+		if stats, exists := mountStats[path]; exists {
+			metrics = append(metrics,
+				prometheus.MustNewConstMetric(driveWrites, prometheus.CounterValue, float64(stats.writeSectors*512), info.Device, path),
+				prometheus.MustNewConstMetric(driveReads, prometheus.CounterValue, float64(stats.readSectors*512), info.Device, path))
+		}
+	}
+
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return metrics, fmt.Errorf("%s", strings.Join(failed, ", "))
+	}
+	return metrics, nil
+}
+
+// readBlockStats reads /sys/block/<dev>/stat
+func readBlockStats(dev string) (*DriveStats, error) {
+	fname := fmt.Sprintf("/sys/block/%s/stat", dev)
+	b, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	vals := numberRegex.FindAllString(string(b), -1)
+	if len(vals) < 11 {
+		return nil, fmt.Errorf("unexpected contents in %s", fname)
+	}
 
-		validPaths = append(validPaths, v)
+	// fields are 1-based in the kernel docs
+	field := func(i int) int64 {
+		v, _ := strconv.ParseInt(vals[i-1], 10, 64)
+		return v
 	}
-	return validPaths
+	return &DriveStats{
+		readIOs:      field(1),
+		readMerges:   field(2),
+		readSectors:  field(3),
+		readTicks:    field(4),
+		writeIOs:     field(5),
+		writeMerges:  field(6),
+		writeSectors: field(7),
+		writeTicks:   field(8),
+		inFlight:     field(9),
+		ioTicks:      field(10),
+		waitQueue:    field(11),
+	}, nil
+}
+
+// checkLowSpace publishes a DriveLow event when path drops below threshold bytes
+// free, and DriveFull once a final path can't take another k32 plot
+func checkLowSpace(path string, threshold uint64) {
+	driveInfoLock.Lock()
+	defer driveInfoLock.Unlock()
+	sampleDrives()
+
+	info, exists := driveInfos[path]
+	if !exists || info.Error != "" || info.Updated.IsZero() {
+		return
+	}
+
+	low := info.FreeBytes < threshold
+	if low && !lowDrives[path] {
+		events.Publish(Event{Type: DriveLow, Path: path, FreeBytes: info.FreeBytes})
+	}
+	lowDrives[path] = low
+	info.Low = low
+
+	full := driveKind(*info, "final") && float64(info.FreeBytes) < k32PlotBytes
+	if full && !fullDrives[path] {
+		events.Publish(Event{Type: DriveFull, Path: path, FreeBytes: info.FreeBytes})
+	}
+	fullDrives[path] = full
 }
 
 var driveRegex = regexp.MustCompile(`/dev/(\D{3})\d+`)
@@ -149,12 +285,12 @@ var driveRegex = regexp.MustCompile(`/dev/(\D{3})\d+`)
 func pathToDevice(path string) (string, error) {
 	o, err := exec.Command("/bin/df", "-h", path).Output()
 	if err != nil {
-		log.Printf("[DriveMonitor] Error calling 'df -h' for path '%s': %v", err, path)
+		return "", fmt.Errorf("error calling 'df -h' for path '%s': %v", path, err)
 	}
 
 	rows := strings.Split(string(o), "\n")
 	// first row is header, second is data
-	if len(rows) < 1 {
+	if len(rows) < 2 {
 		return "", fmt.Errorf("unexpected output from df")
 	}
 
@@ -165,65 +301,68 @@ func pathToDevice(path string) (string, error) {
 		return "", fmt.Errorf("unexpected output from df")
 	}
 
-	log.Printf("Mapped '%s' => '%s'", path, m[1])
+	drivesLog.Infof("Mapped '%s' => '%s'", path, m[1])
 
 	return m[1], nil
 }
 
-func startDriveMonitoring(cfg DriveMonitorConfig) {
-	// monitor temp paths
-	go func(p []string) {
-
-		var mounts []mountMapping
-		for _, v := range p {
-			mount, err := pathToDevice(v)
-			if err != nil {
-				log.Println(err)
-				continue
-			}
+func startDriveMonitoring(ctx context.Context, cfg DriveMonitorConfig) {
+	kinds := []string{"temp", "staging", "final"}
+	for i, paths := range [][]string{cfg.TempPaths, cfg.StagingPaths, cfg.FinalPaths} {
+		for _, v := range paths {
+			updateDriveInfo(v, func(info *DriveInfo) { info.Kinds = append(info.Kinds, kinds[i]) })
+		}
+	}
 
-			mounts = append(mounts,
-				mountMapping{mount: mount, path: v})
+	// map paths to block devices for I/O stats, space is still reported for
+	// paths that can't be mapped. Missing paths stay monitored and report
+	// drive_up 0 until they show up
+	for _, info := range DriveSnapshot() {
+		if info.Error != "" {
+			drivesLog.Warnf("Monitor path '%s' can't be read: %s", info.Path, info.Error)
+			continue
 		}
+		dev, err := pathToDevice(info.Path)
+		if err != nil {
+			drivesLog.Warnf("No I/O stats for '%s': %v", info.Path, err)
+			continue
+		}
+		updateDriveInfo(info.Path, func(info *DriveInfo) { info.Device = dev })
+	}
 
-		for {
-			for _, v := range mounts {
-				monitorDrives(v)
+	// count plots and check for low space, space and I/O are read when scraped
+	p := append(append([]string{}, cfg.FinalPaths...), cfg.StagingPaths...)
+	for {
+		for _, v := range p {
+			files, err := ioutil.ReadDir(v)
+			if err != nil {
+				continue // reported by drive_up, don't count it as empty
 			}
-
-			for _, v := range p {
-				var stat unix.Statfs_t
-				err := unix.Statfs(v, &stat)
-				if err != nil {
-					return
+			count := 0
+			for _, f := range files {
+				if filepath.Ext(f.Name()) == ".plot" {
+					count++
 				}
-
-				driveFree.WithLabelValues(v).Set(float64(stat.Bfree*uint64(stat.Bsize)) / 1024 / 1024)
-				driveUsage.WithLabelValues(v).Set(float64((stat.Blocks-stat.Bfree)*uint64(stat.Bsize)) / 1024 / 1024)
 			}
-
-			time.Sleep(10 * time.Second)
+			plotCount.WithLabelValues(v).Set(float64(count))
+			updateDriveInfo(v, func(info *DriveInfo) { info.Plots = count })
+			checkLowSpace(v, cfg.LowSpaceGB*1024*1024*1024)
 		}
-	}(validatePaths(cfg.TempPaths))
-
-	go func(p []string) { // Monitor plot count
-		for {
-			for _, v := range p {
-				count := 0
-				files, _ := ioutil.ReadDir(v)
-				for _, f := range files {
-					if filepath.Ext(f.Name()) == ".plot" {
-						count++
-					}
-				}
-				plotCount.WithLabelValues(v).Set(float64(count))
-			}
 
-			time.Sleep(slowRate)
+		select {
+		case <-ctx.Done():
+			// forget the paths, they're picked up again if the monitor is restarted
+			driveInfoLock.Lock()
+			driveInfos = map[string]*DriveInfo{}
+			mountStats = map[string]*DriveStats{}
+			mountStatsAt = map[string]time.Time{}
+			drivesSampledAt, driveErrors = time.Time{}, map[string]error{}
+			driveInfoLock.Unlock()
+			plotCount.Reset()
+			drivesLog.Infof("Stopped")
+			return
+		case <-plotRescan:
+		case <-time.After(slowRate):
 		}
-	}(validatePaths(append(cfg.FinalPaths, cfg.StagingPaths...)))
-
-	// go func(p []string){
-
-	// }()
+	}
 }
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestMissingDriveReportedDown(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "gone")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		startDriveMonitoring(ctx, DriveMonitorConfig{FinalPaths: []string{missing}})
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(DriveSnapshot()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("path wasn't monitored")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	metrics, err := collectDrives()
+	if err == nil || !strings.Contains(err.Error(), missing) {
+		t.Errorf("got error %v, want one naming %s", err, missing)
+	}
+	if len(metrics) != 1 {
+		t.Fatalf("got %d metrics, want only drive_up", len(metrics))
+	}
+	m := &dto.Metric{}
+	if err := metrics[0].Write(m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetGauge().GetValue(); got != 0 {
+		t.Errorf("drive_up = %v, want 0", got)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var eventsLog = newLogger("events")
+
+type EventType string
+
+const (
+	PlotLaunched     EventType = "plot_launched"
+	PlotStarted      EventType = "plot_started"
+	PhaseChanged     EventType = "phase_changed"
+	PlotCompleted    EventType = "plot_completed"
+	PlotFailed       EventType = "plot_failed"
+	TransferStarted  EventType = "transfer_started"
+	TransferFinished EventType = "transfer_finished"
+	TransferFailed   EventType = "transfer_failed"
+	DriveLow         EventType = "drive_low"
+	DriveFull        EventType = "drive_full"
+	AlertFiring      EventType = "alert_firing"
+	AlertResolved    EventType = "alert_resolved"
+)
+
+// eventTypes lists every type, for checking the types named in the config
+var eventTypes = []EventType{
+	PlotLaunched, PlotStarted, PhaseChanged, PlotCompleted, PlotFailed,
+	TransferStarted, TransferFinished, TransferFailed, DriveLow, DriveFull, AlertFiring, AlertResolved,
+}
+
+func knownEventType(t string) bool {
+	for _, k := range eventTypes {
+		if string(k) == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Event is published by the subsystems whenever something happens to a plot
+// or drive, only the fields relevant to the type are set
+type Event struct {
+	Type        EventType          `json:"type"`
+	Time        time.Time          `json:"time"`
+	Tag         string             `json:"tag,omitempty"`
+	PlotID      string             `json:"plotId,omitempty"`
+	Pid         int                `json:"pid,omitempty"`
+	Phase       string             `json:"phase,omitempty"`
+	Path        string             `json:"path,omitempty"` // temp dir or drive path
+	File        string             `json:"file,omitempty"` // final plot file
+	Destination string             `json:"destination,omitempty"`
+	Duration    time.Duration      `json:"duration,omitempty"`
+	FreeBytes   uint64             `json:"freeBytes,omitempty"`
+	Bytes       int64              `json:"bytes,omitempty"`  // plot size, on transfers
+	Phases      map[string]float64 `json:"phases,omitempty"` // seconds by phase and copy, on completion
+	Error       string             `json:"error,omitempty"`
+	Alert       string             `json:"alert,omitempty"` // rule name
+	Message     string             `json:"message,omitempty"`
+}
+
+// events are dropped for subscribers that fall this far behind
+const subscriberBuffer = 256
+
+type subscription struct {
+	name  string
+	types map[EventType]bool // empty for all
+	ch    chan Event
+}
+
+type EventBus struct {
+	lock sync.Mutex
+	subs []*subscription
+}
+
+var events = NewEventBus()
+
+var (
+	eventsPublished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "events_published",
+		Help: "Number of internal events published by type",
+	}, []string{
+		"type",
+	})
+
+	eventsDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "events_dropped",
+		Help: "Number of internal events dropped because a subscriber fell behind",
+	}, []string{
+		"subscriber",
+	})
+)
+
+func NewEventBus() *EventBus {
+	return &EventBus{}
+}
+
+// Subscribe returns a channel receiving every future event of the given
+// types, or all events if no types are given
+func (b *EventBus) Subscribe(name string, types ...EventType) <-chan Event {
+	sub := &subscription{
+		name:  name,
+		types: map[EventType]bool{},
+		ch:    make(chan Event, subscriberBuffer),
+	}
+	for _, t := range types {
+		sub.types[t] = true
+	}
+
+	b.lock.Lock()
+	b.subs = append(b.subs, sub)
+	b.lock.Unlock()
+
+	return sub.ch
+}
+
+// Unsubscribe stops delivering events to ch and closes it
+func (b *EventBus) Unsubscribe(ch <-chan Event) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for i, sub := range b.subs {
+		if sub.ch == ch {
+			b.subs = append(b.subs[:i], b.subs[i+1:]...)
+			close(sub.ch)
+			return
+		}
+	}
+}
+
+// SubscribeContext is Subscribe until ctx is done, then the channel is
+// closed so the subscriber can drain what was already published
+func (b *EventBus) SubscribeContext(ctx context.Context, name string, types ...EventType) <-chan Event {
+	ch := b.Subscribe(name, types...)
+	go func() {
+		<-ctx.Done()
+		b.Unsubscribe(ch)
+	}()
+	return ch
+}
+
+// Publish hands the event to every interested subscriber without blocking
+func (b *EventBus) Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	eventsPublished.WithLabelValues(string(e.Type)).Inc()
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, sub := range b.subs {
+		if len(sub.types) > 0 && !sub.types[e.Type] {
+			continue
+		}
+		select {
+		case sub.ch <- e:
+		default:
+			eventsDropped.WithLabelValues(sub.name).Inc()
+		}
+	}
+}
+
+// logEvents writes every event to the log
+func logEvents(ch <-chan Event) {
+	for e := range ch {
+		plot := plotterLog.With("tag", e.Tag, "plot_id", e.PlotID, "pid", e.Pid)
+		switch e.Type {
+		case PlotLaunched:
+			plotterLog.With("tag", e.Tag).Infof("Starting plot on %s => %s", e.Path, e.Destination)
+		case PlotStarted:
+			plot.Infof("Plot %s started phase 1", e.PlotID)
+		case PhaseChanged:
+			plot.Infof("Plot %s entered phase %s", e.PlotID, e.Phase)
+		case PlotCompleted:
+			plot.Infof("Plot %s finished as '%s'", e.PlotID, e.File)
+		case PlotFailed:
+			plot.Errorf("Plot %s stopped in phase %s: %s", e.PlotID, e.Phase, e.Error)
+		case TransferStarted:
+			uhaulLog.Infof("Moving '%s' => '%s'", e.File, e.Destination)
+		case TransferFinished:
+			uhaulLog.Infof("Moved file '%s' => '%s' in %f minutes", e.File, e.Destination, e.Duration.Minutes())
+		case TransferFailed:
+			uhaulLog.Errorf("Failed moving file '%s' => '%s': %s", e.File, e.Destination, e.Error)
+		case DriveLow:
+			drivesLog.Warnf("'%s' is low on space, %.1f GiB free", e.Path, float64(e.FreeBytes)/1024/1024/1024)
+		case DriveFull:
+			drivesLog.Warnf("'%s' has no room for another plot, %.1f GiB free", e.Path, float64(e.FreeBytes)/1024/1024/1024)
+		case AlertFiring:
+			alertsLog.Warnf("%s firing: %s", e.Alert, e.Message)
+		case AlertResolved:
+			alertsLog.Infof("%s resolved: %s", e.Alert, e.Message)
+		default:
+			eventsLog.Debugf("%+v", e)
+		}
+	}
+}
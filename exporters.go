@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exporter sends the latest values to a backend that isn't prometheus
+type exporter interface {
+	export(samples []pushSample, at time.Time) error
+}
+
+// udp packets are kept under a typical mtu so they aren't fragmented
+const maxUDPPacket = 1400
+
+// newExporters returns every configured backend by target, targets label the
+// push metrics
+func newExporters(cfg PushConfig) map[string]exporter {
+	exporters := map[string]exporter{}
+	if cfg.Influx.URL != "" {
+		client := &http.Client{Timeout: pushTimeout}
+		exporters["influx_http"] = influxHTTP{url: cfg.Influx.URL, cfg: cfg.Influx, client: client}
+	}
+	if cfg.Influx.UDP != "" {
+		exporters["influx_udp"] = influxUDP{addr: cfg.Influx.UDP}
+	}
+	if cfg.Graphite.Address != "" {
+		exporters["graphite"] = graphite{cfg: cfg.Graphite}
+	}
+	return exporters
+}
+
+// exportable leaves out the go runtime and process metrics, the backends get
+// the monitor's own measurements
+func exportable(name string) bool {
+	for _, prefix := range []string{"chia_monitor_", "go_", "process_", "promhttp_"} {
+		if strings.HasPrefix(name, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+func sampleName(s pushSample) string {
+	for _, l := range s.labels {
+		if l.name == "__name__" {
+			return l.value
+		}
+	}
+	return ""
+}
+
+// influxLines renders samples as line protocol, one measurement per series
+// with the labels as tags and a single value field:
+//
+//	drive_free_mb,host=plotter1,path=/media/ext0 value=81546.3 1626000000000000000
+func influxLines(samples []pushSample, at time.Time) []string {
+	ts := strconv.FormatInt(at.UnixNano(), 10)
+	lines := make([]string, 0, len(samples))
+	for _, s := range samples {
+		name := sampleName(s)
+		if !exportable(name) || math.IsNaN(s.value) || math.IsInf(s.value, 0) {
+			continue // line protocol has no NaN or Inf
+		}
+		b := strings.Builder{}
+		b.WriteString(influxEscape(name, ", "))
+		for _, l := range s.labels {
+			if l.name == "__name__" || l.value == "" {
+				continue
+			}
+			b.WriteString("," + influxEscape(l.name, ",= ") + "=" + influxEscape(l.value, ",= "))
+		}
+		b.WriteString(" value=" + strconv.FormatFloat(s.value, 'g', -1, 64) + " " + ts)
+		lines = append(lines, b.String())
+	}
+	return lines
+}
+
+func influxEscape(s string, chars string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	for _, c := range chars {
+		s = strings.ReplaceAll(s, string(c), `\`+string(c))
+	}
+	return s
+}
+
+// influxHTTP posts line protocol to an InfluxDB 1.x /write or 2.x
+// /api/v2/write url, the database or bucket is part of the url
+type influxHTTP struct {
+	url    string
+	cfg    InfluxConfig
+	client *http.Client
+}
+
+func (e influxHTTP) export(samples []pushSample, at time.Time) error {
+	body := strings.Join(influxLines(samples, at), "\n")
+	req, err := http.NewRequest(http.MethodPost, e.url, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("User-Agent", "chia-monitor/"+version)
+	if e.cfg.Token != "" {
+		req.Header.Set("Authorization", "Token "+e.cfg.Token)
+	} else if e.cfg.Username != "" {
+		req.SetBasicAuth(e.cfg.Username, e.cfg.Password)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// influxUDP sends line protocol to an InfluxDB or Telegraf udp listener,
+// nothing comes back so only resolving and sending can fail
+type influxUDP struct {
+	addr string
+}
+
+func (e influxUDP) export(samples []pushSample, at time.Time) error {
+	conn, err := net.DialTimeout("udp", e.addr, pushTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	packet := bytes.Buffer{}
+	flush := func() error {
+		if packet.Len() == 0 {
+			return nil
+		}
+		_, err := conn.Write(packet.Bytes())
+		packet.Reset()
+		return err
+	}
+	for _, line := range influxLines(samples, at) {
+		if packet.Len()+len(line)+1 > maxUDPPacket {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		packet.WriteString(line + "\n")
+	}
+	return flush()
+}
+
+var graphiteRegex = regexp.MustCompile(`[^a-zA-Z0-9_\-]+`)
+
+// graphite writes the plaintext protocol over tcp. Series are named
+// prefix.host.metric.label.value..., or metric;label=value... with Tagged
+type graphite struct {
+	cfg GraphiteConfig
+}
+
+func (e graphite) export(samples []pushSample, at time.Time) error {
+	ts := strconv.FormatInt(at.Unix(), 10)
+	b := bytes.Buffer{}
+	for _, s := range samples {
+		name := sampleName(s)
+		if !exportable(name) || math.IsNaN(s.value) || math.IsInf(s.value, 0) {
+			continue
+		}
+		b.WriteString(e.path(name, s.labels))
+		b.WriteString(" " + strconv.FormatFloat(s.value, 'f', -1, 64) + " " + ts + "\n")
+	}
+
+	conn, err := net.DialTimeout("tcp", e.cfg.Address, pushTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(pushTimeout))
+	_, err = conn.Write(b.Bytes())
+	return err
+}
+
+func (e graphite) path(name string, labels []labelPair) string {
+	if e.cfg.Tagged {
+		path := e.cfg.Prefix + "." + name
+		for _, l := range labels {
+			// graphite tag values can't contain ; or ~ and can't be empty
+			if v := strings.NewReplacer(";", "_", "~", "_").Replace(l.value); l.name != "__name__" && v != "" {
+				path += ";" + l.name + "=" + v
+			}
+		}
+		return path
+	}
+
+	path := e.cfg.Prefix
+	for _, l := range labels { // host goes first, it's the most useful to browse by
+		if l.name == "host" {
+			path += "." + graphiteRegex.ReplaceAllString(l.value, "_")
+		}
+	}
+	path += "." + name
+	for _, l := range labels {
+		if l.name == "__name__" || l.name == "host" || l.value == "" {
+			continue
+		}
+		v := strings.Trim(graphiteRegex.ReplaceAllString(l.value, "_"), "_")
+		if v == "" {
+			v = "_" // ie path="/"
+		}
+		path += "." + l.name + "." + v
+	}
+	return path
+}
@@ -7,6 +7,8 @@ require (
 	github.com/gdamore/tcell/v2 v2.2.1
 	github.com/mattn/go-runewidth v0.0.10
 	github.com/prometheus/client_golang v1.10.0
+	github.com/prometheus/client_model v0.2.0
 	golang.org/x/sys v0.0.0-20210507161434-a76c4d0a0096
-	gopkg.in/yaml.v2 v2.3.0
+	google.golang.org/protobuf v1.23.0
+	gopkg.in/yaml.v3 v3.0.1
 )
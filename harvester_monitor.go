@@ -2,17 +2,20 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
-	"log"
 	"os/exec"
 	"regexp"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
+var farmLog = newLogger("farm")
+
 var (
 	farmedChia = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "total_chia_farmed",
@@ -24,12 +27,37 @@ var (
 		Help: "Netspace estimate via 'chia farm summary'",
 	})
 
+	harvesterPlots = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "harvester_plots",
+		Help: "Plots the harvesters are farming via 'chia farm summary'",
+	})
+
+	farmSummary     FarmSummary
+	farmSummaryLock sync.Mutex
+
 	farmedRegex   = regexp.MustCompile(`Block rewards: (\d+)`)
 	netspaceRegex = regexp.MustCompile(`Estimated network space: (\d+)`)
+	// older versions only have the local harvester
+	plotCountRegex = regexp.MustCompile(`Plot count(?: for all harvesters)?: (\d+)`)
 )
 
-func startFarmMonitor(chiaPath string) {
-	for {
+// FarmSummary holds the values last parsed from 'chia farm summary'
+type FarmSummary struct {
+	Farmed      float64   `json:"farmed"`
+	NetspacePiB float64   `json:"netspacePiB"`
+	Plots       *int      `json:"plots,omitempty"` // nil if the summary has no plot count
+	Updated     time.Time `json:"updated"`
+	Error       string    `json:"error,omitempty"`
+}
+
+func CurrentFarmSummary() FarmSummary {
+	farmSummaryLock.Lock()
+	defer farmSummaryLock.Unlock()
+	return farmSummary
+}
+
+func startFarmMonitor(ctx context.Context, chiaPath string) {
+	for ctx.Err() == nil {
 
 		chiaProc := exec.Command("sh")
 		chiaProc.Dir = chiaPath
@@ -41,27 +69,48 @@ func startFarmMonitor(chiaPath string) {
 
 		res, err := chiaProc.Output()
 		if err != nil {
-			log.Printf("[Harvester] error running 'chia farm summary': %v", err)
+			farmLog.Errorf("error running 'chia farm summary': %v", err)
+			farmSummaryLock.Lock()
+			farmSummary.Error = err.Error()
+			farmSummaryLock.Unlock()
+			sleepContext(ctx, time.Minute)
 			continue
 		}
 
+		summary := FarmSummary{Updated: time.Now()}
+
 		s := string(res)
 		if matches, found := checkRegex(s, farmedRegex); found {
 			f, err := strconv.ParseFloat(matches[0], 64)
 			if err != nil {
-				log.Printf("[Harvester] error parsing output from 'chia farm summary': %v", err)
+				farmLog.Errorf("error parsing output from 'chia farm summary': %v", err)
 			}
 			farmedChia.Set(f)
+			summary.Farmed = f
 		}
 
 		if matches, found := checkRegex(s, netspaceRegex); found {
 			f, err := strconv.ParseFloat(matches[0], 64)
 			if err != nil {
-				log.Printf("[Harvester] error parsing output from 'chia farm summary': %v", err)
+				farmLog.Errorf("error parsing output from 'chia farm summary': %v", err)
 			}
 			netspaceEstimate.Set(f)
+			summary.NetspacePiB = f
 		}
 
-		time.Sleep(1 * time.Minute)
+		if matches, found := checkRegex(s, plotCountRegex); found {
+			n, err := strconv.Atoi(matches[0])
+			if err != nil {
+				farmLog.Errorf("error parsing output from 'chia farm summary': %v", err)
+			}
+			harvesterPlots.Set(float64(n))
+			summary.Plots = &n
+		}
+
+		farmSummaryLock.Lock()
+		farmSummary = summary
+		farmSummaryLock.Unlock()
+
+		sleepContext(ctx, time.Minute)
 	}
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// one sample a minute for the last day
+const historyInterval = time.Minute
+const historyLength = 24 * 60
+
+// historySample is a point in time summary kept for the web dashboard
+type historySample struct {
+	Time         time.Time          `json:"time"`
+	ActivePlots  int                `json:"activePlots"`
+	Phases       map[string]int     `json:"phases"`
+	FreeBytes    map[string]uint64  `json:"freeBytes"`
+	WriteRate    map[string]float64 `json:"writeBytesPerSec"`
+	Transfers    int                `json:"transfers"`
+	MemUsedBytes uint64             `json:"memUsedBytes"`
+	SwapUsed     uint64             `json:"swapUsedBytes"`
+}
+
+var historyLock sync.Mutex
+var history []historySample
+
+func startHistory(ctx context.Context) {
+	for ctx.Err() == nil {
+		recordHistory()
+		sleepContext(ctx, historyInterval)
+	}
+}
+
+func recordHistory() {
+	sample := historySample{
+		Time:      time.Now(),
+		Phases:    map[string]int{},
+		FreeBytes: map[string]uint64{},
+		WriteRate: map[string]float64{},
+		Transfers: len(ActiveTransfers()),
+	}
+
+	for _, p := range plotterStatus() {
+		sample.ActivePlots++
+		sample.Phases[p.Phase]++
+	}
+	for _, d := range DriveSnapshot() {
+		sample.FreeBytes[d.Path] = d.FreeBytes
+		sample.WriteRate[d.Path] = d.WriteRate
+	}
+	mem := memStatus()
+	sample.MemUsedBytes, sample.SwapUsed = mem.UsedBytes, mem.SwapUsedBytes
+
+	historyLock.Lock()
+	defer historyLock.Unlock()
+	history = append(history, sample)
+	if len(history) > historyLength {
+		history = history[len(history)-historyLength:]
+	}
+}
+
+// History returns the samples recorded since the given time
+func History(since time.Time) []historySample {
+	historyLock.Lock()
+	defer historyLock.Unlock()
+
+	samples := []historySample{}
+	for _, s := range history {
+		if !s.Time.Before(since) {
+			samples = append(samples, s)
+		}
+	}
+	return samples
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var hooksLog = newLogger("hooks")
+
+const (
+	maxQueuedHooks    = 100              // events waiting per hook, later ones are dropped
+	maxHookOutput     = 4096             // bytes of output kept for the log
+	hookKillGrace     = 5 * time.Second  // between SIGTERM and SIGKILL
+	hookShutdownGrace = 10 * time.Second // for queued and running commands on shutdown
+)
+
+var (
+	hookRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hook_runs_total",
+		Help: "Hook commands run by hook and result (ok, failed, timeout, aborted or error when it couldn't start)",
+	}, []string{
+		"hook",
+		"result",
+	})
+
+	hookRunTime = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "hook_run_seconds",
+		Help:    "How long hook commands ran",
+		Buckets: prometheus.ExponentialBuckets(0.1, 4, 8),
+	}, []string{
+		"hook",
+	})
+
+	hookExitCode = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "hook_exit_code",
+		Help: "Exit status of the last run of a hook, -1 if it was killed or didn't start",
+	}, []string{
+		"hook",
+	})
+
+	hooksRunning = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "hooks_running",
+		Help: "Hook commands running right now",
+	}, []string{
+		"hook",
+	})
+
+	hooksQueued = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "hooks_queued",
+		Help: "Events waiting for a hook to be free",
+	}, []string{
+		"hook",
+	})
+
+	hooksDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hooks_dropped_total",
+		Help: "Events a hook didn't run for because too many were waiting or the monitor was stopping",
+	}, []string{
+		"hook",
+	})
+)
+
+// why a hook command was killed
+const (
+	hookNotKilled int32 = iota
+	hookTimedOut
+	hookAborted
+)
+
+type hook struct {
+	cfg  HookConfig
+	host string
+}
+
+// startHooks runs every hook until ctx is done
+func startHooks(ctx context.Context, cfgs []*HookConfig) {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+
+	wg := sync.WaitGroup{}
+	for _, cfg := range cfgs {
+		h := &hook{cfg: *cfg, host: host}
+		var types []EventType
+		for _, t := range cfg.Events {
+			types = append(types, EventType(t))
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.run(ctx, events.SubscribeContext(ctx, "hook_"+h.cfg.Name, types...))
+		}()
+	}
+	wg.Wait()
+	hooksLog.Infof("Stopped")
+}
+
+// run queues the wanted events for up to Concurrency workers. Once ctx is
+// done what's queued and running gets hookShutdownGrace, then it's killed
+func (h *hook) run(ctx context.Context, evs <-chan Event) {
+	name := h.cfg.Name
+	jobs := make(chan Event, maxQueuedHooks)
+	abort, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var skipped int32
+	wg := sync.WaitGroup{}
+	for i := 0; i < h.cfg.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range jobs {
+				hooksQueued.WithLabelValues(name).Dec()
+				if abort.Err() != nil {
+					atomic.AddInt32(&skipped, 1)
+					hooksDropped.WithLabelValues(name).Inc()
+					continue
+				}
+				h.exec(abort, e)
+			}
+		}()
+	}
+
+	for e := range evs {
+		if len(h.cfg.Tags) > 0 && e.Tag != "" && !contains(h.cfg.Tags, e.Tag) {
+			continue
+		}
+		select {
+		case jobs <- e:
+			hooksQueued.WithLabelValues(name).Inc()
+		default:
+			hooksDropped.WithLabelValues(name).Inc()
+			hooksLog.Warnf("%s is %d events behind, not running it for %s", name, maxQueuedHooks, e.Type)
+		}
+	}
+
+	close(jobs)
+	if !waitTimeout(&wg, hookShutdownGrace) {
+		cancel()
+		wg.Wait()
+	}
+	if skipped > 0 {
+		hooksLog.Warnf("%s didn't run for %d queued event(s) on shutdown", name, skipped)
+	}
+}
+
+// exec runs the command for e and records how it went
+func (h *hook) exec(abort context.Context, e Event) {
+	name := h.cfg.Name
+	log := hooksLog.With("hook", name, "event", e.Type)
+
+	stdin, err := json.Marshal(struct {
+		Event
+		Host string `json:"host"`
+	}{e, h.host})
+	if err != nil {
+		log.Errorf("Error encoding the event: %v", err)
+		return
+	}
+
+	out := &cappedBuffer{max: maxHookOutput}
+	cmd := exec.Command("/bin/sh", "-c", h.cfg.Command)
+	cmd.Dir = h.cfg.Dir
+	cmd.Env = append(os.Environ(), hookEnv(e, h.host)...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout, cmd.Stderr = out, out
+	// in its own process group so a timeout kills whatever it started too
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	started := time.Now()
+	if err := cmd.Start(); err != nil {
+		hookRuns.WithLabelValues(name, "error").Inc()
+		hookExitCode.WithLabelValues(name).Set(-1)
+		log.Errorf("Error starting %s: %v", name, err)
+		return
+	}
+	hooksRunning.WithLabelValues(name).Inc()
+	defer hooksRunning.WithLabelValues(name).Dec()
+
+	var killed int32
+	done := make(chan struct{})
+	go func() {
+		timer := time.NewTimer(h.cfg.Timeout)
+		defer timer.Stop()
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+			atomic.StoreInt32(&killed, hookTimedOut)
+		case <-abort.Done():
+			atomic.StoreInt32(&killed, hookAborted)
+		}
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+		select {
+		case <-done:
+		case <-time.After(hookKillGrace):
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		}
+	}()
+	err = cmd.Wait()
+	close(done)
+
+	took := time.Since(started)
+	hookRunTime.WithLabelValues(name).Observe(took.Seconds())
+	code := cmd.ProcessState.ExitCode()
+	hookExitCode.WithLabelValues(name).Set(float64(code))
+
+	output := strings.TrimSpace(out.String())
+	switch atomic.LoadInt32(&killed) {
+	case hookTimedOut:
+		hookRuns.WithLabelValues(name, "timeout").Inc()
+		log.Warnf("%s timed out after %v and was killed: %s", name, h.cfg.Timeout, lastLine(output))
+	case hookAborted:
+		hookRuns.WithLabelValues(name, "aborted").Inc()
+		log.Warnf("%s was killed on shutdown after %v", name, took.Round(time.Millisecond))
+	default:
+		var exitErr *exec.ExitError
+		if err != nil && !errors.As(err, &exitErr) {
+			hookRuns.WithLabelValues(name, "error").Inc()
+			log.Errorf("Error running %s: %v", name, err)
+		} else if code != 0 {
+			hookRuns.WithLabelValues(name, "failed").Inc()
+			log.Warnf("%s exited with status %d after %v: %s", name, code, took.Round(time.Millisecond), lastLine(output))
+		} else {
+			hookRuns.WithLabelValues(name, "ok").Inc()
+			log.Infof("%s finished in %v", name, took.Round(time.Millisecond))
+		}
+	}
+	if output != "" {
+		log.Debugf("%s output: %s", name, output)
+	}
+}
+
+// hookEnv has the event's fields that are set as CHIA_MONITOR_* variables
+func hookEnv(e Event, host string) []string {
+	env := []string{
+		"CHIA_MONITOR_EVENT=" + string(e.Type),
+		"CHIA_MONITOR_TIME=" + e.Time.Format(time.RFC3339),
+		"CHIA_MONITOR_HOST=" + host,
+	}
+	for k, v := range map[string]string{
+		"TAG":         e.Tag,
+		"PLOT_ID":     e.PlotID,
+		"PHASE":       e.Phase,
+		"PATH":        e.Path,
+		"FILE":        e.File,
+		"DESTINATION": e.Destination,
+		"ERROR":       e.Error,
+		"ALERT":       e.Alert,
+		"MESSAGE":     e.Message,
+	} {
+		if v != "" {
+			env = append(env, "CHIA_MONITOR_"+k+"="+v)
+		}
+	}
+	if e.Pid != 0 {
+		env = append(env, "CHIA_MONITOR_PID="+strconv.Itoa(e.Pid))
+	}
+	if e.Duration != 0 {
+		env = append(env, fmt.Sprintf("CHIA_MONITOR_DURATION=%.0f", e.Duration.Seconds()))
+	}
+	if e.FreeBytes != 0 {
+		env = append(env, "CHIA_MONITOR_FREE_BYTES="+strconv.FormatUint(e.FreeBytes, 10))
+	}
+	if e.Bytes != 0 {
+		env = append(env, "CHIA_MONITOR_BYTES="+strconv.FormatInt(e.Bytes, 10))
+	}
+	return env
+}
+
+// cappedBuffer keeps the first and last max/2 bytes written to it, the start
+// says what the command was doing and the end why it stopped
+type cappedBuffer struct {
+	head, tail []byte
+	max        int
+	skipped    int
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if room := b.max/2 - len(b.head); room > 0 {
+		if room > len(p) {
+			room = len(p)
+		}
+		b.head, p = append(b.head, p[:room]...), p[room:]
+	}
+	b.tail = append(b.tail, p...)
+	if over := len(b.tail) - b.max/2; over > 0 {
+		b.tail = append(b.tail[:0], b.tail[over:]...)
+		b.skipped += over
+	}
+	return n, nil
+}
+
+func (b *cappedBuffer) String() string {
+	if b.skipped == 0 {
+		return string(b.head) + string(b.tail)
+	}
+	return fmt.Sprintf("%s\n... %d bytes skipped ...\n%s", b.head, b.skipped, b.tail)
+}
+
+// lastLine of a command's output, usually the error message
+func lastLine(s string) string {
+	if i := strings.LastIndex(s, "\n"); i >= 0 {
+		s = s[i+1:]
+	}
+	if s == "" {
+		return "no output"
+	}
+	return truncate(s, 200)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCappedBufferKeepsTail(t *testing.T) {
+	b := &cappedBuffer{max: 64}
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(b, "line %d\n", i)
+	}
+	b.Write([]byte("error: disk full\n"))
+
+	out := strings.TrimSpace(b.String())
+	if !strings.HasPrefix(out, "line 0\nline 1\n") {
+		t.Errorf("output doesn't start with the first lines: %q", out)
+	}
+	if !strings.Contains(out, "bytes skipped") || len(out) > 64+40 {
+		t.Errorf("output wasn't capped: %q", out)
+	}
+	if got := lastLine(out); got != "error: disk full" {
+		t.Errorf("lastLine = %q, want the last line written", got)
+	}
+
+	b = &cappedBuffer{max: 64}
+	b.Write([]byte("short\n"))
+	if got := b.String(); got != "short\n" {
+		t.Errorf("got %q, want the whole output", got)
+	}
+}
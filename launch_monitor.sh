@@ -1,8 +1,9 @@
 #!/bin/bash
 echo "Building Monitor..."
-go build -o chia_monitor
+go build -ldflags "-X main.version=$(git describe --always --dirty)" -o chia_monitor
+./chia_monitor validate-config || exit 1
 echo "Killing previous..."
 pkill chia_monitor
 echo "Launching..."
-./chia_monitor &
+./chia_monitor run &
 echo "Finished."
\ No newline at end of file
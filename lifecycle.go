@@ -0,0 +1,354 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var lifecycleLog = newLogger("lifecycle")
+
+// PlotLifecycle follows a single plot from launch until uhaul moves it to the farm
+type PlotLifecycle struct {
+	ID          string `json:"id"`
+	Tag         string `json:"tag"`
+	Pid         int    `json:"pid"`
+	TempDir     string `json:"tempDir"`
+	File        string `json:"file"`        // final plot in staging
+	Destination string `json:"destination"` // farm dir the plot was moved to
+	Bytes       int64  `json:"bytes,omitempty"`
+	Error       string `json:"error,omitempty"`       // why the plotter stopped early
+	FailedPhase string `json:"failedPhase,omitempty"` // phase it was in
+
+	Phases map[string]float64 `json:"phases,omitempty"` // seconds by phase and copy
+
+	Queued       time.Time `json:"queued"`
+	Plotting     time.Time `json:"plotting"`
+	Staged       time.Time `json:"staged"`
+	Transferring time.Time `json:"transferring"`
+	Farmed       time.Time `json:"farmed"`
+	Failed       time.Time `json:"failed"`
+}
+
+// Stage returns the latest lifecycle stage the plot reached
+func (p *PlotLifecycle) Stage() string {
+	switch {
+	case !p.Farmed.IsZero():
+		return "farmed"
+	case !p.Transferring.IsZero():
+		return "transferring"
+	case !p.Staged.IsZero():
+		return "staged"
+	case !p.Failed.IsZero():
+		return "failed"
+	case !p.Plotting.IsZero():
+		return "plotting"
+	default:
+		return "queued"
+	}
+}
+
+// oldest records are dropped once we go over this
+const maxLifecycleRecords = 2000
+
+var lifecycleBuckets = []float64{
+	4 * 3600, 6 * 3600, 8 * 3600, 10 * 3600, 12 * 3600,
+	16 * 3600, 20 * 3600, 24 * 3600, 36 * 3600, 48 * 3600,
+}
+
+var (
+	plotLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "plot_lifecycle_seconds",
+		Help:    "Time from launching (or first seeing) a plot until it's moved to the farm",
+		Buckets: lifecycleBuckets,
+	}, []string{
+		"tag",
+		"destination",
+	})
+
+	plotTransferTime = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "plot_transfer_seconds",
+		Help:    "Time uhaul spent moving a plot from staging to the farm",
+		Buckets: prometheus.ExponentialBuckets(60, 2, 8),
+	}, []string{
+		"tag",
+		"destination",
+	})
+)
+
+// final plot names end with the plot id, ie plot-k32-2021-06-06-10-00-<id>.plot
+var plotFileRegex = regexp.MustCompile(`plot-k\d+-[\d-]+-(\w+)\.plot$`)
+
+type LifecycleTracker struct {
+	lock   sync.Mutex
+	path   string
+	plots  map[string]*PlotLifecycle // by plot id
+	queued map[string]time.Time      // launch time by temp dir, until the plot id is known
+}
+
+var lifecycle = NewLifecycleTracker("plot_history.json")
+
+func NewLifecycleTracker(path string) *LifecycleTracker {
+	return &LifecycleTracker{
+		path:   path,
+		plots:  map[string]*PlotLifecycle{},
+		queued: map[string]time.Time{},
+	}
+}
+
+// Load reads previously saved lifecycle records, a missing file is not an error
+func (l *LifecycleTracker) Load() error {
+	b, err := os.ReadFile(l.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var records []*PlotLifecycle
+	if err := json.Unmarshal(b, &records); err != nil {
+		return err
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, r := range records {
+		l.plots[r.ID] = r
+	}
+	lifecycleLog.Infof("Loaded %d plot records from '%s'", len(records), l.path)
+	return nil
+}
+
+// must be called with the lock held
+func (l *LifecycleTracker) save() {
+	records := l.sorted()
+	if len(records) > maxLifecycleRecords {
+		for _, r := range records[:len(records)-maxLifecycleRecords] {
+			delete(l.plots, r.ID)
+		}
+		records = records[len(records)-maxLifecycleRecords:]
+	}
+
+	b, err := json.Marshal(records)
+	if err != nil {
+		lifecycleLog.Errorf("Error encoding plot records: %v", err)
+		return
+	}
+
+	tmp := l.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0666); err != nil {
+		lifecycleLog.Errorf("Error saving plot records: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		lifecycleLog.Errorf("Error saving plot records: %v", err)
+	}
+}
+
+// records ordered by when they were first seen
+func (l *LifecycleTracker) sorted() []*PlotLifecycle {
+	records := make([]*PlotLifecycle, 0, len(l.plots))
+	for _, r := range l.plots {
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].started().Before(records[j].started())
+	})
+	return records
+}
+
+func (p *PlotLifecycle) started() time.Time {
+	if !p.Queued.IsZero() {
+		return p.Queued
+	}
+	return p.Plotting
+}
+
+// when the plot last moved to a new stage
+func (p *PlotLifecycle) updated() time.Time {
+	latest := time.Time{}
+	for _, t := range []time.Time{p.Queued, p.Plotting, p.Staged, p.Transferring, p.Farmed, p.Failed} {
+		if t.After(latest) {
+			latest = t
+		}
+	}
+	return latest
+}
+
+// must be called with the lock held
+func (l *LifecycleTracker) get(id string) *PlotLifecycle {
+	if r, exists := l.plots[id]; exists {
+		return r
+	}
+	r := &PlotLifecycle{ID: id}
+	l.plots[id] = r
+	return r
+}
+
+// must be called with the lock held
+func (l *LifecycleTracker) byFile(file string) *PlotLifecycle {
+	for _, r := range l.plots {
+		if r.File == file {
+			return r
+		}
+	}
+
+	// plots we didn't see being made (other plotters, restarts) still carry their id
+	if matches, valid := checkRegex(filepath.Base(file), plotFileRegex); valid {
+		r := l.get(matches[0])
+		r.File = file
+		return r
+	}
+	return nil
+}
+
+// Queued marks a plot as launched into the given temp dir
+func (l *LifecycleTracker) Queued(tempDir string, at time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.queued[filepath.Clean(tempDir)] = at
+}
+
+// Plotting marks the start of phase 1 for a plot
+func (l *LifecycleTracker) Plotting(id string, tag string, pid int, tempDir string, at time.Time) {
+	if id == "" {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	r := l.get(id)
+	if !r.Plotting.IsZero() { // already known, ie the monitor restarted
+		return
+	}
+
+	r.Tag, r.Pid, r.TempDir, r.Plotting = tag, pid, tempDir, at
+	if queued, exists := l.queued[filepath.Clean(tempDir)]; exists {
+		r.Queued = queued
+		delete(l.queued, filepath.Clean(tempDir))
+	}
+	l.save()
+}
+
+// Staged marks a plot as finished and sitting in staging as file, phases
+// are the phase times reported by the plotter
+func (l *LifecycleTracker) Staged(id string, file string, phases map[string]float64, at time.Time) {
+	if id == "" {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	r := l.get(id)
+	if !r.Staged.IsZero() {
+		return
+	}
+	r.File, r.Phases, r.Staged = file, phases, at
+	l.save()
+}
+
+// Failed marks a plot as abandoned by its plotter during phase
+func (l *LifecycleTracker) Failed(id string, tag string, phase string, reason string, at time.Time) {
+	if id == "" {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	r := l.get(id)
+	if !r.Failed.IsZero() || !r.Staged.IsZero() {
+		return
+	}
+	if r.Tag == "" {
+		r.Tag = tag
+	}
+	r.FailedPhase, r.Error, r.Failed = phase, reason, at
+	l.save()
+}
+
+// Transferring marks the start of uhaul moving file to destination
+func (l *LifecycleTracker) Transferring(file string, destination string, bytes int64, at time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	r := l.byFile(file)
+	if r == nil {
+		return
+	}
+	r.Destination, r.Transferring = destination, at
+	if bytes > 0 {
+		r.Bytes = bytes
+	}
+	l.save()
+}
+
+// Farmed marks file as moved to its farm destination
+func (l *LifecycleTracker) Farmed(file string, at time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	r := l.byFile(file)
+	if r == nil {
+		return
+	}
+	r.Farmed = at
+
+	if !r.Transferring.IsZero() {
+		plotTransferTime.WithLabelValues(r.Tag, r.Destination).Observe(at.Sub(r.Transferring).Seconds())
+	}
+	if started := r.started(); !started.IsZero() {
+		plotLatency.WithLabelValues(r.Tag, r.Destination).Observe(at.Sub(started).Seconds())
+	}
+	l.save()
+}
+
+// Run updates lifecycle records from plot and transfer events
+func (l *LifecycleTracker) Run(ch <-chan Event) {
+	for e := range ch {
+		switch e.Type {
+		case PlotLaunched:
+			l.Queued(e.Path, e.Time)
+		case PlotStarted:
+			l.Plotting(e.PlotID, e.Tag, e.Pid, e.Path, e.Time)
+		case PlotCompleted:
+			l.Staged(e.PlotID, e.File, e.Phases, e.Time)
+		case PlotFailed:
+			l.Failed(e.PlotID, e.Tag, e.Phase, e.Error, e.Time)
+		case TransferStarted:
+			l.Transferring(e.File, e.Destination, e.Bytes, e.Time)
+		case TransferFinished:
+			l.Farmed(e.File, e.Time)
+		}
+	}
+}
+
+// Flush writes every record to disk
+func (l *LifecycleTracker) Flush() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.save()
+	lifecycleLog.Infof("Saved %d plot records to '%s'", len(l.plots), l.path)
+}
+
+// Records returns a copy of every known lifecycle record, oldest first
+func (l *LifecycleTracker) Records() []PlotLifecycle {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	var records []PlotLifecycle
+	for _, r := range l.sorted() {
+		records = append(records, *r)
+	}
+	return records
+}
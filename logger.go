@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+func parseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	if strings.EqualFold(s, "warning") {
+		return LevelWarn, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level '%s', expected one of %s", s, strings.Join(levelNames, ", "))
+}
+
+func (l Level) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.String())
+}
+
+func (l *Level) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	level, err := parseLevel(s)
+	*l = level
+	return err
+}
+
+// Logger writes entries for one subsystem, with optional key value fields
+type Logger struct {
+	subsystem string
+	fields    []interface{}
+}
+
+// guards everything below, entries are written one at a time
+var logLock sync.Mutex
+var logOut io.Writer = os.Stderr
+var logJSON bool
+var defaultLevel = LevelInfo
+var logLevels = map[string]Level{} // by subsystem, overrides defaultLevel
+var logSubsystems = map[string]bool{}
+
+// newLogger returns the logger for subsystem, levels can be set per subsystem
+func newLogger(subsystem string) *Logger {
+	logLock.Lock()
+	defer logLock.Unlock()
+	logSubsystems[subsystem] = true
+	return &Logger{subsystem: subsystem}
+}
+
+// catches output of the standard logger, ie from net/http
+func init() {
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{})
+}
+
+type stdLogWriter struct{}
+
+func (stdLogWriter) Write(p []byte) (int, error) {
+	mainLog.Warnf("%s", strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+// With returns a logger that adds the key value pairs to every entry
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{subsystem: l.subsystem, fields: fields}
+}
+
+func (l *Logger) Debugf(format string, a ...interface{}) { l.write(LevelDebug, format, a) }
+func (l *Logger) Infof(format string, a ...interface{})  { l.write(LevelInfo, format, a) }
+func (l *Logger) Warnf(format string, a ...interface{})  { l.write(LevelWarn, format, a) }
+func (l *Logger) Errorf(format string, a ...interface{}) { l.write(LevelError, format, a) }
+
+// Fatalf logs an error and exits
+func (l *Logger) Fatalf(format string, a ...interface{}) {
+	l.write(LevelError, format, a)
+	os.Exit(exitError)
+}
+
+func (l *Logger) write(level Level, format string, a []interface{}) {
+	logLock.Lock()
+	defer logLock.Unlock()
+
+	min, set := logLevels[l.subsystem]
+	if !set {
+		min = defaultLevel
+	}
+	if level < min {
+		return
+	}
+
+	now, msg := time.Now(), fmt.Sprintf(format, a...)
+	b := bytes.Buffer{}
+	if logJSON {
+		b.WriteString(`{"time":`)
+		jsonValue(&b, now.Format(time.RFC3339Nano))
+		b.WriteString(`,"level":`)
+		jsonValue(&b, level.String())
+		b.WriteString(`,"subsystem":`)
+		jsonValue(&b, l.subsystem)
+		b.WriteString(`,"msg":`)
+		jsonValue(&b, msg)
+		for i := 0; i+1 < len(l.fields); i += 2 {
+			b.WriteByte(',')
+			jsonValue(&b, fmt.Sprint(l.fields[i]))
+			b.WriteByte(':')
+			jsonValue(&b, l.fields[i+1])
+		}
+		b.WriteString("}\n")
+	} else {
+		fmt.Fprintf(&b, "%s %-5s [%s] %s", now.Format("2006/01/02 15:04:05"), strings.ToUpper(level.String()), l.subsystem, msg)
+		for i := 0; i+1 < len(l.fields); i += 2 {
+			v := fmt.Sprint(l.fields[i+1])
+			if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+				v = strconv.Quote(v)
+			}
+			fmt.Fprintf(&b, " %v=%s", l.fields[i], v)
+		}
+		b.WriteByte('\n')
+	}
+	logOut.Write(b.Bytes())
+}
+
+func jsonValue(b *bytes.Buffer, v interface{}) {
+	enc := bytes.Buffer{}
+	e := json.NewEncoder(&enc)
+	e.SetEscapeHTML(false)
+	if err := e.Encode(v); err != nil {
+		enc.Reset()
+		e.Encode(fmt.Sprint(v))
+	}
+	b.Write(bytes.TrimSuffix(enc.Bytes(), []byte("\n")))
+}
+
+// setLogOutput sends every entry to w
+func setLogOutput(w io.Writer) {
+	logLock.Lock()
+	defer logLock.Unlock()
+	logOut = w
+}
+
+// setLogConfig applies the format and levels from cfg, levels set through the
+// control api are replaced
+func setLogConfig(cfg LoggingConfig) {
+	level, _ := parseLevel(cfg.Level) // checked by validateConfig
+	levels := map[string]Level{}
+	for k, v := range cfg.Levels {
+		if l, err := parseLevel(v); err == nil {
+			levels[k] = l
+		}
+	}
+
+	logLock.Lock()
+	defer logLock.Unlock()
+	logJSON = cfg.Format == "json"
+	defaultLevel, logLevels = level, levels
+}
+
+// SetLogLevel changes the level of subsystem, or the default level when
+// subsystem is empty
+func SetLogLevel(subsystem string, level Level) error {
+	logLock.Lock()
+	defer logLock.Unlock()
+	if subsystem == "" {
+		defaultLevel = level
+		return nil
+	}
+	if !logSubsystems[subsystem] {
+		return fmt.Errorf("%w: unknown subsystem '%s', expected one of %s", errNotFound, subsystem, strings.Join(knownSubsystems(), ", "))
+	}
+	logLevels[subsystem] = level
+	return nil
+}
+
+// logLevelStatus is the level in effect for every subsystem
+type logLevelStatus struct {
+	Format  string           `json:"format"`
+	Default Level            `json:"default"`
+	Levels  map[string]Level `json:"levels"`
+}
+
+func LogLevels() logLevelStatus {
+	logLock.Lock()
+	defer logLock.Unlock()
+	status := logLevelStatus{Format: "text", Default: defaultLevel, Levels: map[string]Level{}}
+	if logJSON {
+		status.Format = "json"
+	}
+	for s := range logSubsystems {
+		status.Levels[s] = defaultLevel
+		if l, set := logLevels[s]; set {
+			status.Levels[s] = l
+		}
+	}
+	return status
+}
+
+func (s logLevelStatus) known(subsystem string) bool {
+	_, known := s.Levels[subsystem]
+	return known
+}
+
+// must be called with logLock held
+func knownSubsystems() []string {
+	names := make([]string, 0, len(logSubsystems))
+	for s := range logSubsystems {
+		names = append(names, s)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var logsLog = newLogger("logs")
+
+// how often plotter_logs is checked for logs to compress or remove
+const plotterLogsInterval = time.Hour
+
+// logs written to more recently than this belong to running plots
+const plotterLogQuiet = time.Hour
+
+// rotatingFile is a log file that's moved aside once it gets too big or too
+// old, keeping the last few rotated files
+type rotatingFile struct {
+	lock   sync.Mutex
+	path   string
+	cfg    LogRotateConfig
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func openRotatingFile(path string, cfg LogRotateConfig) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, cfg: cfg}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size, f.opened = file, info.Size(), time.Now()
+	return nil
+}
+
+// setConfig changes the rotation settings, they're checked on the next write
+func (f *rotatingFile) setConfig(cfg LogRotateConfig) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.cfg = cfg
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	tooBig := f.cfg.MaxSizeMB > 0 && f.size+int64(len(p)) > int64(f.cfg.MaxSizeMB)<<20
+	tooOld := f.cfg.MaxAge > 0 && time.Since(f.opened) > f.cfg.MaxAge
+	if f.size > 0 && (tooBig || tooOld) {
+		if err := f.rotate(); err != nil {
+			// keep writing to the old file rather than losing entries
+			f.opened = time.Now()
+			os.Stderr.WriteString("Error rotating '" + f.path + "': " + err.Error() + "\n")
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate renames the file to name-<timestamp>.ext and starts a new one, must
+// be called with the lock held
+func (f *rotatingFile) rotate() error {
+	ext := filepath.Ext(f.path)
+	stamp := strings.TrimSuffix(f.path, ext) + "-" + time.Now().Format("20060102T150405")
+	rotated := stamp + ext
+	for i := 1; fileExists(rotated) || fileExists(rotated+".gz"); i++ {
+		rotated = fmt.Sprintf("%s.%d%s", stamp, i, ext)
+	}
+	if err := os.Rename(f.path, rotated); err != nil {
+		return err
+	}
+	f.file.Close()
+	if err := f.open(); err != nil {
+		return err
+	}
+
+	cfg := f.cfg
+	go func() {
+		if cfg.Compress {
+			if err := gzipFile(rotated); err != nil {
+				os.Stderr.WriteString("Error compressing '" + rotated + "': " + err.Error() + "\n")
+			}
+		}
+		f.prune(cfg.Keep)
+	}()
+	return nil
+}
+
+// prune removes all but the newest keep rotated files
+func (f *rotatingFile) prune(keep int) {
+	if keep <= 0 {
+		return
+	}
+	ext := filepath.Ext(f.path)
+	rotated, _ := filepath.Glob(strings.TrimSuffix(f.path, ext) + "-*" + ext + "*")
+	sort.Strings(rotated) // timestamps sort by age
+	if len(rotated) <= keep {
+		return
+	}
+	for _, r := range rotated[:len(rotated)-keep] {
+		os.Remove(r)
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// gzipFile replaces path with path.gz, keeping the modification time so
+// the age of the log doesn't reset
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(path + ".gz.tmp")
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		os.Chtimes(path+".gz.tmp", info.ModTime(), info.ModTime())
+		err = os.Rename(path+".gz.tmp", path+".gz")
+	}
+	if err != nil {
+		os.Remove(path + ".gz.tmp")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// maintainPlotterLogs compresses and removes old plotter logs in dir, cfg is
+// read on every pass so reloads apply
+func maintainPlotterLogs(ctx context.Context, dir string, cfg func() PlotterLogsConfig) {
+	for ctx.Err() == nil {
+		cleanPlotterLogs(dir, cfg(), time.Now())
+		sleepContext(ctx, plotterLogsInterval)
+	}
+}
+
+func cleanPlotterLogs(dir string, cfg PlotterLogsConfig, now time.Time) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		logsLog.Errorf("Error listing plotter logs in '%s': %v", dir, err)
+		return
+	}
+
+	type logFile struct {
+		path string
+		info os.FileInfo
+	}
+	var files []logFile
+	compressed, removed := 0, 0
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		age := now.Sub(info.ModTime())
+
+		if cfg.MaxAge > 0 && age > cfg.MaxAge && age > plotterLogQuiet {
+			if err := os.Remove(path); err == nil {
+				removed++
+			}
+			continue
+		}
+		// a plot writes its log until it finishes, only touch logs that went quiet
+		if cfg.CompressAfter > 0 && age > cfg.CompressAfter && age > plotterLogQuiet && strings.HasSuffix(path, ".log") {
+			if err := gzipFile(path); err != nil {
+				logsLog.Errorf("Error compressing '%s': %v", path, err)
+			} else {
+				compressed++
+				path += ".gz"
+				info, err = os.Stat(path)
+				if err != nil {
+					continue
+				}
+			}
+		}
+		files = append(files, logFile{path, info})
+	}
+
+	if cfg.MaxSizeMB > 0 {
+		sort.Slice(files, func(i, j int) bool { return files[i].info.ModTime().Before(files[j].info.ModTime()) })
+		total := int64(0)
+		for _, f := range files {
+			total += f.info.Size()
+		}
+		for _, f := range files {
+			if total <= int64(cfg.MaxSizeMB)<<20 {
+				break
+			}
+			if now.Sub(f.info.ModTime()) < plotterLogQuiet {
+				break // this and everything newer may still be written to
+			}
+			if err := os.Remove(f.path); err == nil {
+				total -= f.info.Size()
+				removed++
+			}
+		}
+	}
+
+	if compressed > 0 || removed > 0 {
+		logsLog.Infof("Compressed %d and removed %d plotter logs in '%s'", compressed, removed, dir)
+	}
+}
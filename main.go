@@ -1,58 +1,214 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"io"
-	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"syscall"
 	"time"
 )
 
 var fastRate = 15 * time.Second
 var slowRate = 1 * time.Minute
 
+// swapped for a virtual clock when simulating
+var clock = time.Now
+
 var processMonitor *ProcessMonitor
 
+var mainLog = newLogger("main")
+
+// monitor.log, rotated according to the Logging config
+var monitorLogFile *rotatingFile
+
+// set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+// where plot_history.json and plotter_logs are kept
+var stateDir = "."
+
+// exit codes
+const (
+	exitError  = 1
+	exitUsage  = 2
+	exitConfig = 78 // EX_CONFIG from sysexits.h
+)
+
+const usage = `usage: chia-monitor <command> [flags]
+
+commands:
+  run               run the monitor (default)
+  validate-config   check a config file and exit
+  version           print the version
+  top               live terminal view of this host
+  ctl               query or control a running monitor
+  simulate          run the plotter scheduler against simulated plots
+
+run 'chia-monitor <command> -h' for the flags of a command
+`
+
 func main() {
-	logFile, err := os.OpenFile("monitor.log", os.O_CREATE|os.O_APPEND|os.O_RDWR, 0666)
-	if err != nil {
-		panic(err)
+	args := os.Args[1:]
+	cmd := "run"
+	if len(args) > 0 && args[0] != "" && args[0][0] != '-' {
+		cmd, args = args[0], args[1:]
 	}
 
-	mw := io.MultiWriter(os.Stdout, logFile)
-	log.SetOutput(mw)
-	log.Println("====== Startup Finished ======")
-	cfg, err := parseConfig("config.yaml")
-	if err != nil {
-		log.Println(err)
+	switch cmd {
+	case "run":
+		runMonitor(args)
+	case "validate-config":
+		runValidateConfig(args)
+	case "version":
+		fmt.Printf("chia-monitor %s (%s %s/%s)\n", version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	case "simulate":
+		runSimulation(args)
+	case "top":
+		runTop(args)
+	case "ctl":
+		runCtl(args)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command '%s'\n\n%s", cmd, usage)
+		os.Exit(exitUsage)
 	}
+}
 
-	go startMemMonitor()
-	processMonitor = StartProcessMonitor()
+func statePath(name string) string {
+	return filepath.Join(stateDir, name)
+}
 
-	if cfg.DriveMonitorEnabled {
-		go startDriveMonitoring(cfg.DriveMonitorConfig)
-	} else {
-		log.Println("[WARN] Drive Monitor disabled in cfg")
+func runValidateConfig(args []string) {
+	fs := flag.NewFlagSet("validate-config", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "config file to check")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		*configPath = fs.Arg(0)
 	}
-	if cfg.PlotterEnabled {
-		go startPlotter(cfg.PlotterConfig, cfg.ChiaPath)
-	} else {
-		log.Println("[WARN] Plotter disabled in cfg")
+
+	if _, err := loadConfig(*configPath); err != nil {
+		printConfigError(*configPath, err)
+		os.Exit(exitConfig)
 	}
-	if cfg.UhaulEnabled {
-		go startUhaul(cfg.UhaulConfig)
-	} else {
-		log.Println("[WARN] UHaul disabled in cfg")
+	fmt.Printf("%s: ok\n", *configPath)
+}
+
+func printConfigError(path string, err error) {
+	if errs, ok := err.(ConfigErrors); ok {
+		fmt.Fprintf(os.Stderr, "%s has %d problem(s):\n", path, len(errs))
+		for _, e := range errs {
+			fmt.Fprintf(os.Stderr, "  %s\n", e.Error())
+		}
+		return
 	}
-	if cfg.FarmMonitorEnabled {
-		go startFarmMonitor(cfg.ChiaPath)
-	} else {
-		log.Println("[WARN] Farm monitor disabled in cfg")
+	fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+}
+
+func runMonitor(args []string) {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "config file")
+	logPath := fs.String("log", "monitor.log", "log file, output also goes to stdout")
+	state := fs.String("state-dir", ".", "dir for plot history and plotter logs")
+	fs.StringVar(&listenFlag, "listen", "", "address to serve metrics, the status api and dashboard on, overrides Metrics.Listen (default \":2112\")")
+	allowEmpty := fs.Bool("allow-empty", false, "keep running with everything disabled if the config is missing or invalid")
+	fs.DurationVar(&transferTimeout, "shutdown-timeout", transferTimeout, "how long plot transfers get to finish on shutdown before they're aborted")
+	fs.Parse(args)
+
+	cfg, cfgErr := loadConfig(*configPath)
+	if cfgErr != nil {
+		printConfigError(*configPath, cfgErr)
+		if !*allowEmpty {
+			os.Exit(exitConfig)
+		}
+		cfg = MonitorConfig{LoggingConfig: defaultLoggingConfig, AlertsConfig: defaultAlertsConfig}
+		setMetricsDefaults(&cfg.MetricsConfig)
+	}
+
+	stateDir, _ = filepath.Abs(*state)
+	if err := os.MkdirAll(statePath("plotter_logs"), 0755); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitError)
+	}
+	lifecycle = NewLifecycleTracker(statePath("plot_history.json"))
+
+	logFile, err := openRotatingFile(*logPath, cfg.LoggingConfig.File)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitError)
+	}
+	monitorLogFile = logFile
+
+	setLogOutput(io.MultiWriter(os.Stdout, logFile))
+	setLogConfig(cfg.LoggingConfig)
+	mainLog.Infof("====== Startup Finished ======")
+	mainLog.Infof("chia-monitor %s, config '%s', state in '%s'", version, *configPath, stateDir)
+	if cfgErr != nil {
+		mainLog.Warnf("Running with an empty config, '%s' is invalid", *configPath)
+	}
+
+	startSubsystem("events", func(ctx context.Context) { logEvents(events.SubscribeContext(ctx, "log")) })
+	startSubsystem("metrics", func(ctx context.Context) {
+		recordPlotMetrics(events.SubscribeContext(ctx, "metrics", PhaseChanged, PlotCompleted, PlotFailed))
+	})
+	startSubsystem("lifecycle", func(ctx context.Context) {
+		lifecycle.Run(events.SubscribeContext(ctx, "lifecycle"))
+		lifecycle.Flush()
+	})
+
+	startSubsystem("logs", func(ctx context.Context) {
+		maintainPlotterLogs(ctx, statePath("plotter_logs"), func() PlotterLogsConfig {
+			configLock.Lock()
+			defer configLock.Unlock()
+			return currentConfig.LoggingConfig.PlotterLogs
+		})
+	})
+	timingModel.LoadLogs(statePath("plotter_logs"))
+	if err := lifecycle.Load(); err != nil {
+		lifecycleLog.Errorf("Error loading plot history: %v", err)
 	}
+	processMonitor = NewProcessMonitor()
+	startSubsystem("processes", processMonitor.Run)
 
-	startRecording()
+	if !cfg.DriveMonitorEnabled {
+		mainLog.Warnf("Drive Monitor disabled in cfg")
+	}
+	if !cfg.PlotterEnabled {
+		mainLog.Warnf("Plotter disabled in cfg")
+	}
+	if !cfg.UhaulEnabled {
+		mainLog.Warnf("UHaul disabled in cfg")
+	}
+	if !cfg.FarmMonitorEnabled {
+		mainLog.Warnf("Farm monitor disabled in cfg")
+	}
+	applyConfig(MonitorConfig{}, cfg)
+	startSubsystem("config", func(ctx context.Context) { watchConfig(ctx, *configPath) })
 
-	for {
-		time.Sleep(5 * time.Minute)
+	if cfg.ControlConfig.Listen != "" || cfg.ControlConfig.Socket != "" {
+		startSubsystem("control", func(ctx context.Context) { startControlAPI(ctx, cfg.ControlConfig) })
 	}
+
+	startSubsystem("history", startHistory)
+	startSubsystem("alerts", func(ctx context.Context) {
+		alerts.Run(ctx, func() AlertsConfig {
+			configLock.Lock()
+			defer configLock.Unlock()
+			return currentConfig.AlertsConfig
+		})
+	})
+	startSubsystem("http", func(ctx context.Context) { startHTTP(ctx, cfg.MetricsConfig) })
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-ctx.Done()
+	stop() // a second signal kills the monitor right away
+
+	mainLog.Infof("====== Shutting down ======")
+	stopSubsystems()
+	mainLog.Infof("====== Shutdown Finished ======")
 }
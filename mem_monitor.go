@@ -2,32 +2,41 @@ package main
 
 import (
 	"bufio"
+	"fmt"
 	"io"
-	"log"
 	"os"
 	"regexp"
 	"strconv"
+	"sync"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 type Meminfo map[string]uint64
 
 var meminfo = Meminfo{}
+var meminfoAt time.Time
+var meminfoLock sync.Mutex
 var meminfoRegex = regexp.MustCompile(`(\w+):\s+(\d+)\s(\w+)`)
 
+var (
+	ramUsedDesc  = prometheus.NewDesc("chia_host_used_ram", "The current ram usage for the host", nil, nil)
+	ramMaxDesc   = prometheus.NewDesc("chia_host_max_ram", "The current max ram for the host", nil, nil)
+	swapUsedDesc = prometheus.NewDesc("chia_host_swap_usage", "The current swap usage for the host", nil, nil)
+)
+
 func parseMeminfo() (Meminfo, error) {
 	o, err := os.Open("/proc/meminfo")
 	if err != nil {
 		return nil, err
 	}
+	defer o.Close()
+
 	ret := Meminfo{}
 	r := bufio.NewReader(o)
 	for {
 		s, err := r.ReadString('\n')
-		if err == io.EOF {
-			break
-		}
-
 		if meminfoRegex.Match([]byte(s)) {
 			matches := meminfoRegex.FindStringSubmatch(s)
 			if len(matches) > 2 {
@@ -38,20 +47,54 @@ func parseMeminfo() (Meminfo, error) {
 				ret[matches[1]] = v
 			}
 		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
 	}
 
+	if _, ok := ret["MemTotal"]; !ok {
+		return nil, fmt.Errorf("no MemTotal in /proc/meminfo")
+	}
 	return ret, nil
 }
 
-func startMemMonitor() {
-	go func() {
-		for {
-			var err error
-			meminfo, err = parseMeminfo()
-			if err != nil {
-				log.Fatal(err)
-			}
-			time.Sleep(fastRate)
-		}
-	}()
+// readMeminfo returns /proc/meminfo in kB, reading it at most every
+// collectorCacheTTL. On error the last values read are returned with it
+func readMeminfo() (Meminfo, error) {
+	meminfoLock.Lock()
+	defer meminfoLock.Unlock()
+	if time.Since(meminfoAt) < collectorCacheTTL {
+		return meminfo, nil
+	}
+
+	m, err := parseMeminfo()
+	if err != nil {
+		return meminfo, err
+	}
+	meminfo, meminfoAt = m, time.Now()
+	return m, nil
+}
+
+// currentMeminfo returns /proc/meminfo in kB, or the last values read if it
+// can't be read right now
+func currentMeminfo() Meminfo {
+	m, _ := readMeminfo()
+	return m
+}
+
+// collectMeminfo reports ram and swap in GB
+func collectMeminfo() ([]prometheus.Metric, error) {
+	m, err := readMeminfo()
+	if err != nil {
+		return nil, err
+	}
+
+	gb := func(key string) float64 { return float64(m[key]) / 1024.0 / 1024.0 }
+	return []prometheus.Metric{
+		prometheus.MustNewConstMetric(ramUsedDesc, prometheus.GaugeValue, gb("MemTotal")-gb("MemAvailable")),
+		prometheus.MustNewConstMetric(ramMaxDesc, prometheus.GaugeValue, gb("MemTotal")),
+		prometheus.MustNewConstMetric(swapUsedDesc, prometheus.GaugeValue, gb("SwapTotal")-gb("SwapFree")),
+	}, nil
 }
@@ -1,89 +1,146 @@
 package main
 
 import (
-	"log"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"net"
 	"net/http"
-	"time"
+	"os"
+	"strings"
+	"sync"
 
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-var (
-	ramUsageGauge = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "chia_host_used_ram",
-		Help: "The current ram usage for the host",
-	})
-
-	ramMaxGauge = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "chia_host_max_ram",
-		Help: "The current max ram for the host",
-	})
-
-	swapUsageGauge = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "chia_host_swap_usage",
-		Help: "The current swap usage for the host",
-	})
-
-	// phaseTime = promauto.NewCounterVec(prometheus.CounterOpts{
-	// 	Name: "plotter_state",
-	// 	Help: "Time spent in each phase",
-	// }, []string{
-	// 	"pid",
-	// 	"phase",
-	// })
-)
+var httpLog = newLogger("http")
 
-func startRecording() {
-	recordMetrics()
+// metricsServer asks for a basic auth login or bearer token when any are
+// configured
+type metricsServer struct {
+	cfg MetricsConfig
+	mux *http.ServeMux
+}
 
-	http.Handle("/metrics", promhttp.Handler())
-	err := http.ListenAndServe(":2112", nil)
-	if err != nil {
-		log.Println(err)
+// startHTTP serves metrics, the status api and the dashboard on the
+// configured address and/or socket until ctx is done
+func startHTTP(ctx context.Context, cfg MetricsConfig) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	registerStatusAPI(mux)
+	registerDashboard(mux)
+	s := &metricsServer{cfg: cfg, mux: mux}
+
+	var wg sync.WaitGroup
+	serve := func(l net.Listener) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := serveHTTP(ctx, l, s); err != nil {
+				httpLog.Errorf("Server stopped: %v", err)
+			}
+		}()
 	}
-}
 
-func recordMetrics() {
-	go func() {
-		// give the program some time to settle/process before we start sending metrics
-		time.Sleep(30 * time.Second)
-		for {
-			// completions := float64(0)
-			// for _, v := range plotterStates {
+	if cfg.Socket != "" {
+		os.Remove(cfg.Socket) // left over from a previous run
+		l, err := net.Listen("unix", cfg.Socket)
+		if err != nil {
+			httpLog.Errorf("Error listening on '%s': %v", cfg.Socket, err)
+		} else {
+			os.Chmod(cfg.Socket, 0660)
+			httpLog.Infof("Listening on unix socket '%s'", cfg.Socket)
+			serve(l)
+		}
+	}
 
-			// 	pi, _ := strconv.ParseFloat(p, 64)
-			// 	ti, _ := strconv.ParseFloat(t, 64)
-			// 	bi, _ := strconv.ParseFloat(b, 64)
-			// 	bsi, _ := strconv.ParseFloat(bs, 64)
+	if cfg.Listen != "" {
+		l, err := listenMetrics(cfg)
+		if err != nil {
+			httpLog.Errorf("Error listening on %s: %v", cfg.Listen, err)
+		} else {
+			scheme := "http"
+			if cfg.TLSCert != "" {
+				scheme = "https"
+			}
+			httpLog.Infof("Listening on %s://%s", scheme, cfg.Listen)
+			if !s.authRequired() && !loopbackAddr(cfg.Listen) {
+				httpLog.Warnf("No Metrics.Users or Metrics.Tokens configured, anyone who can reach %s can read the status api", cfg.Listen)
+			}
+			serve(l)
+		}
+	}
 
-			// 	// p4, t7, b 32/32
-			// 	// (3 * 25) + (7/7) * 20 + (32/32) * 5 = 100
-			// 	progress := ((pi - 1) * 20) + ((ti / 7) * 20) + (bi/bsi)*5
+	wg.Wait()
+}
 
-			// 	pid := fmt.Sprintf("%d", v.Pid)
-			// 	//processVec.WithLabelValues(pid).Set(float64(p))
-			// 	completions += float64(v.Completions)
+// listenMetrics opens the tcp listener, wrapped in TLS when a cert is set. A
+// bad cert fails rather than falling back to plain http
+func listenMetrics(cfg MetricsConfig) (net.Listener, error) {
+	var tlsCfg *tls.Config
+	if cfg.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
 
-			// 	//phaseTime.WithLabelValues(pid, p).Inc()
-			// }
+	l, err := net.Listen("tcp", cfg.Listen)
+	if err != nil || tlsCfg == nil {
+		return l, err
+	}
+	return tls.NewListener(l, tlsCfg), nil
+}
 
-			// processGauge.Set(float64(len(plotterStates)))
+func loopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
 
-			// processGauge.W
+func (s *metricsServer) authRequired() bool {
+	return len(s.cfg.Users) > 0 || len(s.cfg.Tokens) > 0
+}
 
-			total := (float64)(meminfo["MemTotal"]) / 1024.0 / 1024.0
-			free := (float64)(meminfo["MemAvailable"]) / 1024.0 / 1024.0
-			swapTotal := (float64)(meminfo["SwapTotal"]) / 1024.0 / 1024.0
-			swapFree := (float64)(meminfo["SwapFree"]) / 1024.0 / 1024.0
+func (s *metricsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.authRequired() && !s.authenticate(r) {
+		httpLog.Debugf("Rejected %s %s from %s, invalid login or token", r.Method, r.URL.Path, r.RemoteAddr)
+		if len(s.cfg.Users) > 0 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="chia-monitor"`)
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
 
-			ramUsageGauge.Set(total - free)
-			ramMaxGauge.Set(total)
-			swapUsageGauge.Set(swapTotal - swapFree)
+func (s *metricsServer) authenticate(r *http.Request) bool {
+	if name, password, ok := r.BasicAuth(); ok {
+		for _, u := range s.cfg.Users {
+			nameOK := subtle.ConstantTimeCompare([]byte(u.Name), []byte(name)) == 1
+			passwordOK := subtle.ConstantTimeCompare([]byte(u.Password), []byte(password)) == 1
+			if nameOK && passwordOK {
+				return true
+			}
+		}
+		return false
+	}
 
-			//opsProcessed.Inc()
-			time.Sleep(15 * time.Second)
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		return false
+	}
+	for _, t := range s.cfg.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return true
 		}
-	}()
+	}
+	return false
 }
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var mqttLog = newLogger("mqtt")
+
+var mqttConnected = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "mqtt_connected",
+	Help: "1 while connected to the MQTT broker",
+})
+
+// published to <prefix>/<host>/events/<type> as they happen, not retained
+var mqttEventTypes = []EventType{PlotCompleted, TransferFinished, PlotFailed}
+
+var topicRegex = regexp.MustCompile(`[^a-zA-Z0-9]+`)
+
+// topicSlug turns a hostname or path into a single topic level
+func topicSlug(s string) string {
+	slug := strings.Trim(topicRegex.ReplaceAllString(s, "_"), "_")
+	if slug == "" {
+		return "root"
+	}
+	return slug
+}
+
+// mqttPublisher publishes retained state under <prefix>/<host>/ and, with
+// Discovery, the home assistant configs for it
+type mqttPublisher struct {
+	cfg    MQTTConfig
+	host   string
+	base   string
+	client *mqttClient
+
+	// slugs of the drives with retained topics on the broker, saved to
+	// drivesPath so ones removed while disconnected or stopped still get
+	// cleared
+	drives     map[string]bool
+	drivesPath string
+	announced  map[string]bool // drives with discovery configs sent this session
+}
+
+// startMQTT publishes to the broker until ctx is done, reconnecting with
+// backoff whenever the connection is lost
+func startMQTT(ctx context.Context, cfg MQTTConfig) {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	p := &mqttPublisher{cfg: cfg, host: host, base: cfg.Prefix + "/" + topicSlug(host), drivesPath: statePath("mqtt_drives.json")}
+	if p.cfg.ClientID == "" {
+		p.cfg.ClientID = "chia-monitor-" + topicSlug(host)
+	}
+	p.loadDrives()
+	evs := events.SubscribeContext(ctx, "mqtt", mqttEventTypes...)
+
+	retry := retryBackoff{}
+	for ctx.Err() == nil {
+		connected, err := p.session(ctx, evs)
+		mqttConnected.Set(0)
+		if ctx.Err() != nil {
+			break
+		}
+
+		pushFailures.WithLabelValues("mqtt").Inc()
+		if connected {
+			retry.succeeded()
+		}
+		wait, first := retry.failed()
+		if first {
+			mqttLog.Warnf("Lost %s, reconnecting with backoff: %v", cfg.Broker, err)
+		} else {
+			mqttLog.Debugf("Error connecting to %s, retrying in %v: %v", cfg.Broker, wait, err)
+		}
+		sleepContext(ctx, wait)
+	}
+	mqttLog.Infof("Stopped")
+}
+
+// session connects and publishes until the connection is lost or ctx is
+// done, connected tells if it got that far
+func (p *mqttPublisher) session(ctx context.Context, evs <-chan Event) (connected bool, err error) {
+	status := p.base + "/status"
+	client, err := dialMQTT(p.cfg.Broker, p.cfg.ClientID, p.cfg.Username, p.cfg.Password,
+		mqttWill{topic: status, payload: []byte("offline"), retain: true})
+	if err != nil {
+		return false, err
+	}
+	p.client, p.announced = client, map[string]bool{}
+	defer client.close()
+
+	mqttConnected.Set(1)
+	mqttLog.Infof("Connected to %s, publishing to '%s'", p.cfg.Broker, p.base)
+	if err := p.publish(status, []byte("online"), true); err != nil {
+		return true, err
+	}
+	if p.cfg.Discovery {
+		if err := p.publishDiscovery(); err != nil {
+			return true, err
+		}
+	}
+	if err := p.publishState(); err != nil {
+		return true, err
+	}
+
+	state := time.NewTicker(p.cfg.Interval)
+	defer state.Stop()
+	ping := time.NewTicker(mqttKeepAlive / 2)
+	defer ping.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			// a clean disconnect doesn't trigger the will
+			p.publish(status, []byte("offline"), true)
+			return true, nil
+		case <-client.done:
+			return true, client.err()
+		case e, ok := <-evs:
+			if !ok {
+				continue // ctx is done
+			}
+			payload, _ := json.Marshal(struct {
+				Event
+				Host string `json:"host"`
+			}{e, p.host})
+			if err := p.publish(p.base+"/events/"+string(e.Type), payload, false); err != nil {
+				return true, err
+			}
+		case <-state.C:
+			if err := p.publishState(); err != nil {
+				return true, err
+			}
+		case <-ping.C:
+			if err := client.ping(); err != nil {
+				return true, err
+			}
+		}
+	}
+}
+
+func (p *mqttPublisher) publish(topic string, payload []byte, retain bool) error {
+	if err := p.client.publish(topic, payload, byte(p.cfg.QoS), retain); err != nil {
+		return fmt.Errorf("publishing '%s': %v", topic, err)
+	}
+	return nil
+}
+
+func (p *mqttPublisher) publishJSON(topic string, v interface{}) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return p.publish(topic, payload, true)
+}
+
+// publishState sends the retained plotter, drive, farm and memory topics
+func (p *mqttPublisher) publishState() error {
+	plots := plotterStatus()
+	if err := p.publishJSON(p.base+"/plotters", map[string]interface{}{"active": len(plots), "plots": plots}); err != nil {
+		return err
+	}
+	if err := p.publishJSON(p.base+"/farm", CurrentFarmSummary()); err != nil {
+		return err
+	}
+	if err := p.publishJSON(p.base+"/memory", memStatus()); err != nil {
+		return err
+	}
+
+	changed := false
+	defer func() {
+		if changed {
+			p.saveDrives()
+		}
+	}()
+
+	seen := map[string]bool{}
+	for _, d := range DriveSnapshot() {
+		slug := topicSlug(d.Path)
+		seen[slug] = true
+		// recorded before publishing, a retained topic is never forgotten
+		if !p.drives[slug] {
+			p.drives[slug], changed = true, true
+		}
+		if !p.announced[slug] && p.cfg.Discovery {
+			if err := p.publishDriveDiscovery(slug, d.Path); err != nil {
+				return err
+			}
+			p.announced[slug] = true
+		}
+		if err := p.publishJSON(p.base+"/drives/"+slug, d); err != nil {
+			return err
+		}
+	}
+	// drives removed from the config, empty retained payloads clear them
+	for slug := range p.drives {
+		if seen[slug] {
+			continue
+		}
+		topics := []string{p.base + "/drives/" + slug}
+		if p.cfg.Discovery {
+			for _, s := range p.driveSensors(slug, "") {
+				topics = append(topics, p.discoveryTopic(s))
+			}
+		}
+		for _, t := range topics {
+			if err := p.publish(t, nil, true); err != nil {
+				return err
+			}
+		}
+		delete(p.drives, slug)
+		delete(p.announced, slug)
+		changed = true
+	}
+	return nil
+}
+
+// loadDrives reads the drives published before a restart, by topic base so
+// a changed Prefix doesn't clear another tree
+func (p *mqttPublisher) loadDrives() {
+	p.drives = map[string]bool{}
+	b, err := os.ReadFile(p.drivesPath)
+	if os.IsNotExist(err) {
+		return
+	}
+	var saved map[string][]string
+	if err == nil {
+		err = json.Unmarshal(b, &saved)
+	}
+	if err != nil {
+		mqttLog.Errorf("Error loading published drives: %v", err)
+		return
+	}
+	for _, slug := range saved[p.base] {
+		p.drives[slug] = true
+	}
+}
+
+func (p *mqttPublisher) saveDrives() {
+	saved := map[string][]string{}
+	if b, err := os.ReadFile(p.drivesPath); err == nil {
+		json.Unmarshal(b, &saved)
+	}
+	slugs := []string{}
+	for slug := range p.drives {
+		slugs = append(slugs, slug)
+	}
+	sort.Strings(slugs)
+	saved[p.base] = slugs
+
+	b, err := json.Marshal(saved)
+	if err != nil {
+		mqttLog.Errorf("Error encoding published drives: %v", err)
+		return
+	}
+	tmp := p.drivesPath + ".tmp"
+	if err := os.WriteFile(tmp, b, 0666); err != nil {
+		mqttLog.Errorf("Error saving published drives: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, p.drivesPath); err != nil {
+		mqttLog.Errorf("Error saving published drives: %v", err)
+	}
+}
+
+// haSensor is a home assistant mqtt discovery config
+type haSensor struct {
+	component string
+	object    string
+
+	Name              string   `json:"name"`
+	UniqueID          string   `json:"unique_id"`
+	StateTopic        string   `json:"state_topic"`
+	ValueTemplate     string   `json:"value_template"`
+	Unit              string   `json:"unit_of_measurement,omitempty"`
+	DeviceClass       string   `json:"device_class,omitempty"`
+	StateClass        string   `json:"state_class,omitempty"`
+	Icon              string   `json:"icon,omitempty"`
+	AvailabilityTopic string   `json:"availability_topic"`
+	Device            haDevice `json:"device"`
+}
+
+type haDevice struct {
+	Identifiers []string `json:"identifiers"`
+	Name        string   `json:"name"`
+	Model       string   `json:"model"`
+	SWVersion   string   `json:"sw_version"`
+}
+
+func (p *mqttPublisher) sensor(component, object, name, topic, template string) haSensor {
+	node := "chia_monitor_" + topicSlug(p.host)
+	return haSensor{
+		component:         component,
+		object:            object,
+		Name:              name,
+		UniqueID:          node + "_" + object,
+		StateTopic:        p.base + "/" + topic,
+		ValueTemplate:     template,
+		AvailabilityTopic: p.base + "/status",
+		Device: haDevice{
+			Identifiers: []string{node},
+			Name:        "chia-monitor " + p.host,
+			Model:       "chia-monitor",
+			SWVersion:   version,
+		},
+	}
+}
+
+func (p *mqttPublisher) discoveryTopic(s haSensor) string {
+	return fmt.Sprintf("%s/%s/chia_monitor_%s/%s/config", p.cfg.DiscoveryPrefix, s.component, topicSlug(p.host), s.object)
+}
+
+func (p *mqttPublisher) publishDiscovery() error {
+	plots := p.sensor("sensor", "active_plots", "Active plots", "plotters", "{{ value_json.active }}")
+	plots.StateClass, plots.Icon = "measurement", "mdi:progress-clock"
+	ram := p.sensor("sensor", "ram_used", "RAM used", "memory", "{{ (value_json.usedBytes / value_json.totalBytes * 100) | round(1) }}")
+	ram.Unit, ram.StateClass, ram.Icon = "%", "measurement", "mdi:memory"
+	swap := p.sensor("sensor", "swap_used", "Swap used", "memory", "{{ (value_json.swapUsedBytes / 1073741824) | round(2) }}")
+	swap.Unit, swap.DeviceClass, swap.StateClass = "GiB", "data_size", "measurement"
+	farmed := p.sensor("sensor", "farmed", "Chia farmed", "farm", "{{ value_json.farmed }}")
+	farmed.Unit, farmed.StateClass, farmed.Icon = "XCH", "total_increasing", "mdi:sprout"
+	netspace := p.sensor("sensor", "netspace", "Netspace", "farm", "{{ value_json.netspacePiB }}")
+	netspace.Unit, netspace.StateClass, netspace.Icon = "PiB", "measurement", "mdi:earth"
+
+	for _, s := range []haSensor{plots, ram, swap, farmed, netspace} {
+		if err := p.publishJSON(p.discoveryTopic(s), s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// driveSensors are the free space, plot count and low space sensors of a drive
+func (p *mqttPublisher) driveSensors(slug, path string) []haSensor {
+	topic := "drives/" + slug
+	free := p.sensor("sensor", slug+"_free", path+" free", topic, "{{ (value_json.freeBytes / 1073741824) | round(1) }}")
+	free.Unit, free.DeviceClass, free.StateClass = "GiB", "data_size", "measurement"
+	plots := p.sensor("sensor", slug+"_plots", path+" plots", topic, "{{ value_json.plots }}")
+	plots.StateClass, plots.Icon = "measurement", "mdi:harddisk"
+	low := p.sensor("binary_sensor", slug+"_low", path+" low on space", topic, "{{ 'ON' if value_json.low else 'OFF' }}")
+	low.DeviceClass = "problem"
+	return []haSensor{free, plots, low}
+}
+
+func (p *mqttPublisher) publishDriveDiscovery(slug, path string) error {
+	for _, s := range p.driveSensors(slug, path) {
+		if err := p.publishJSON(p.discoveryTopic(s), s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
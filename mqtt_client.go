@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	mqttConnect    = 1
+	mqttConnack    = 2
+	mqttPublish    = 3
+	mqttPuback     = 4
+	mqttPubrec     = 5
+	mqttPubrel     = 6
+	mqttPubcomp    = 7
+	mqttPingreq    = 12
+	mqttPingresp   = 13
+	mqttDisconnect = 14
+)
+
+// the broker drops the connection after 1.5x this without a packet from us
+const mqttKeepAlive = 60 * time.Second
+
+var mqttConnackErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "client id rejected",
+	3: "server unavailable",
+	4: "bad username or password",
+	5: "not authorized",
+}
+
+type mqttAck struct {
+	kind byte
+	id   uint16
+}
+
+// mqttClient is a minimal MQTT 3.1.1 client that only publishes, acks are
+// matched to publishes by packet id
+type mqttClient struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	lock    sync.Mutex // one packet is written at a time
+	nextID  uint16
+	acks    chan mqttAck
+	done    chan struct{} // closed when the connection is lost
+	readErr error
+}
+
+// mqttWill is published by the broker when the connection drops without a
+// disconnect
+type mqttWill struct {
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+// dialMQTT connects to broker, a tcp:// or mqtt:// url, or ssl://, tls:// or
+// mqtts:// for TLS
+func dialMQTT(broker, clientID, username, password string, will mqttWill) (*mqttClient, error) {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return nil, err
+	}
+	secure := u.Scheme == "ssl" || u.Scheme == "tls" || u.Scheme == "mqtts"
+	addr := u.Host
+	if u.Port() == "" && secure {
+		addr = net.JoinHostPort(u.Hostname(), "8883")
+	} else if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "1883")
+	}
+
+	dialer := &net.Dialer{Timeout: pushTimeout}
+	var conn net.Conn
+	if secure {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: u.Hostname()})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &mqttClient{conn: conn, r: bufio.NewReader(conn), acks: make(chan mqttAck, 16), done: make(chan struct{})}
+	if err := c.connect(clientID, username, password, will); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go c.read()
+	return c, nil
+}
+
+func (c *mqttClient) connect(clientID, username, password string, will mqttWill) error {
+	flags := byte(0x02) // clean session
+	body := mqttString(nil, "MQTT")
+	payload := mqttString(nil, clientID)
+	if will.topic != "" {
+		flags |= 0x04
+		if will.retain {
+			flags |= 0x20
+		}
+		payload = mqttString(payload, will.topic)
+		payload = mqttBytes(payload, will.payload)
+	}
+	if username != "" {
+		flags |= 0x80
+		payload = mqttString(payload, username)
+		if password != "" {
+			flags |= 0x40
+			payload = mqttString(payload, password)
+		}
+	}
+	body = append(body, 4, flags) // protocol level 4 is 3.1.1
+	body = mqttUint16(body, uint16(mqttKeepAlive/time.Second))
+	body = append(body, payload...)
+
+	c.conn.SetDeadline(time.Now().Add(pushTimeout))
+	defer c.conn.SetDeadline(time.Time{})
+	if err := c.write(mqttConnect<<4, body); err != nil {
+		return err
+	}
+
+	kind, resp, err := mqttReadPacket(c.r)
+	if err != nil {
+		return err
+	}
+	if kind>>4 != mqttConnack || len(resp) < 2 {
+		return fmt.Errorf("expected CONNACK, got packet type %d", kind>>4)
+	}
+	if code := resp[1]; code != 0 {
+		if msg, known := mqttConnackErrors[code]; known {
+			return fmt.Errorf("connection refused: %s", msg)
+		}
+		return fmt.Errorf("connection refused with code %d", code)
+	}
+	return nil
+}
+
+// read handles everything the broker sends until the connection drops
+func (c *mqttClient) read() {
+	defer close(c.done)
+	for {
+		kind, body, err := mqttReadPacket(c.r)
+		if err != nil {
+			c.readErr = err
+			return
+		}
+		switch kind >> 4 {
+		case mqttPuback, mqttPubrec, mqttPubcomp:
+			if len(body) >= 2 {
+				select {
+				case c.acks <- mqttAck{kind: kind >> 4, id: binary.BigEndian.Uint16(body)}:
+				default: // nobody is waiting for it anymore
+				}
+			}
+		case mqttPingresp:
+		default:
+			c.readErr = fmt.Errorf("unexpected packet type %d", kind>>4)
+			c.conn.Close()
+			return
+		}
+	}
+}
+
+// err is why the connection was lost, nil while it's up
+func (c *mqttClient) err() error {
+	select {
+	case <-c.done:
+		if c.readErr == nil || errors.Is(c.readErr, io.EOF) {
+			return fmt.Errorf("connection closed by broker")
+		}
+		return c.readErr
+	default:
+		return nil
+	}
+}
+
+// publish sends payload and, for qos 1 and 2, waits for the broker to take it
+func (c *mqttClient) publish(topic string, payload []byte, qos byte, retain bool) error {
+	header := byte(mqttPublish<<4) | qos<<1
+	if retain {
+		header |= 0x01
+	}
+	body := mqttString(nil, topic)
+	var id uint16
+	if qos > 0 {
+		c.lock.Lock()
+		c.nextID++
+		if c.nextID == 0 {
+			c.nextID = 1
+		}
+		id = c.nextID
+		c.lock.Unlock()
+		body = mqttUint16(body, id)
+	}
+	body = append(body, payload...)
+
+	if err := c.write(header, body); err != nil {
+		return err
+	}
+	switch qos {
+	case 1:
+		return c.waitAck(mqttPuback, id)
+	case 2:
+		if err := c.waitAck(mqttPubrec, id); err != nil {
+			return err
+		}
+		if err := c.write(mqttPubrel<<4|0x02, mqttUint16(nil, id)); err != nil {
+			return err
+		}
+		return c.waitAck(mqttPubcomp, id)
+	}
+	return nil
+}
+
+func (c *mqttClient) waitAck(kind byte, id uint16) error {
+	timeout := time.After(pushTimeout)
+	for {
+		select {
+		case ack := <-c.acks:
+			if ack.kind == kind && ack.id == id {
+				return nil
+			}
+		case <-c.done:
+			return c.err()
+		case <-timeout:
+			return fmt.Errorf("no ack for packet %d", id)
+		}
+	}
+}
+
+func (c *mqttClient) ping() error {
+	return c.write(mqttPingreq<<4, nil)
+}
+
+// close disconnects cleanly, so the broker doesn't publish the will
+func (c *mqttClient) close() {
+	c.write(mqttDisconnect<<4, nil)
+	c.conn.Close()
+	<-c.done
+}
+
+func (c *mqttClient) write(header byte, body []byte) error {
+	packet := []byte{header}
+	n := len(body)
+	for { // remaining length, 7 bits at a time
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	packet = append(packet, body...)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(pushTimeout))
+	_, err := c.conn.Write(packet)
+	return err
+}
+
+func mqttReadPacket(r *bufio.Reader) (byte, []byte, error) {
+	kind, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, shift := 0, 0
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		if shift += 7; shift > 21 {
+			return 0, nil, fmt.Errorf("malformed remaining length")
+		}
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	return kind, body, err
+}
+
+func mqttUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func mqttString(b []byte, s string) []byte {
+	return mqttBytes(b, []byte(s))
+}
+
+func mqttBytes(b []byte, s []byte) []byte {
+	b = mqttUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
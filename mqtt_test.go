@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type brokerPublish struct {
+	topic   string
+	payload string
+	retain  bool
+}
+
+// startTestBroker accepts connections and passes on every PUBLISH
+func startTestBroker(t *testing.T) (string, <-chan brokerPublish) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	pubs := make(chan brokerPublish, 100)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					kind, body, err := mqttReadPacket(r)
+					if err != nil {
+						return
+					}
+					switch kind >> 4 {
+					case mqttConnect:
+						conn.Write([]byte{mqttConnack << 4, 2, 0, 0})
+					case mqttPublish:
+						n := int(binary.BigEndian.Uint16(body))
+						pubs <- brokerPublish{topic: string(body[2 : 2+n]), payload: string(body[2+n:]), retain: kind&1 == 1}
+					case mqttDisconnect:
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return "tcp://" + l.Addr().String(), pubs
+}
+
+// runSession connects once, publishes the state and disconnects, returning
+// the last publish to every topic
+func runSession(t *testing.T, p *mqttPublisher, pubs <-chan brokerPublish) map[string]brokerPublish {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := p.session(ctx, nil)
+		done <- err
+	}()
+
+	// the state is published before the session waits on ctx
+	got := map[string]brokerPublish{}
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case pub := <-pubs:
+			got[pub.topic] = pub
+			if pub.topic == p.base+"/memory" {
+				cancel()
+			}
+			if pub.topic == p.base+"/status" && pub.payload == "offline" {
+				if err := <-done; err != nil {
+					t.Fatalf("session: %v", err)
+				}
+				return got
+			}
+		case <-timeout:
+			t.Fatalf("session didn't finish, got %v", got)
+		}
+	}
+}
+
+func TestMQTTClearsRemovedDrives(t *testing.T) {
+	broker, pubs := startTestBroker(t)
+	drive := t.TempDir()
+	slug := topicSlug(drive)
+	updateDriveInfo(drive, func(*DriveInfo) {})
+	t.Cleanup(func() {
+		driveInfoLock.Lock()
+		delete(driveInfos, drive)
+		driveInfoLock.Unlock()
+	})
+
+	// published by a previous run under this prefix, and by another prefix
+	state := filepath.Join(t.TempDir(), "mqtt_drives.json")
+	if err := os.WriteFile(state, []byte(`{"chia_monitor/farm1":["gone"],"other/farm1":["elsewhere"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	newPublisher := func() *mqttPublisher {
+		p := &mqttPublisher{
+			cfg:        MQTTConfig{Broker: broker, ClientID: "test", Prefix: "chia_monitor", Interval: time.Hour, Discovery: true, DiscoveryPrefix: "homeassistant"},
+			host:       "farm1",
+			base:       "chia_monitor/farm1",
+			drivesPath: state,
+		}
+		p.loadDrives()
+		return p
+	}
+	saved := func() map[string][]string {
+		b, err := os.ReadFile(state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m map[string][]string
+		if err := json.Unmarshal(b, &m); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	p := newPublisher()
+	got := runSession(t, p, pubs)
+	for _, topic := range []string{"chia_monitor/farm1/drives/gone", "homeassistant/sensor/chia_monitor_farm1/gone_free/config"} {
+		if pub, ok := got[topic]; !ok || pub.payload != "" || !pub.retain {
+			t.Errorf("%s got %+v, want an empty retained payload", topic, pub)
+		}
+	}
+	if pub := got["chia_monitor/farm1/drives/"+slug]; pub.payload == "" {
+		t.Errorf("drive %s wasn't published", slug)
+	}
+	if _, ok := got["other/farm1/drives/elsewhere"]; ok {
+		t.Errorf("cleared a drive of another prefix")
+	}
+	want := map[string][]string{"chia_monitor/farm1": {slug}, "other/farm1": {"elsewhere"}}
+	if got := saved(); !reflect.DeepEqual(got, want) {
+		t.Errorf("saved %v, want %v", got, want)
+	}
+
+	// removed between sessions of the same run
+	driveInfoLock.Lock()
+	delete(driveInfos, drive)
+	driveInfoLock.Unlock()
+	got = runSession(t, p, pubs)
+	if pub, ok := got["chia_monitor/farm1/drives/"+slug]; !ok || pub.payload != "" {
+		t.Errorf("got %+v, want an empty payload", pub)
+	}
+	want["chia_monitor/farm1"] = []string{}
+	if got := saved(); !reflect.DeepEqual(got, want) {
+		t.Errorf("saved %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var notifyLog = newLogger("notify")
+
+// messages waiting on the rate limit or a channel that's down, the oldest are
+// dropped past this
+const maxPendingMessages = 100
+
+var (
+	notificationsSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notifications_sent_total",
+		Help: "Messages sent, by channel",
+	}, []string{
+		"channel",
+	})
+
+	notificationsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notifications_failed_total",
+		Help: "Attempts to send a message that failed, by channel",
+	}, []string{
+		"channel",
+	})
+
+	notificationsDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notifications_dropped_total",
+		Help: "Messages dropped because too many were waiting, by channel",
+	}, []string{
+		"channel",
+	})
+)
+
+var defaultNotifyTemplates = map[string]string{
+	string(PlotLaunched):     `{{.Host}}: launched a {{.Tag}} plot in {{.Path}}`,
+	string(PlotStarted):      `{{.Host}}: plot {{.PlotID}} ({{.Tag}}) started`,
+	string(PhaseChanged):     `{{.Host}}: plot {{.PlotID}} ({{.Tag}}) entered phase {{.Phase}}`,
+	string(PlotCompleted):    `{{.Host}}: plot {{.PlotID}} ({{.Tag}}) finished as {{.File}}`,
+	string(PlotFailed):       `{{.Host}}: plot {{.PlotID}} ({{.Tag}}) failed in phase {{.Phase}}: {{.Error}}`,
+	string(TransferStarted):  `{{.Host}}: moving {{.File}} to {{.Destination}}`,
+	string(TransferFinished): `{{.Host}}: moved {{.File}} to {{.Destination}} in {{duration .Duration}}`,
+	string(TransferFailed):   `{{.Host}}: failed moving {{.File}} to {{.Destination}}: {{.Error}}`,
+	string(DriveLow):         `{{.Host}}: {{.Path}} is low on space, {{bytes .FreeBytes}} free`,
+	string(DriveFull):        `{{.Host}}: {{.Path}} has no room for another plot, {{bytes .FreeBytes}} free`,
+	string(AlertFiring):      `{{.Host}}: [FIRING] {{.Alert}}: {{.Message}}`,
+	string(AlertResolved):    `{{.Host}}: [RESOLVED] {{.Alert}}: {{.Message}}`,
+	"digest": `{{.Host}}: {{len .Events}} event(s) since {{time .Since}}
+{{range .Types}}- {{.Count}} {{.Type}}{{if .Tags}} ({{.Tags}}){{end}}
+{{end}}`,
+}
+
+var notifyFuncs = texttemplate.FuncMap{
+	"duration": formatDuration,
+	"bytes":    formatBytes,
+	"time":     func(t time.Time) string { return t.Local().Format("2006-01-02 15:04") },
+}
+
+// parseNotifyTemplates compiles the configured templates over the defaults,
+// by event type and digest
+func parseNotifyTemplates(cfg NotifyConfig) (map[string]*texttemplate.Template, error) {
+	templates := map[string]*texttemplate.Template{}
+	for name, text := range defaultNotifyTemplates {
+		if t, custom := cfg.Templates[name]; custom {
+			text = t
+		}
+		tmpl, err := texttemplate.New(name).Funcs(notifyFuncs).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("template %s: %v", name, err)
+		}
+		templates[name] = tmpl
+	}
+	return templates, nil
+}
+
+// notifyMessage is one or more events rendered for a channel
+type notifyMessage struct {
+	Host   string  `json:"host"`
+	Text   string  `json:"text"`
+	Digest bool    `json:"digest,omitempty"`
+	Events []Event `json:"events"`
+}
+
+// digestType summarizes the events of one type for the digest template
+type digestType struct {
+	Type  EventType
+	Count int
+	Tags  string // count by tag, ie "ext0 3, ext1 2"
+}
+
+// notifier sends the events a channel wants, batched and rate limited, and
+// collects the ones for its digest
+type notifier struct {
+	cfg       NotifyConfig
+	host      string
+	templates map[string]*texttemplate.Template
+	send      func(m notifyMessage) error
+
+	pending []notifyMessage
+	next    time.Time   // when pending may be sent
+	sent    []time.Time // within the last hour, for RateLimit
+	retry   retryBackoff
+
+	digest      []Event
+	digestSince time.Time
+}
+
+// startNotify runs every channel until ctx is done, email channels send
+// through the server in email
+func startNotify(ctx context.Context, cfgs []*NotifyConfig, email EmailConfig) {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	client := &http.Client{Timeout: pushTimeout}
+
+	wg := sync.WaitGroup{}
+	for _, cfg := range cfgs {
+		n, err := newNotifier(*cfg, host, client, email)
+		if err != nil {
+			notifyLog.Errorf("Not sending to %s: %v", cfg.Name, err)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n.run(ctx, events.SubscribeContext(ctx, "notify_"+n.cfg.Name))
+		}()
+	}
+	wg.Wait()
+	notifyLog.Infof("Stopped")
+}
+
+func newNotifier(cfg NotifyConfig, host string, client *http.Client, email EmailConfig) (*notifier, error) {
+	templates, err := parseNotifyTemplates(cfg)
+	if err != nil {
+		return nil, err
+	}
+	n := &notifier{cfg: cfg, host: host, templates: templates, digestSince: time.Now()}
+
+	switch cfg.Type {
+	case "discord":
+		n.send = func(m notifyMessage) error {
+			return postJSON(client, cfg.URL, nil, map[string]string{"content": truncate(m.Text, 2000), "username": "chia-monitor"})
+		}
+	case "slack":
+		n.send = func(m notifyMessage) error {
+			return postJSON(client, cfg.URL, nil, map[string]string{"text": truncate(m.Text, 40000)})
+		}
+	case "telegram":
+		endpoint := strings.TrimSuffix(cfg.URL, "/") + "/bot" + cfg.Token + "/sendMessage"
+		n.send = func(m notifyMessage) error {
+			return postJSON(client, endpoint, nil, map[string]interface{}{
+				"chat_id":                  cfg.ChatID,
+				"text":                     truncate(m.Text, 4096),
+				"disable_web_page_preview": true,
+			})
+		}
+	case "webhook":
+		n.send = func(m notifyMessage) error {
+			return postJSON(client, cfg.URL, cfg.Headers, m)
+		}
+	case "email":
+		to := cfg.To
+		if len(to) == 0 {
+			to = email.To
+		}
+		n.send = func(m notifyMessage) error {
+			return sendMail(email, to, emailSubject(m), m.Text, "")
+		}
+	default:
+		return nil, fmt.Errorf("unknown type '%s'", cfg.Type)
+	}
+	return n, nil
+}
+
+func (n *notifier) run(ctx context.Context, evs <-chan Event) {
+	digestAt := nextDigest(n.cfg.DigestAt, time.Now())
+	for {
+		wake := time.Until(digestAt)
+		if len(n.pending) > 0 && time.Until(n.next) < wake {
+			wake = time.Until(n.next)
+		}
+		timer := time.NewTimer(wake)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			// send what was published up to now, one try
+			for e := range evs {
+				n.add(e)
+			}
+			if len(n.pending) > 0 {
+				n.next = time.Time{}
+				n.flush()
+			}
+			return
+		case e, ok := <-evs:
+			if ok {
+				n.add(e)
+			}
+		case now := <-timer.C:
+			if !now.Before(digestAt) {
+				n.queueDigest()
+				digestAt = nextDigest(n.cfg.DigestAt, now)
+			}
+			if len(n.pending) > 0 && !now.Before(n.next) {
+				n.flush()
+			}
+		}
+		timer.Stop()
+	}
+}
+
+// wants filters by event type, tag and alert rule
+func (n *notifier) wants(e Event, types []string) bool {
+	if !contains(types, string(e.Type)) {
+		return false
+	}
+	if len(n.cfg.Tags) > 0 && e.Tag != "" && !contains(n.cfg.Tags, e.Tag) {
+		return false
+	}
+	if len(n.cfg.Alerts) > 0 && e.Alert != "" && !contains(n.cfg.Alerts, e.Alert) {
+		return false
+	}
+	return true
+}
+
+func (n *notifier) add(e Event) {
+	if n.wants(e, n.cfg.Digest) {
+		n.digest = append(n.digest, e)
+		return
+	}
+	if !n.wants(e, n.cfg.Events) {
+		return
+	}
+
+	b := bytes.Buffer{}
+	data := struct {
+		Event
+		Host string
+	}{e, n.host}
+	if err := n.templates[string(e.Type)].Execute(&b, data); err != nil {
+		notifyLog.Warnf("Error rendering %s for %s: %v", e.Type, n.cfg.Name, err)
+		return
+	}
+	n.queue(notifyMessage{Host: n.host, Text: strings.TrimSpace(b.String()), Events: []Event{e}})
+}
+
+// queue holds m until the batch window passed, messages arriving meanwhile
+// are sent along with it
+func (n *notifier) queue(m notifyMessage) {
+	if len(n.pending) == 0 {
+		if at := time.Now().Add(n.cfg.Batch); at.After(n.next) {
+			n.next = at
+		}
+	}
+	n.pending = append(n.pending, m)
+	if over := len(n.pending) - maxPendingMessages; over > 0 {
+		n.pending = n.pending[over:]
+		notificationsDropped.WithLabelValues(n.cfg.Name).Add(float64(over))
+	}
+}
+
+func (n *notifier) queueDigest() {
+	if len(n.digest) == 0 {
+		n.digestSince = time.Now()
+		return
+	}
+
+	counts := map[EventType]int{}
+	tags := map[EventType]map[string]int{}
+	for _, e := range n.digest {
+		counts[e.Type]++
+		if e.Tag != "" {
+			if tags[e.Type] == nil {
+				tags[e.Type] = map[string]int{}
+			}
+			tags[e.Type][e.Tag]++
+		}
+	}
+	var types []digestType
+	for t, c := range counts {
+		var byTag []string
+		for tag, c := range tags[t] {
+			byTag = append(byTag, fmt.Sprintf("%s %d", tag, c))
+		}
+		sort.Strings(byTag)
+		types = append(types, digestType{Type: t, Count: c, Tags: strings.Join(byTag, ", ")})
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i].Type < types[j].Type })
+
+	b := bytes.Buffer{}
+	data := map[string]interface{}{"Host": n.host, "Since": n.digestSince, "Events": n.digest, "Types": types}
+	if err := n.templates["digest"].Execute(&b, data); err != nil {
+		notifyLog.Warnf("Error rendering the digest for %s: %v", n.cfg.Name, err)
+	} else {
+		n.queue(notifyMessage{Host: n.host, Text: strings.TrimSpace(b.String()), Digest: true, Events: n.digest})
+	}
+	n.digest, n.digestSince = nil, time.Now()
+}
+
+// flush sends everything pending as one message, unless that would go over
+// RateLimit
+func (n *notifier) flush() {
+	now := time.Now()
+	for len(n.sent) > 0 && now.Sub(n.sent[0]) >= time.Hour {
+		n.sent = n.sent[1:]
+	}
+	if len(n.sent) >= n.cfg.RateLimit {
+		n.next = n.sent[0].Add(time.Hour)
+		notifyLog.Debugf("%s is rate limited until %s, %d message(s) waiting", n.cfg.Name, n.next.Format("15:04:05"), len(n.pending))
+		return
+	}
+
+	m := n.pending[0]
+	for _, p := range n.pending[1:] {
+		m.Text += "\n" + p.Text
+		m.Digest = m.Digest || p.Digest
+		m.Events = append(m.Events, p.Events...)
+	}
+	if err := n.send(m); err != nil {
+		notificationsFailed.WithLabelValues(n.cfg.Name).Inc()
+		wait, first := n.retry.failed()
+		n.next = n.retry.next
+		if first {
+			notifyLog.Warnf("Error sending to %s, retrying with backoff: %v", n.cfg.Name, err)
+		} else {
+			notifyLog.Debugf("Error sending to %s, retrying in %v: %v", n.cfg.Name, wait, err)
+		}
+		return
+	}
+
+	if n.retry.succeeded() {
+		notifyLog.Infof("Sending to %s again", n.cfg.Name)
+	}
+	notificationsSent.WithLabelValues(n.cfg.Name).Inc()
+	n.pending, n.sent, n.next = nil, append(n.sent, now), now
+}
+
+// emailSubject is the first line of a single event, otherwise a count
+func emailSubject(m notifyMessage) string {
+	switch {
+	case m.Digest:
+		return fmt.Sprintf("%s: digest of %d event(s)", m.Host, len(m.Events))
+	case len(m.Events) > 1:
+		return fmt.Sprintf("%s: %d events", m.Host, len(m.Events))
+	}
+	subject := strings.SplitN(m.Text, "\n", 2)[0]
+	return truncate(subject, 200)
+}
+
+// nextDigest is the next time of day at, a validated HH:MM, after now
+func nextDigest(at string, now time.Time) time.Time {
+	t, _ := time.Parse("15:04", at)
+	next := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// postJSON sends v to endpoint. Errors leave the url out, chat webhook and
+// telegram urls carry their token
+func postJSON(client *http.Client, endpoint string, headers map[string]string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return withoutURL(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "chia-monitor/"+version)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return withoutURL(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// withoutURL strips the url net/http and net/url put in their errors
+func withoutURL(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return fmt.Errorf("%s: %v", urlErr.Op, urlErr.Err)
+	}
+	return err
+}
+
+// truncate cuts s to max runes for channels that refuse longer messages
+func truncate(s string, max int) string {
+	r := []rune(s)
+	if len(r) <= max {
+		return s
+	}
+	return string(r[:max-1]) + "…"
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
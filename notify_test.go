@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type notifyRequest struct {
+	path   string
+	header http.Header
+	body   map[string]interface{}
+}
+
+// notifyServer stands in for a chat api, answering with the given statuses
+// in turn, then 200
+type notifyServer struct {
+	*httptest.Server
+	lock     sync.Mutex
+	statuses []int
+	requests []notifyRequest
+}
+
+func newNotifyServer(t *testing.T, statuses ...int) *notifyServer {
+	s := &notifyServer{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		req := notifyRequest{path: r.URL.Path, header: r.Header}
+		if err := json.Unmarshal(b, &req.body); err != nil {
+			t.Errorf("body %s: %v", b, err)
+		}
+
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.requests = append(s.requests, req)
+		status := http.StatusOK
+		if len(s.statuses) > 0 {
+			status, s.statuses = s.statuses[0], s.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *notifyServer) received() []notifyRequest {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]notifyRequest{}, s.requests...)
+}
+
+// testNotifier is set up the way decodeConfig fills in the defaults
+func testNotifier(t *testing.T, cfg NotifyConfig) *notifier {
+	t.Helper()
+	if cfg.Name == "" {
+		cfg.Name = cfg.Type
+	}
+	if cfg.Events == nil {
+		cfg.Events = defaultNotifyEvents
+	}
+	if cfg.RateLimit == 0 {
+		cfg.RateLimit = 30
+	}
+	if cfg.DigestAt == "" {
+		cfg.DigestAt = "08:00"
+	}
+	n, err := newNotifier(cfg, "farm1", &http.Client{Timeout: pushTimeout}, EmailConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func plotCompleted(id string) Event {
+	return Event{Type: PlotCompleted, Time: time.Now(), Tag: "ssd0", PlotID: id, File: "/plots/" + id + ".plot"}
+}
+
+func TestNotifierPayloads(t *testing.T) {
+	text := "farm1: plot abc (ssd0) finished as /plots/abc.plot"
+	for _, tc := range []struct {
+		typ  string
+		path string
+		body map[string]interface{}
+	}{
+		{"discord", "/discord", map[string]interface{}{"content": text, "username": "chia-monitor"}},
+		{"slack", "/slack", map[string]interface{}{"text": text}},
+		{"telegram", "/telegram/bot123:abc/sendMessage", map[string]interface{}{"chat_id": "42", "text": text, "disable_web_page_preview": true}},
+	} {
+		s := newNotifyServer(t)
+		n := testNotifier(t, NotifyConfig{Type: tc.typ, URL: s.URL + "/" + tc.typ, Token: "123:abc", ChatID: "42"})
+		n.add(plotCompleted("abc"))
+		n.flush()
+
+		got := s.received()
+		if len(got) != 1 {
+			t.Fatalf("%s: %d requests, want 1", tc.typ, len(got))
+		}
+		if got[0].path != tc.path || got[0].header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s: sent to %s as %s", tc.typ, got[0].path, got[0].header.Get("Content-Type"))
+		}
+		if !reflect.DeepEqual(got[0].body, tc.body) {
+			t.Errorf("%s: sent %v, want %v", tc.typ, got[0].body, tc.body)
+		}
+	}
+
+	s := newNotifyServer(t)
+	n := testNotifier(t, NotifyConfig{Type: "webhook", URL: s.URL, Headers: map[string]string{"X-Key": "k"}})
+	n.add(plotCompleted("abc"))
+	n.flush()
+	got := s.received()
+	if len(got) != 1 || got[0].header.Get("X-Key") != "k" {
+		t.Fatalf("got %+v, want one request with the X-Key header", got)
+	}
+	events, _ := got[0].body["events"].([]interface{})
+	if got[0].body["host"] != "farm1" || got[0].body["text"] != text || len(events) != 1 {
+		t.Fatalf("webhook got %v", got[0].body)
+	}
+	if e := events[0].(map[string]interface{}); e["type"] != "plot_completed" || e["plotId"] != "abc" {
+		t.Errorf("webhook event %v", e)
+	}
+}
+
+func TestNotifierBatching(t *testing.T) {
+	s := newNotifyServer(t)
+	n := testNotifier(t, NotifyConfig{Type: "webhook", URL: s.URL, Batch: time.Minute, Tags: []string{"ssd0"}})
+
+	start := time.Now()
+	n.add(plotCompleted("a"))
+	n.add(Event{Type: PhaseChanged, Tag: "ssd0"})   // not in Events
+	n.add(Event{Type: PlotCompleted, Tag: "other"}) // not in Tags
+	n.add(plotCompleted("b"))
+	if len(n.pending) != 2 {
+		t.Fatalf("%d pending, want 2", len(n.pending))
+	}
+	if n.next.Before(start.Add(time.Minute)) || n.next.After(time.Now().Add(time.Minute)) {
+		t.Errorf("sent at %v, want a minute after the first event", n.next)
+	}
+
+	n.flush()
+	got := s.received()
+	if len(got) != 1 {
+		t.Fatalf("%d requests, want 1", len(got))
+	}
+	want := "farm1: plot a (ssd0) finished as /plots/a.plot\nfarm1: plot b (ssd0) finished as /plots/b.plot"
+	if text := got[0].body["text"]; text != want {
+		t.Errorf("text %q", text)
+	}
+	if events := got[0].body["events"].([]interface{}); len(events) != 2 {
+		t.Errorf("%d events, want 2", len(events))
+	}
+	if len(n.pending) != 0 {
+		t.Errorf("%d still pending", len(n.pending))
+	}
+}
+
+func TestNotifierRateLimit(t *testing.T) {
+	s := newNotifyServer(t)
+	n := testNotifier(t, NotifyConfig{Type: "slack", URL: s.URL, RateLimit: 2})
+
+	for _, id := range []string{"a", "b", "c"} {
+		n.add(plotCompleted(id))
+		n.flush()
+	}
+	if got := len(s.received()); got != 2 {
+		t.Fatalf("%d requests, want 2", got)
+	}
+	if len(n.pending) != 1 || !n.next.Equal(n.sent[0].Add(time.Hour)) {
+		t.Fatalf("%d pending until %v, want 1 until an hour after the first", len(n.pending), n.next)
+	}
+
+	// the first message left the window
+	n.sent[0] = n.sent[0].Add(-time.Hour)
+	n.flush()
+	if got := len(s.received()); got != 3 || len(n.pending) != 0 {
+		t.Errorf("%d requests and %d pending, want 3 and none", got, len(n.pending))
+	}
+}
+
+func TestNotifierBackoff(t *testing.T) {
+	s := newNotifyServer(t, http.StatusInternalServerError, http.StatusBadGateway)
+	n := testNotifier(t, NotifyConfig{Type: "discord", URL: s.URL})
+	n.add(plotCompleted("a"))
+
+	for _, want := range []time.Duration{10 * time.Second, 20 * time.Second} {
+		before := time.Now()
+		n.flush()
+		if len(n.pending) != 1 || n.retry.backoff != want {
+			t.Fatalf("%d pending with backoff %v, want 1 and %v", len(n.pending), n.retry.backoff, want)
+		}
+		if n.next.Before(before.Add(want)) || n.next.After(time.Now().Add(want)) {
+			t.Errorf("next try at %v, want in %v", n.next, want)
+		}
+	}
+
+	n.flush()
+	if len(n.pending) != 0 || n.retry.failing || n.retry.backoff != 0 || len(n.sent) != 1 {
+		t.Errorf("after a 200: %d pending, %+v", len(n.pending), n.retry)
+	}
+	if got := len(s.received()); got != 3 {
+		t.Errorf("%d requests, want 3", got)
+	}
+
+	// the wait stops growing
+	r := retryBackoff{backoff: 4 * time.Minute, failing: true}
+	if wait, first := r.failed(); wait != maxPushBackoff || first {
+		t.Errorf("got %v (first %v), want %v", wait, first, maxPushBackoff)
+	}
+}
+
+func TestNotifierDigest(t *testing.T) {
+	s := newNotifyServer(t)
+	n := testNotifier(t, NotifyConfig{Type: "slack", URL: s.URL, Digest: []string{"transfer_finished"}})
+	for _, tag := range []string{"ext0", "ext1", "ext0"} {
+		n.add(Event{Type: TransferFinished, Tag: tag})
+	}
+	if len(n.pending) != 0 || len(n.digest) != 3 {
+		t.Fatalf("%d pending and %d in the digest, want 0 and 3", len(n.pending), len(n.digest))
+	}
+
+	n.queueDigest()
+	n.flush()
+	got := s.received()
+	if len(got) != 1 {
+		t.Fatalf("%d requests, want 1", len(got))
+	}
+	if text := got[0].body["text"].(string); !strings.Contains(text, "- 3 transfer_finished (ext0 2, ext1 1)") {
+		t.Errorf("digest %q", text)
+	}
+	if len(n.digest) != 0 {
+		t.Errorf("%d events left in the digest", len(n.digest))
+	}
+}
+
+func TestNextDigest(t *testing.T) {
+	day := func(d, h, m int) time.Time { return time.Date(2021, 6, d, h, m, 0, 0, time.Local) }
+	for _, tc := range []struct {
+		at       string
+		now, out time.Time
+	}{
+		{"08:00", day(6, 7, 59), day(6, 8, 0)},
+		{"08:00", day(6, 8, 0), day(7, 8, 0)},
+		{"08:00", day(6, 23, 30), day(7, 8, 0)},
+		{"00:00", day(30, 12, 0), time.Date(2021, 7, 1, 0, 0, 0, 0, time.Local)},
+	} {
+		if got := nextDigest(tc.at, tc.now); !got.Equal(tc.out) {
+			t.Errorf("nextDigest(%s, %v) = %v, want %v", tc.at, tc.now, got, tc.out)
+		}
+	}
+}
+
+func TestPostJSONHidesURL(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	endpoint := s.URL + "/bot123:s3cr3t/sendMessage"
+	s.Close() // connection refused
+
+	client := &http.Client{Timeout: pushTimeout}
+	for _, u := range []string{endpoint, "http://[::1:80/bot123:s3cr3t/sendMessage"} {
+		err := postJSON(client, u, nil, map[string]string{"text": "hi"})
+		if err == nil {
+			t.Fatalf("%s: no error", u)
+		}
+		if strings.Contains(err.Error(), "s3cr3t") {
+			t.Errorf("the token is in '%v'", err)
+		}
+	}
+}
@@ -2,36 +2,164 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
+var plotterLog = newLogger("plotter")
+
+// guards the plotter state below, plots can be launched by the scheduler and
+// the control api and the config can be reloaded at any time
+var plotterLock sync.Mutex
 var ownedPlotters map[string][]*os.Process
 var lastLaunched map[string]time.Time
+var plotterChiaPath string
+var plotterCfgMap map[string]PlotterConfig // by temp path
+
+// SchedulerDecision is the outcome of the last scheduling pass for a tag
+type SchedulerDecision struct {
+	Time   time.Time `json:"time"`
+	Launch bool      `json:"launch"`
+	Reason string    `json:"reason"`
+	Active int       `json:"active"`
+	Phase1 int       `json:"phase1"`
+}
+
+var decisionsLock sync.Mutex
+var lastDecisions = map[string]SchedulerDecision{}
+var plotterConfigs []PlotterConfig
+var drainedTags = map[string]bool{} // tags the scheduler won't launch new plots for
+
+var errNotFound = errors.New("not found")
+
+func recordDecision(tag string, d SchedulerDecision) {
+	plotterLog.With("tag", tag, "active", d.Active, "phase1", d.Phase1).Debugf("Schedule: %s", d.Reason)
+	decisionsLock.Lock()
+	defer decisionsLock.Unlock()
+	lastDecisions[tag] = d
+}
+
+// SchedulerStatus returns the plotter configs and the last decision made for each tag
+func SchedulerStatus() ([]PlotterConfig, map[string]SchedulerDecision) {
+	decisionsLock.Lock()
+	defer decisionsLock.Unlock()
+
+	decisions := make(map[string]SchedulerDecision, len(lastDecisions))
+	for k, v := range lastDecisions {
+		decisions[k] = v
+	}
+	return append([]PlotterConfig{}, plotterConfigs...), decisions
+}
+
+// Drained reports whether the scheduler has stopped launching plots for tag
+func Drained(tag string) bool {
+	decisionsLock.Lock()
+	defer decisionsLock.Unlock()
+	return drainedTags[tag]
+}
+
+// DrainTag stops (or resumes) launching new plots for tag, running plots
+// are left alone
+func DrainTag(tag string, drain bool) error {
+	if _, err := plotterConfig(tag); err != nil {
+		return err
+	}
+
+	decisionsLock.Lock()
+	defer decisionsLock.Unlock()
+	if drain {
+		drainedTags[tag] = true
+	} else {
+		delete(drainedTags, tag)
+	}
+	return nil
+}
 
-func startPlotter(cfg []*PlotterConfig, chiaPath string) {
+func plotterConfig(tag string) (PlotterConfig, error) {
+	decisionsLock.Lock()
+	defer decisionsLock.Unlock()
+	for _, cfg := range plotterConfigs {
+		if cfg.Tag == tag {
+			return cfg, nil
+		}
+	}
+	return PlotterConfig{}, fmt.Errorf("%w: no plotter config for tag '%s'", errNotFound, tag)
+}
+
+// LaunchPlot starts a plot for tag right away, ignoring the stagger
+// settings. The cooldown for the tag starts over from now
+func LaunchPlot(tag string) error {
+	cfg, err := plotterConfig(tag)
+	if err != nil {
+		return err
+	}
+
+	plotterLock.Lock()
+	defer plotterLock.Unlock()
+	if plotterCfgMap == nil {
+		return fmt.Errorf("plotter is not running")
+	}
+	lastLaunched[tag] = clock()
+	startPlot(cfg, plotterChiaPath)
+	return nil
+}
+
+func startPlotter(ctx context.Context, cfg []*PlotterConfig, chiaPath string) {
+	plotterLock.Lock()
+	if ownedPlotters == nil { // keep cooldowns when the plotter is restarted
+		ownedPlotters = map[string][]*os.Process{}
+		lastLaunched = map[string]time.Time{}
+	}
+	plotterLock.Unlock()
+	setPlotterConfig(cfg, chiaPath)
+
+	monitor(ctx)
+
+	plotterLock.Lock()
+	plotterCfgMap = nil
+	plotterLock.Unlock()
+	decisionsLock.Lock()
+	plotterConfigs = nil
+	decisionsLock.Unlock()
+}
+
+// setPlotterConfig replaces the configs the scheduler works from, plots that
+// are already running and the cooldowns are left alone
+func setPlotterConfig(cfg []*PlotterConfig, chiaPath string) {
 	if len(cfg) == 0 {
-		log.Println("[Plotter] No config specified, skipping init")
-		return
+		plotterLog.Warnf("No config specified, nothing will be scheduled")
 	}
 
 	cfgMap := map[string]PlotterConfig{}
-	ownedPlotters = map[string][]*os.Process{}
-	lastLaunched = map[string]time.Time{}
+	tags := map[string]bool{}
 
+	decisionsLock.Lock()
+	plotterConfigs = nil
 	for _, v := range cfg {
 		cfgMap[v.TempPath] = *v
+		plotterConfigs = append(plotterConfigs, *v)
+		tags[v.Tag] = true
 	}
+	for tag := range lastDecisions {
+		if !tags[tag] {
+			delete(lastDecisions, tag)
+			delete(drainedTags, tag)
+		}
+	}
+	decisionsLock.Unlock()
 
-	monitor(cfgMap, chiaPath)
-	// for _, k := range cfg {
-
-	// }
+	plotterLock.Lock()
+	plotterCfgMap = cfgMap
+	plotterChiaPath = chiaPath
+	plotterLock.Unlock()
 }
 
 // type plotterState struct {
@@ -40,15 +168,13 @@ func startPlotter(cfg []*PlotterConfig, chiaPath string) {
 // 	plotters []*PlotterState
 // }
 
-var template = `chia plots create -n 1 -r {CORES} -k 32 -c {POOL_KEY}  -u {BUCKETS} -b {RAM} -t {TEMP_PATH} -d {FINAL_PATH} -x  2>&1 > {LOGFILE}.log &`
+var template = `chia plots create -n 1 -r {CORES} -k 32 {POOL}  -u {BUCKETS} -b {RAM} -t {TEMP_PATH} -d {FINAL_PATH} -x  2>&1 > {LOGFILE}.log &`
 
 func startPlot(cfg PlotterConfig, chiaPath string) {
-	log.Printf("[%s] Starting plot on %s => %s", cfg.Tag, cfg.TempPath, cfg.FinalPath)
-	lastLaunched[cfg.Tag] = time.Now()
 	chiaProc := exec.Command("sh")
 	chiaProc.Dir = chiaPath
-
-	cwd, _ := os.Getwd()
+	// own process group, plots keep running when the monitor is interrupted
+	chiaProc.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 
 	buffer := bytes.Buffer{}
 	plotTag := fmt.Sprintf("%s_%d", cfg.Tag, time.Now().UTC().Unix())
@@ -58,9 +184,15 @@ func startPlot(cfg PlotterConfig, chiaPath string) {
 	plotterCommand = strings.ReplaceAll(plotterCommand, "{RAM}", cfg.Ram)
 	plotterCommand = strings.ReplaceAll(plotterCommand, "{TEMP_PATH}", fmt.Sprintf("%s/%s", cfg.TempPath, plotTag))
 	plotterCommand = strings.ReplaceAll(plotterCommand, "{FINAL_PATH}", cfg.FinalPath)
-	plotterCommand = strings.ReplaceAll(plotterCommand, "{LOGFILE}", fmt.Sprintf("%s/plotter_logs/%s", cwd, plotTag))
-	plotterCommand = strings.ReplaceAll(plotterCommand, "{POOL_KEY}", cfg.PoolKey)
-	log.Printf("[%s] Plot command: `%s`", cfg.Tag, plotterCommand)
+	plotterCommand = strings.ReplaceAll(plotterCommand, "{LOGFILE}", filepath.Join(statePath("plotter_logs"), plotTag))
+	plotterCommand = strings.ReplaceAll(plotterCommand, "{POOL}", poolArgs(cfg.PoolKey))
+	events.Publish(Event{
+		Type:        PlotLaunched,
+		Tag:         cfg.Tag,
+		Path:        fmt.Sprintf("%s/%s", cfg.TempPath, plotTag),
+		Destination: cfg.FinalPath,
+	})
+	plotterLog.With("tag", cfg.Tag).Infof("Plot command: `%s`", plotterCommand)
 
 	buffer.Write([]byte(fmt.Sprintf("cd %s;. ./activate;chia init;%s", chiaPath, plotterCommand)))
 	chiaProc.Stdin = &buffer
@@ -72,7 +204,7 @@ func startPlot(cfg PlotterConfig, chiaPath string) {
 
 	err := chiaProc.Start()
 	if err != nil {
-		log.Printf("[%s] Error starting/running plotter: %+v", cfg.Tag, err)
+		plotterLog.With("tag", cfg.Tag).Errorf("Error starting/running plotter: %+v", err)
 		return
 	}
 	if chiaProc.Process != nil {
@@ -89,73 +221,117 @@ func startPlot(cfg PlotterConfig, chiaPath string) {
 	// }
 }
 
-func monitor(cfgMap map[string]PlotterConfig, chiaPath string) {
-	time.Sleep(time.Second * 60)
+// poolArgs picks the plotter flag for the configured pool key, contract
+// addresses are plotted with -c and hex pool public keys with -p
+func poolArgs(key string) string {
+	switch {
+	case key == "":
+		return ""
+	case strings.HasPrefix(key, "xch1") || strings.HasPrefix(key, "txch1"):
+		return "-c " + key
+	default:
+		return "-p " + key
+	}
+}
 
-	start := time.Now()
+// how often the plotter checks whether it should launch more plots
+var scheduleInterval = 5 * time.Minute
 
-	for {
-		states := map[string][]*PlotterState{}
+func monitor(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(time.Second * 60):
+	}
+
+	start := clock()
 
+	for {
 		pm := processMonitor
 
 		pm.stateLock.Lock()
-		for _, v := range pm.plotterStates {
-			if drive, exists := v.State["temp_drive"]; exists {
-				//drive := path.Dir(drive)
-				drive = filepath.Clean(filepath.Join(drive, ".."))
-				//path.Match(pattern string, name string)
-				states[drive] = append(states[drive], v)
-			}
+		states := byTempPath(pm.plotterStates)
+		pm.stateLock.Unlock()
 
+		plotterLock.Lock()
+		chiaPath := plotterChiaPath
+		schedule(plotterCfgMap, states, start, clock(), func(cfg PlotterConfig) {
+			startPlot(cfg, chiaPath)
+		})
+		plotterLock.Unlock()
+
+		select {
+		case <-ctx.Done():
+			plotterLog.Infof("Stopped scheduling plots")
+			return
+		case <-time.After(scheduleInterval):
 		}
+	}
+}
 
-		pm.stateLock.Unlock()
-
-		log.Println("==================================")
+// byTempPath groups plotter states by the temp path they were launched in
+func byTempPath(plotterStates PlotterStates) map[string][]*PlotterState {
+	states := map[string][]*PlotterState{}
+	for _, v := range plotterStates {
+		if drive, exists := v.State["temp_drive"]; exists {
+			drive = filepath.Clean(filepath.Join(drive, ".."))
+			states[drive] = append(states[drive], v)
+		}
+	}
+	return states
+}
 
-		for k, cfg := range cfgMap {
-			byPhase := map[string][]*PlotterState{}
-			plotters := states[k]
-			active := 0
-			log.Printf("[Plotter][%s] ------------------", cfg.Tag)
-			if time.Since(start) < cfg.StartDelay {
-				wait := cfg.StartDelay - time.Since(start)
-				log.Printf("\tWill start potter in approx %f minutes due to start delay", (cfg.MinCooldown-wait).Seconds()/60)
-				continue
-			}
-			for _, v := range plotters {
-				phase := v.State["phase"]
-				prog := v.State["progress"]
-				if phase != "copy" {
-					active++
-					log.Printf("\t%d state: %s, progress: %s", v.Pid, phase, prog)
-					byPhase[phase] = append(byPhase[phase], v)
-				}
+// schedule makes a single scheduling pass over every plotter config, calling
+// launch for each one that should start a new plot at now
+func schedule(cfgMap map[string]PlotterConfig, states map[string][]*PlotterState, start time.Time, now time.Time, launch func(PlotterConfig)) {
+	for k, cfg := range cfgMap {
+		byPhase := map[string][]*PlotterState{}
+		plotters := states[k]
+		active := 0
+		decision := SchedulerDecision{Time: now}
+		if now.Sub(start) < cfg.StartDelay {
+			wait := cfg.StartDelay - now.Sub(start)
+			decision.Reason = fmt.Sprintf("start delay, %.0f minutes left", wait.Minutes())
+			recordDecision(cfg.Tag, decision)
+			continue
+		}
+		for _, v := range plotters {
+			phase := v.State["phase"]
+			if phase != "copy" {
+				active++
+				byPhase[phase] = append(byPhase[phase], v)
 			}
+		}
 
-			log.Printf("	[%d/%d] active plotters", len(plotters), cfg.StageConcurrency)
-
-			if len(plotters) < cfg.StageConcurrency {
-				if p1Plotters, exists := byPhase["1"]; exists {
-					if len(p1Plotters) >= cfg.MaxPhase1 {
-						log.Printf("\t%d plotters in phase 1, max %d, waiting to launch more", len(p1Plotters), cfg.MaxPhase1)
-						continue
-					}
-					log.Printf("\t%d plotters in phase 1, max %d, starting a plotter", len(p1Plotters), cfg.MaxPhase1)
-				}
+		decision.Active, decision.Phase1 = active, len(byPhase["1"])
+		decision.Reason = fmt.Sprintf("%d/%d plotters active", len(plotters), cfg.StageConcurrency)
+		if Drained(cfg.Tag) {
+			decision.Reason = "drained"
+			recordDecision(cfg.Tag, decision)
+			continue
+		}
 
-				lastStarted := lastLaunched[cfg.Tag]
-				elapsed := time.Since(lastStarted)
-				if elapsed < cfg.MinCooldown {
-					log.Printf("\tIn cooldown, will launch plotter in approx %f minutes", (cfg.MinCooldown-elapsed).Seconds()/60)
+		if len(plotters) < cfg.StageConcurrency {
+			if p1Plotters, exists := byPhase["1"]; exists {
+				if len(p1Plotters) >= cfg.MaxPhase1 {
+					decision.Reason = fmt.Sprintf("%d plotters in phase 1, max %d", len(p1Plotters), cfg.MaxPhase1)
+					recordDecision(cfg.Tag, decision)
 					continue
 				}
+			}
 
-				startPlot(cfg, chiaPath)
+			lastStarted := lastLaunched[cfg.Tag]
+			elapsed := now.Sub(lastStarted)
+			if elapsed < cfg.MinCooldown {
+				decision.Reason = fmt.Sprintf("in cooldown, %.0f minutes left", (cfg.MinCooldown - elapsed).Minutes())
+				recordDecision(cfg.Tag, decision)
+				continue
 			}
-		}
 
-		time.Sleep(time.Second * 60 * 5)
+			decision.Launch, decision.Reason = true, "launching a plot"
+			lastLaunched[cfg.Tag] = now
+			launch(cfg)
+		}
+		recordDecision(cfg.Tag, decision)
 	}
 }
@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"path/filepath"
 	"regexp"
 	"strconv"
@@ -19,6 +18,65 @@ type PlotterState struct {
 	Completions int
 	lock        sync.Mutex
 	lastSeen    time.Time
+	stepStarted time.Time // when the current phase/table started
+	stepExact   bool      // stepStarted came from a timestamp or a live entry
+	lastStamp   time.Time // last timestamp printed by the plotter
+	finished    bool      // the final file is in place
+
+	// labels of the active plot gauges, so they can be removed again
+	activeLabels prometheus.Labels
+	// seconds by finished phase and copy, sent with the completed event
+	phaseTimes map[string]float64
+}
+
+// PlotterInfo is a point in time copy of a PlotterState
+type PlotterInfo struct {
+	Pid        int               `json:"pid"`
+	Tag        string            `json:"tag"`
+	PlotID     string            `json:"plotId"`
+	TempDir    string            `json:"tempDir"`
+	Phase      string            `json:"phase"`
+	Table      string            `json:"table"`
+	Bucket     string            `json:"bucket"`
+	Buckets    string            `json:"buckets"`
+	Progress   float64           `json:"progress"`
+	EtaSeconds float64           `json:"etaSeconds"`
+	Eta        string            `json:"eta,omitempty"`
+	LastSeen   time.Time         `json:"lastSeen"`
+	State      map[string]string `json:"state"`
+}
+
+func (s *PlotterState) Info() PlotterInfo {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	state := make(map[string]string, len(s.State))
+	for k, v := range s.State {
+		state[k] = v
+	}
+
+	return PlotterInfo{
+		Pid:        s.Pid,
+		Tag:        plotTag(s),
+		PlotID:     state["plot_id"],
+		TempDir:    state["temp_drive"],
+		Phase:      state["phase"],
+		Table:      state["table"],
+		Bucket:     state["bucket"],
+		Buckets:    state["bucketSize"],
+		Progress:   parseNumber(state["progress"]),
+		EtaSeconds: parseNumber(state["eta_seconds"]),
+		Eta:        state["eta"],
+		LastSeen:   s.lastSeen,
+		State:      state,
+	}
+}
+
+// LastSeen is when the plotter last printed something
+func (s *PlotterState) LastSeen() time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.lastSeen
 }
 
 var processors = map[string][]*regexp.Regexp{
@@ -28,47 +86,118 @@ var processors = map[string][]*regexp.Regexp{
 	"phase":      {regexp.MustCompile(`.*Starting phase (\d)/*.`)},
 	"table": {
 		regexp.MustCompile(`Computing table (\d+)`),
+		regexp.MustCompile(`Backpropagating on table (\d+)`),
 		regexp.MustCompile(`Compressing tables (\d+)`),
+		// phase 4 has no tables, C1/C3 is reported as table 1 and C2 as table 2
+		regexp.MustCompile(`Starting to write C(1) and C3 tables`),
+		regexp.MustCompile(`Writing C(2) table`),
 	},
-	"bucket":     {regexp.MustCompile(`.*Bucket (\d+)`)},
-	"temp_drive": {regexp.MustCompile(`Starting plotting progress into temporary dirs: (.*) and`)},
-	"plot_id":    {regexp.MustCompile(`ID: (\w+)`)},
+	"bucket":        {regexp.MustCompile(`.*Bucket (\d+)`)},
+	"temp_drive":    {regexp.MustCompile(`Starting plotting progress into temporary dirs: (.*) and`)},
+	"plot_id":       {regexp.MustCompile(`ID: (\w+)`)},
+	"cpu":           {regexp.MustCompile(`CPU \(([\d.]+)%\)`)},
+	"working_space": {regexp.MustCompile(`Approximate working space used \(without final file\): ([\d.]+) GiB`)},
+	"final_size":    {regexp.MustCompile(`Final File size: ([\d.]+) GiB`)},
+	"total_time":    {regexp.MustCompile(`Total time = ([\d.]+) seconds`)},
+	"final_file":    {regexp.MustCompile(`Renamed final file from ".*" to "(.*)"`)},
 }
 var debugPid = 336480
 
 var phaseTime = regexp.MustCompile(`Time for phase (\d) = (\d+)`)
 var copyTime = regexp.MustCompile(`Copy time = (\d+)`)
 
-var phaseTimings = promauto.NewGaugeVec(prometheus.GaugeOpts{
-	Name: "phase_timings",
-	Help: "The number of process currently plotting",
+// the only plotter we parse the output of so far
+const chiaposBackend = "chiapos"
+
+// plot metrics are labelled by tag, temp drive and backend, all bounded by
+// the config. Only the active plot gauges have a pid and they're removed
+// when the plot is done
+var plotLabels = []string{"tag", "drive", "backend"}
+
+var phaseDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "plot_phase_seconds",
+	Help:    "Time spent in each phase (and the copy) of finished phases",
+	Buckets: prometheus.ExponentialBuckets(300, 1.5, 14), // 5m to ~16h
+}, append(plotLabels, "phase"))
+
+var plotDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "plot_duration_seconds",
+	Help:    "Total time reported by the plotter for finished plots, excluding copy",
+	Buckets: prometheus.ExponentialBuckets(3600, 1.25, 16), // 1h to ~28h
+}, plotLabels)
+
+var plotsCompleted = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "plots_completed_total",
+	Help: "Plots whose final file was written",
+}, plotLabels)
+
+var plotsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "plots_failed_total",
+	Help: "Plots that stopped before finishing, by the phase they were in",
+}, append(plotLabels, "phase"))
+
+var activeLabels = []string{"tag", "pid"}
+
+var plotProgress = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "plot_progress_percent",
+	Help: "Estimated progress of an active plot",
+}, activeLabels)
+
+var plotPhase = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "plot_phase",
+	Help: "Phase an active plot is in, 5 is the copy",
+}, activeLabels)
+
+var plotTable = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "plot_table",
+	Help: "Table an active plot is working on",
+}, activeLabels)
+
+var tableTimings = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "plot_table_seconds",
+	Help: "Time spent on the last finished table for the tag",
 }, []string{
-	"pid",
-	"id",
-	"drive",
+	"tag",
 	"phase",
+	"table",
 })
 
-// value is the timestamp when finished
-var completionMarker = promauto.NewGaugeVec(prometheus.GaugeOpts{
-	Name: "completed_plots",
-	Help: "Number of plots completed by the given pid",
+var phaseCpu = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "plot_phase_cpu_percent",
+	Help: "CPU usage reported by the plotter for the last finished phase of the tag",
 }, []string{
-	"pid",
 	"tag",
-	"id",
+	"phase",
 })
 
-var plotterState = promauto.NewGaugeVec(prometheus.GaugeOpts{
-	Name: "plotter_state",
-	Help: "Full plotter state breakdown",
+var workingSpace = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "plot_working_space_gib",
+	Help: "Approximate temp space used by the last plot of the tag",
 }, []string{
-	"pid",
-	"phase",
-	"table",
 	"tag",
 })
 
+var totalTime = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "plot_total_seconds",
+	Help: "Total time reported by the plotter for the last plot of the tag, excluding copy",
+}, []string{
+	"tag",
+})
+
+var finalSize = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "plot_final_size_gib",
+	Help: "Final file size of the last plot of the tag",
+}, []string{
+	"tag",
+})
+
+var plotterEta = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "plotter_eta_seconds",
+	Help: "Estimated seconds until an active plot finishes, based on previous plots for the tag",
+}, activeLabels)
+
+var activeGauges = []*prometheus.GaugeVec{plotProgress, plotPhase, plotTable, plotterEta}
+
 func checkRegexes(s string, reg []*regexp.Regexp) ([]string, bool) {
 	for _, r := range reg {
 		if v, ok := checkRegex(s, r); ok {
@@ -92,116 +221,233 @@ func checkRegex(s string, r *regexp.Regexp) ([]string, bool) {
 
 var tagRegex = regexp.MustCompile(`(\w+)_\d+`)
 
-// Clears previous prom entries so that they stop sending
+// plotTag returns the plotter tag from the temp dir name ({tag}_{unix})
+func plotTag(ps *PlotterState) string {
+	return tempDirTag(ps.State["temp_drive"])
+}
+
+func tempDirTag(dir string) string {
+	if matches, valid := checkRegex(filepath.Base(dir), tagRegex); valid {
+		return matches[0]
+	}
+	return ""
+}
+
+// plotDrive is the temp path the plot was launched in, the parent of its
+// {tag}_{unix} temp dir
+func plotDrive(tempDir string) string {
+	if tempDir != "" {
+		return filepath.Dir(filepath.Clean(tempDir))
+	}
+	return ""
+}
+
+// phases a plot has finished so far, a copy for events
+func (s *PlotterState) finishedPhases() map[string]float64 {
+	if len(s.phaseTimes) == 0 {
+		return nil
+	}
+	phases := make(map[string]float64, len(s.phaseTimes))
+	for k, v := range s.phaseTimes {
+		phases[k] = v
+	}
+	return phases
+}
+
+// clearEntries removes the active plot gauges of ps, must be called with its
+// lock held
 func clearEntries(ps *PlotterState) {
-	pid := fmt.Sprintf("%d", ps.Pid)
-	pp := ps.State["temp_drive"]
-	//plot_id := ps.State["plot_id"]
-	//temp_drive := ps.State["temp_drive"]
-	tag := ""
-	tempDir := filepath.Base(pp)
-	if matches, valid := checkRegex(tempDir, tagRegex); valid {
-		tag = matches[0]
-	}
-
-	// clear previous metrics or they'll continue to send
-	for _, pp := range statesNames {
-		//phaseTimings.DeleteLabelValues(pid, plot_id, temp_drive, pp)
-		for _, tt := range tableNames {
-			// clear previous metrics or they'll continue to send
-			plotterState.DeleteLabelValues(pid, pp, tt, tag)
-		}
+	if ps.activeLabels == nil {
+		return
 	}
+	for _, g := range activeGauges {
+		g.Delete(ps.activeLabels)
+	}
+	ps.activeLabels = nil
 }
 
 func updateProgress(ps *PlotterState) {
-	pid := fmt.Sprintf("%d", ps.Pid)
 	p := ps.State["phase"]
 	t := ps.State["table"]
-	b := ps.State["bucket"]
-	bs := ps.State["bucketSize"]
-	pp := ps.State["temp_drive"]
+	tag := plotTag(ps)
 
-	tag := ""
-	tempDir := filepath.Base(pp)
-	if matches, valid := checkRegex(tempDir, tagRegex); valid {
-		tag = matches[0]
+	elapsed := time.Duration(0)
+	if !ps.stepStarted.IsZero() {
+		elapsed = clock().Sub(ps.stepStarted)
 	}
 
-	progress := float64(0)
-	switch p {
-	case "copy":
-		progress = 100
-	default:
-		pi, err := strconv.ParseFloat(p, 64)
-		if err != nil {
-			pi = 1
-		}
-		ti, err := strconv.ParseFloat(t, 64)
-		if err != nil {
-			ti = 1
-		}
-		bi, err := strconv.ParseFloat(b, 64)
-		if err != nil {
-			bi = 1
-		}
-		bsi, err := strconv.ParseFloat(bs, 64)
-		if err != nil {
-			bsi = 128
-		}
-
-		if progress < 0 || progress > 100 {
-			log.Printf("[%d] Error determining progress %+v", ps.Pid, ps.State)
-			return
-		}
-
-		// p4, t7, b 32/32
-		// bsi buckets = 1 table, 7 tables = 1 phase
-		progress = ((pi - 1) * 30) + ((ti / 7) * 30) + (bi/bsi)*4.28571428571
-		ps.State["progress"] = fmt.Sprintf("%f", progress)
+	progress, remaining := timingModel.Estimate(tag, p, t, elapsed)
+	if progress < 0 || progress > 100 {
+		processesLog.With("pid", ps.Pid).Errorf("Error determining progress %+v", ps.State)
+		return
 	}
 
+	ps.State["progress"] = fmt.Sprintf("%f", progress)
+	ps.State["eta_seconds"] = fmt.Sprintf("%.0f", remaining.Seconds())
+	ps.State["eta"] = clock().Add(remaining).Format(time.RFC3339)
+
 	if ps.Pid == debugPid {
-		log.Printf("[%d] %f", ps.Pid, progress)
+		processesLog.With("pid", ps.Pid).Debugf("%f, eta %s", progress, remaining)
 	}
 
-	for _, pp := range statesNames {
-		for _, tt := range tableNames {
-			// clear previous metrics or they'll continue to send
-			plotterState.DeleteLabelValues(pid, pp, tt, tag)
-		}
+	if ps.finished || ps.Pid <= 0 {
+		return
 	}
+	labels := prometheus.Labels{"tag": tag, "pid": strconv.Itoa(ps.Pid)}
+	if ps.activeLabels != nil && ps.activeLabels["tag"] != tag {
+		clearEntries(ps) // the tag is only known once the temp dir is logged
+	}
+	ps.activeLabels = labels
 
-	plotterState.WithLabelValues(pid, p, t, tag).Set(progress)
+	phase := parseNumber(p)
+	if p == "copy" {
+		phase = 5
+	}
+	plotProgress.With(labels).Set(progress)
+	plotPhase.With(labels).Set(phase)
+	plotTable.With(labels).Set(parseNumber(t))
+	plotterEta.With(labels).Set(remaining.Seconds())
 }
 
-var statesNames = []string{"1", "2", "3", "4", "copy", "final", "init"}
-var tableNames = []string{"0", "1", "2", "3", "4", "5", "6", "7"}
+// plot summary lines printed at the end of phase 3/4
+func recordSummary(ps *PlotterState, msg string) {
+	tag := plotTag(ps)
+	if val, valid := checkRegexes(msg, processors["working_space"]); valid {
+		workingSpace.WithLabelValues(tag).Set(parseNumber(val[0]))
+	}
+	if val, valid := checkRegexes(msg, processors["final_size"]); valid {
+		finalSize.WithLabelValues(tag).Set(parseNumber(val[0]))
+	}
+	if val, valid := checkRegexes(msg, processors["total_time"]); valid {
+		totalTime.WithLabelValues(tag).Set(parseNumber(val[0]))
+	}
+	if val, valid := checkRegexes(msg, processors["final_file"]); valid {
+		ps.finished = true
+		clearEntries(ps)
+		events.Publish(Event{
+			Type:     PlotCompleted,
+			Time:     ps.lastStamp,
+			Tag:      tag,
+			PlotID:   ps.State["plot_id"],
+			Pid:      ps.Pid,
+			Path:     ps.State["temp_drive"],
+			File:     filepath.Clean(val[0]),
+			Duration: time.Duration(parseNumber(ps.State["total_time"]) * float64(time.Second)),
+			Phases:   ps.phaseTimes,
+		})
+		ps.phaseTimes = nil
+	}
+}
 
+// phaseChanged records the duration of a finished phase, or the copy. It's
+// sent along with the next phase_changed or the plot_completed event
 func phaseChanged(ps *PlotterState, phase string, duration int) {
 	ps.State["phase"] = phase
+	if ps.phaseTimes == nil {
+		ps.phaseTimes = map[string]float64{}
+	}
+	ps.phaseTimes[phase] = float64(duration)
+	updateProgress(ps)
+}
+
+// plot metrics are only kept for a finished phase until the plot is done,
+// plots that never finish or fail are forgotten after this
+const plotMetricsRetention = 7 * 24 * time.Hour
+
+// recordPlotMetrics updates the plot counters and histograms from plot
+// events. Phase times are observed once per plot, from the first event
+// carrying them
+func recordPlotMetrics(ch <-chan Event) {
+	type plotPhases struct {
+		observed map[string]bool
+		updated  time.Time
+	}
+	plots := map[string]*plotPhases{} // by plot id
+
+	for e := range ch {
+		labels := prometheus.Labels{"tag": e.Tag, "drive": plotDrive(e.Path), "backend": chiaposBackend}
+		withPhase := func(phase string) prometheus.Labels {
+			l := prometheus.Labels{"phase": phase}
+			for k, v := range labels {
+				l[k] = v
+			}
+			return l
+		}
 
-	plot_id := ps.State["plot_id"]
-	temp_drive := ps.State["temp_drive"]
+		// without the temp dir the phases can't be labelled
+		if e.PlotID != "" && e.Path != "" && len(e.Phases) > 0 {
+			p, exists := plots[e.PlotID]
+			if !exists {
+				p = &plotPhases{observed: map[string]bool{}}
+				plots[e.PlotID] = p
+			}
+			p.updated = time.Now()
+			for phase, secs := range e.Phases {
+				if !p.observed[phase] {
+					p.observed[phase] = true
+					phaseDuration.With(withPhase(phase)).Observe(secs)
+				}
+			}
+		}
 
-	durSec := (time.Second * time.Duration(duration)).Seconds()
-	if plot_id == "" || temp_drive == "" || phase == "" {
-		log.Printf("Skipping phase timing update to to incomplete info: %+v", ps.Pid)
-	} else {
-		phaseTimings.WithLabelValues(fmt.Sprintf("%d", ps.Pid), plot_id, temp_drive, phase).Set(durSec)
+		switch e.Type {
+		case PlotCompleted:
+			plotsCompleted.With(labels).Inc()
+			if e.Duration > 0 {
+				plotDuration.With(labels).Observe(e.Duration.Seconds())
+			}
+			delete(plots, e.PlotID)
+		case PlotFailed:
+			plotsFailed.With(withPhase(e.Phase)).Inc()
+			delete(plots, e.PlotID)
+		}
+
+		for id, p := range plots {
+			if time.Since(p.updated) > plotMetricsRetention {
+				delete(plots, id)
+			}
+		}
 	}
+}
 
-	updateProgress(ps)
+// entryTime is when a log entry was written, exact when it came from a
+// timestamp or a live entry rather than the last timestamp seen
+func (s *PlotterState) entryTime(stamp time.Time, stamped bool, live bool) (time.Time, bool) {
+	switch {
+	case stamped:
+		return stamp, true
+	case !live && !s.lastStamp.IsZero():
+		return s.lastStamp, false
+	default:
+		return clock(), live
+	}
+}
+
+// observeStep records a table we timed ourselves
+func (s *PlotterState) observeStep(phase string, table string, secs float64, live bool) {
+	timingModel.Observe(plotTag(s), s.State["plot_id"], phase, table, secs)
+	if live {
+		tableTimings.WithLabelValues(plotTag(s), phase, table).Set(secs)
+	}
 }
 
 func (s *PlotterState) Update(entry *logEntry) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
+	s.lastSeen = time.Now()
+
+	stamp, stamped := parseCtime(entry.msg)
+	if stamped {
+		s.lastStamp = stamp
+	}
+
+	prevPhase, prevTable := s.State["phase"], s.State["table"]
+	matched := false
 
 	for k, r := range processors {
 		if val, valid := checkRegexes(entry.msg, r); valid {
 			if s.Pid == debugPid {
-				log.Printf("[%d] %s = %s, [%s]", s.Pid, k, val[0], entry.msg)
+				processesLog.With("pid", s.Pid).Debugf("%s = %s, [%s]", k, val[0], entry.msg)
 			}
 			switch k {
 			case "phase": // phase we reset table and bucket
@@ -214,28 +460,83 @@ func (s *PlotterState) Update(entry *logEntry) {
 			}
 
 			s.State[k] = val[0]
-			if entry.live {
-				updateProgress(s)
-			}
+			matched = true
+		}
+	}
+
+	if s.State["phase"] != prevPhase || s.State["table"] != prevTable {
+		prevStarted, prevExact := s.stepStarted, s.stepExact
+		s.stepStarted, s.stepExact = s.entryTime(stamp, stamped, entry.live)
+
+		// scratch states replaying old logs have no process to track
+		if s.State["phase"] == "1" && prevPhase != "1" && s.Pid > 0 {
+			events.Publish(Event{
+				Type:   PlotStarted,
+				Time:   s.stepStarted,
+				Tag:    plotTag(s),
+				PlotID: s.State["plot_id"],
+				Pid:    s.Pid,
+				Path:   s.State["temp_drive"],
+			})
+		} else if s.State["phase"] != prevPhase && entry.live {
+			events.Publish(Event{
+				Type:   PhaseChanged,
+				Time:   s.stepStarted,
+				Tag:    plotTag(s),
+				PlotID: s.State["plot_id"],
+				Pid:    s.Pid,
+				Phase:  s.State["phase"],
+				Path:   s.State["temp_drive"],
+				Phases: s.finishedPhases(),
+			})
+		}
+
+		// phase 2 & 4 don't report table times, so time them ourselves
+		if (prevPhase == "2" || prevPhase == "4") && prevTable != "0" && prevExact && s.stepExact {
+			s.observeStep(prevPhase, prevTable, s.stepStarted.Sub(prevStarted).Seconds(), entry.live)
+		}
+	}
+
+	if matched && entry.live {
+		updateProgress(s)
+	}
+
+	if val, valid := checkRegex(entry.msg, tableTime); valid {
+		secs := parseNumber(val[0])
+		timingModel.Observe(plotTag(s), s.State["plot_id"], s.State["phase"], s.State["table"], secs)
+		if entry.live {
+			tableTimings.WithLabelValues(plotTag(s), s.State["phase"], s.State["table"]).Set(secs)
 		}
 	}
 
 	if val, valid := checkRegex(entry.msg, phaseTime); valid {
+		// the last table of phase 2 & 4 ends with the phase, phase 4 isn't
+		// followed by another one
+		if (val[0] == "2" || val[0] == "4") && s.State["phase"] == val[0] && s.State["table"] != "0" && s.stepExact {
+			if ended, exact := s.entryTime(stamp, stamped, entry.live); exact {
+				s.observeStep(val[0], s.State["table"], ended.Sub(s.stepStarted).Seconds(), entry.live)
+				s.stepExact = false // timed, the next phase change mustn't time it again
+			}
+		}
+
 		dur, _ := strconv.Atoi(val[1])
+		timingModel.Observe(plotTag(s), s.State["plot_id"], val[0], "", float64(dur))
 		if entry.live {
 			phaseChanged(s, val[0], dur)
+			// the cpu processor already picked up this line's value
+			phaseCpu.WithLabelValues(plotTag(s), val[0]).Set(parseNumber(s.State["cpu"]))
 		}
 	}
 
+	if entry.live {
+		recordSummary(s, entry.msg)
+	}
+
 	if val, valid := checkRegex(entry.msg, copyTime); valid {
 		dur, _ := strconv.Atoi(val[0])
+		timingModel.Observe(plotTag(s), s.State["plot_id"], "copy", "", float64(dur))
 		if entry.live {
 			phaseChanged(s, "copy", dur)
-			pid := fmt.Sprintf("%d", s.Pid)
-			id := s.State["plot_id"]
-			tag := s.State["tag"]
-			// copy is the final phase change we'll get here, so mark completed
-			completionMarker.WithLabelValues(pid, tag, id).Set(1)
 		}
 	}
 
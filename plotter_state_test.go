@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func histogramCount(t *testing.T, o prometheus.Observer) uint64 {
+	t.Helper()
+	m := &dto.Metric{}
+	if err := o.(prometheus.Metric).Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestRecordPlotMetrics(t *testing.T) {
+	temp := "/mnt/ssd0/metricstest_1622000000"
+	ch := make(chan Event, 10)
+	for _, e := range []Event{
+		{Type: PhaseChanged, PlotID: "a", Phase: "2", Phases: map[string]float64{"1": 100}},
+		{Type: PhaseChanged, PlotID: "a", Phase: "3", Phases: map[string]float64{"1": 100, "2": 50}},
+		{Type: PhaseChanged, PlotID: "a", Phase: "4", Phases: map[string]float64{"1": 100, "2": 50, "3": 80}},
+		{Type: PlotCompleted, PlotID: "a", Duration: 250 * time.Second, Phases: map[string]float64{"1": 100, "2": 50, "3": 80, "4": 20, "copy": 30}},
+		{Type: PhaseChanged, PlotID: "b", Phase: "2", Phases: map[string]float64{"1": 90}},
+		{Type: PlotFailed, PlotID: "b", Phase: "2", Phases: map[string]float64{"1": 90}},
+	} {
+		e.Tag, e.Path = "metricstest", temp
+		ch <- e
+	}
+	close(ch)
+	recordPlotMetrics(ch)
+
+	labels := prometheus.Labels{"tag": "metricstest", "drive": "/mnt/ssd0", "backend": chiaposBackend}
+	phase := func(p string) prometheus.Labels {
+		l := prometheus.Labels{"phase": p}
+		for k, v := range labels {
+			l[k] = v
+		}
+		return l
+	}
+	for p, want := range map[string]uint64{"1": 2, "2": 1, "3": 1, "4": 1, "copy": 1} {
+		if got := histogramCount(t, phaseDuration.With(phase(p))); got != want {
+			t.Errorf("phase %s observed %d times, want %d", p, got, want)
+		}
+	}
+	if got := histogramCount(t, plotDuration.With(labels)); got != 1 {
+		t.Errorf("plot_duration_seconds observed %d times, want 1", got)
+	}
+	if got := testutil.ToFloat64(plotsCompleted.With(labels)); got != 1 {
+		t.Errorf("plots_completed_total = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(plotsFailed.With(phase("2"))); got != 1 {
+		t.Errorf("plots_failed_total = %v, want 1", got)
+	}
+}
+
+func TestStepTimings(t *testing.T) {
+	b, err := os.ReadFile("testdata/chiapos.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, savedClock := timingModel, clock
+	t.Cleanup(func() { timingModel, clock = saved, savedClock })
+	timingModel = NewTimingModel()
+
+	// phase 2 & 4 tables aren't stamped, a live plot times them as read
+	var now time.Time
+	clock = func() time.Time { return now }
+	ps := &PlotterState{State: map[string]string{"phase": "init", "table": "0"}}
+	for _, line := range strings.Split(string(b), "\n") {
+		if stamp, ok := parseCtime(line); ok {
+			now = stamp
+		} else {
+			now = now.Add(time.Second)
+		}
+		ps.Update(&logEntry{msg: line, live: true})
+	}
+
+	timings := timingModel.tags["ssd0"]
+	for _, key := range []string{"2/7", "2/6", "2/5", "2/4", "2/3", "2/2", "4/1", "4/2"} {
+		if timings[key] == nil {
+			t.Errorf("step %s wasn't timed", key)
+		}
+	}
+}
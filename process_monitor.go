@@ -2,20 +2,26 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
+var processesLog = newLogger("processes")
+
 type ProcessMonitor struct {
 	stateLock     *sync.Mutex
 	plotterStates PlotterStates
+	entries       chan logEntry
 }
 
 type PlotterStates map[int]*PlotterState
@@ -26,20 +32,32 @@ type logEntry struct {
 	live bool
 }
 
-var procChannel = make(chan logEntry)
-
-func StartProcessMonitor() *ProcessMonitor {
-	monitor := &ProcessMonitor{
+func NewProcessMonitor() *ProcessMonitor {
+	return &ProcessMonitor{
 		stateLock:     &sync.Mutex{},
 		plotterStates: PlotterStates{},
+		entries:       make(chan logEntry),
 	}
+}
 
-	go monitor.startProcessMonitor()
+// Snapshot returns a copy of every monitored plotter state, ordered by pid
+func (p *ProcessMonitor) Snapshot() []PlotterInfo {
+	p.stateLock.Lock()
+	states := make([]*PlotterState, 0, len(p.plotterStates))
+	for _, s := range p.plotterStates {
+		states = append(states, s)
+	}
+	p.stateLock.Unlock()
 
-	return monitor
+	infos := make([]PlotterInfo, 0, len(states))
+	for _, s := range states {
+		infos = append(infos, s.Info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Pid < infos[j].Pid })
+	return infos
 }
 
-func (p *ProcessMonitor) monitorProcess(pid int) {
+func (p *ProcessMonitor) monitorProcess(ctx context.Context, pid int) {
 	p.stateLock.Lock()
 	if _, found := p.plotterStates[pid]; !found {
 		// process entry doesn't exist already, create it and start monitoring
@@ -55,45 +73,49 @@ func (p *ProcessMonitor) monitorProcess(pid int) {
 
 		proc, err := os.FindProcess(pid)
 		if err != nil {
-			log.Println(err)
+			processesLog.Errorf("%v", err)
 			return
 		}
 
 		go func(pid int) {
 			path := fmt.Sprintf("/proc/%d/fd/1", proc.Pid)
-			log.Printf("[Monitor] Opening '%s' to for monitoring", path)
+			processesLog.Infof("Opening '%s' for monitoring", path)
 			fd, err := os.Open(fmt.Sprintf("/proc/%d/fd/1", proc.Pid))
 			if err != nil {
-				log.Println(err)
+				processesLog.Errorf("%v", err)
 				return
 			}
+			defer func() { fd.Close() }()
 
 			retries := 0
 			r := bufio.NewReader(fd)
 			live := false
-			for {
+			for ctx.Err() == nil {
 				for {
 					s, err := r.ReadString('\n')
 					if len(s) == 0 && err == io.EOF {
 						break
 					}
 					if err != nil {
-						log.Printf("Monitor] Error reading from '%d': %+v", pid, err)
+						processesLog.Warnf("Error reading from '%d': %+v", pid, err)
 						if retries > 5 {
-							log.Printf("[Monitor] Failed to read from pid %d, %+v", pid, err)
+							processesLog.Errorf("Failed to read from pid %d, %+v", pid, err)
 							p.stateLock.Lock()
-							delete(p.plotterStates, pid)
+							p.stopMonitoring(pid, "plotter output could not be read")
 							p.stateLock.Unlock()
 							return
 						}
 						// try again in a bit
-						time.Sleep(5 * time.Second)
+						sleepContext(ctx, 5*time.Second)
+						if ctx.Err() != nil {
+							return
+						}
 
 						// retry opening & reset the buffer
 						fd.Close()
 						fd, err = os.Open(path)
 						if err != nil {
-							log.Println(err)
+							processesLog.Errorf("%v", err)
 						}
 						r = bufio.NewReader(fd)
 
@@ -101,10 +123,14 @@ func (p *ProcessMonitor) monitorProcess(pid int) {
 						continue
 					}
 
-					procChannel <- logEntry{msg: s, pid: pid, live: live}
+					select {
+					case p.entries <- logEntry{msg: s, pid: pid, live: live}:
+					case <-ctx.Done():
+						return
+					}
 				}
 				live = true // we're at the latest data, start sending events
-				time.Sleep(5 * time.Second)
+				sleepContext(ctx, 5*time.Second)
 			}
 		}(pid)
 	} else {
@@ -112,10 +138,17 @@ func (p *ProcessMonitor) monitorProcess(pid int) {
 	}
 }
 
-func (p *ProcessMonitor) startProcessMonitor() {
+// Run follows the output of every plotter process until ctx is done. The
+// plotters themselves are left alone
+func (p *ProcessMonitor) Run(ctx context.Context) {
 	go func() { // monitors plotter states
 		for {
-			s := <-procChannel
+			var s logEntry
+			select {
+			case s = <-p.entries:
+			case <-ctx.Done():
+				return
+			}
 
 			p.stateLock.Lock()
 			ps, found := p.plotterStates[s.pid]
@@ -124,37 +157,115 @@ func (p *ProcessMonitor) startProcessMonitor() {
 				continue
 			}
 
-			ps.lastSeen = time.Now()
 			ps.Update(&s)
 		}
 	}()
 
-	for {
-		o, err := exec.Command("/usr/bin/pgrep", "-f", "chia plots create").Output()
+	for ctx.Err() == nil {
+		alive, err := plotterPids()
 		if err != nil {
-			if err.Error() != "exit status 1" { // this means no processes
-				log.Printf("[Monitor] Error fetching processes: %v", err)
-			}
-			goto wait
+			processesLog.Errorf("Error fetching processes: %v", err)
 		}
 
-		for _, s := range strings.Split(string(o), "\n") {
-			pid, _ := strconv.Atoi(s)
-			if pid > 0 {
-				p.monitorProcess(pid)
-			}
+		for pid := range alive {
+			p.monitorProcess(ctx, pid)
 		}
 
 		p.stateLock.Lock()
 		for v, s := range p.plotterStates {
-			if time.Since(s.lastSeen) > time.Duration(30*time.Minute) {
-				log.Printf("[Monitor] Stopping monitor on pid %d due to inactivity", v)
-				clearEntries(s)
-				delete(p.plotterStates, v)
+			idle := time.Since(s.LastSeen())
+			// give the reader a moment to catch the last lines of exited processes
+			if err == nil && !alive[v] && idle > time.Minute {
+				processesLog.Infof("Stopping monitor on pid %d, process exited", v)
+				p.stopMonitoring(v, "plotter process exited")
+			} else if idle > time.Duration(30*time.Minute) {
+				processesLog.Warnf("Stopping monitor on pid %d due to inactivity", v)
+				p.stopMonitoring(v, "no plotter output for 30 minutes")
 			}
 		}
 		p.stateLock.Unlock()
-	wait:
-		time.Sleep(30 * time.Second)
+
+		sleepContext(ctx, 30*time.Second)
+	}
+}
+
+func plotterPids() (map[int]bool, error) {
+	pids := map[int]bool{}
+	o, err := exec.Command("/usr/bin/pgrep", "-f", "chia plots create").Output()
+	if err != nil {
+		if err.Error() == "exit status 1" { // this means no processes
+			return pids, nil
+		}
+		return nil, err
+	}
+
+	for _, s := range strings.Split(string(o), "\n") {
+		pid, _ := strconv.Atoi(s)
+		if pid > 0 {
+			pids[pid] = true
+		}
+	}
+	return pids, nil
+}
+
+// stopMonitoring drops the state for pid, plots that didn't finish are
+// reported as failed. Must be called with stateLock held
+func (p *ProcessMonitor) stopMonitoring(pid int, reason string) {
+	s, found := p.plotterStates[pid]
+	if !found {
+		return
+	}
+	delete(p.plotterStates, pid)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	clearEntries(s)
+	if s.State["phase"] != "copy" && s.State["final_file"] == "" {
+		events.Publish(Event{
+			Type:   PlotFailed,
+			Tag:    plotTag(s),
+			PlotID: s.State["plot_id"],
+			Pid:    pid,
+			Phase:  s.State["phase"],
+			Path:   s.State["temp_drive"],
+			Phases: s.finishedPhases(),
+			Error:  reason,
+		})
+	}
+}
+
+// CancelPlot kills the plotter with pid and removes its temp files once it
+// has exited. Only plotters we're monitoring can be cancelled
+func (p *ProcessMonitor) CancelPlot(pid int) error {
+	p.stateLock.Lock()
+	ps, found := p.plotterStates[pid]
+	p.stateLock.Unlock()
+	if !found {
+		return fmt.Errorf("%w: pid %d is not a monitored plotter", errNotFound, pid)
 	}
+
+	ps.lock.Lock()
+	plotID, tempDir := ps.State["plot_id"], ps.State["temp_drive"]
+	ps.lock.Unlock()
+
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		return err
+	}
+
+	go func() {
+		for i := 0; i < 60 && syscall.Kill(pid, 0) == nil; i++ {
+			time.Sleep(time.Second)
+		}
+		if plotID == "" || tempDir == "" {
+			return
+		}
+		files, _ := filepath.Glob(filepath.Join(tempDir, "*"+plotID+"*.tmp"))
+		for _, f := range files {
+			if err := os.Remove(f); err != nil {
+				processesLog.Errorf("Error removing temp file '%s': %v", f, err)
+			}
+		}
+		processesLog.Infof("Removed %d temp files of cancelled plot %s", len(files), plotID)
+	}()
+	return nil
 }
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var pushLog = newLogger("push")
+
+const pushTimeout = 10 * time.Second
+
+// failed pushes are retried with backoff, doubling up to this
+const maxPushBackoff = 5 * time.Minute
+
+var (
+	pushFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "push_failures_total",
+		Help: "Pushes that failed, by target",
+	}, []string{
+		"target",
+	})
+
+	pushDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "push_dropped_total",
+		Help: "Pushes dropped because the buffer was full or the endpoint rejected them, by target",
+	}, []string{
+		"target",
+	})
+
+	pushBuffered = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "push_buffered",
+		Help: "Pushes waiting to be sent, by target",
+	}, []string{
+		"target",
+	})
+)
+
+// pushLabels identify this host on every pushed series: job, instance (the
+// hostname) and Push.Labels
+func pushLabels(cfg PushConfig) map[string]string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	labels := map[string]string{"job": cfg.Job, "instance": host}
+	for k, v := range cfg.Labels {
+		labels[k] = v
+	}
+	return labels
+}
+
+// authDoer adds the configured credentials to every request
+type authDoer struct {
+	client *http.Client
+	cfg    PushConfig
+}
+
+func (d authDoer) Do(req *http.Request) (*http.Response, error) {
+	if d.cfg.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+d.cfg.BearerToken)
+	} else if d.cfg.Username != "" {
+		req.SetBasicAuth(d.cfg.Username, d.cfg.Password)
+	}
+	req.Header.Set("User-Agent", "chia-monitor/"+version)
+	return d.client.Do(req)
+}
+
+// startPush gathers the registry every Push.Interval and sends it to the
+// configured endpoints until ctx is done. remote_write pushes are buffered
+// while the endpoint is down, the Pushgateway, influx and graphite only ever
+// get the latest values
+func startPush(ctx context.Context, cfg PushConfig) {
+	doer := authDoer{client: &http.Client{Timeout: pushTimeout}, cfg: cfg}
+	labels := pushLabels(cfg)
+
+	var writer *remoteWriter
+	if cfg.RemoteWrite != "" {
+		writer = &remoteWriter{pushRetry: pushRetry{target: "remote_write"}, url: cfg.RemoteWrite, doer: doer, max: cfg.Buffer}
+		pushLog.Infof("Sending metrics to %s every %v", cfg.RemoteWrite, cfg.Interval)
+	}
+	var gateway *pushRetry
+	if cfg.Pushgateway != "" {
+		p := push.New(cfg.Pushgateway, cfg.Job).Gatherer(prometheus.DefaultGatherer).Client(doer)
+		// sorted, the grouping key is part of the url
+		for _, l := range sortedLabels(labels) {
+			if l.name != "job" {
+				p = p.Grouping(l.name, l.value)
+			}
+		}
+		gateway = &pushRetry{target: "pushgateway", push: p.Push}
+		pushLog.Infof("Pushing metrics to %s every %v", cfg.Pushgateway, cfg.Interval)
+	}
+
+	// influx and graphite get a host tag instead of job and instance
+	exporters := newExporters(cfg)
+	exporterRetries := map[string]*pushRetry{}
+	exportLabels := map[string]string{"host": labels["instance"]}
+	for k, v := range cfg.Labels {
+		exportLabels[k] = v
+	}
+	for target := range exporters {
+		exporterRetries[target] = &pushRetry{target: target}
+		pushLog.Infof("Exporting metrics to %s every %v", target, cfg.Interval)
+	}
+
+	for {
+		if writer != nil {
+			series, err := gatherSeries(prometheus.DefaultGatherer, labels)
+			if err != nil {
+				pushLog.Warnf("Error gathering metrics: %v", err)
+			}
+			writer.add(series, time.Now())
+			writer.send()
+		}
+		if gateway != nil {
+			gateway.try()
+		}
+		if len(exporters) > 0 {
+			at := time.Now()
+			samples, err := gatherSeries(prometheus.DefaultGatherer, exportLabels)
+			if err != nil {
+				pushLog.Warnf("Error gathering metrics: %v", err)
+			}
+			for target, e := range exporters {
+				e := e
+				exporterRetries[target].tryWith(func() error { return e.export(samples, at) })
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			// one last try so the final values aren't lost
+			if writer != nil {
+				writer.next = time.Time{}
+				writer.send()
+			}
+			pushLog.Infof("Stopped")
+			return
+		case <-time.After(cfg.Interval):
+		}
+	}
+}
+
+// retryBackoff spaces out tries after failures so a down endpoint isn't
+// hammered, the wait doubles from 10s up to maxPushBackoff
+type retryBackoff struct {
+	next    time.Time // no try before this
+	backoff time.Duration
+	failing bool
+}
+
+// failed sets the next try, first tells if the last try had worked. Only
+// that failure is worth a warning, the rest would flood the log
+func (b *retryBackoff) failed() (wait time.Duration, first bool) {
+	if b.backoff == 0 {
+		b.backoff = 10 * time.Second
+	} else if b.backoff *= 2; b.backoff > maxPushBackoff {
+		b.backoff = maxPushBackoff
+	}
+	first, b.failing = !b.failing, true
+	b.next = time.Now().Add(b.backoff)
+	return b.backoff, first
+}
+
+// succeeded resets the backoff, recovered tells if the last try had failed
+func (b *retryBackoff) succeeded() (recovered bool) {
+	recovered = b.failing
+	b.failing, b.backoff, b.next = false, 0, time.Time{}
+	return recovered
+}
+
+// pushRetry backs off after failed pushes
+type pushRetry struct {
+	retryBackoff
+	target string
+	push   func() error
+}
+
+func (r *pushRetry) try() {
+	r.tryWith(r.push)
+}
+
+// tryWith sends with push unless the last failure is still backing off
+func (r *pushRetry) tryWith(push func() error) {
+	if time.Now().Before(r.next) {
+		return
+	}
+	if err := push(); err != nil {
+		r.failed(err)
+		return
+	}
+	r.succeeded()
+}
+
+func (r *pushRetry) failed(err error) {
+	pushFailures.WithLabelValues(r.target).Inc()
+	if wait, first := r.retryBackoff.failed(); first {
+		pushLog.Warnf("Error pushing to %s, retrying with backoff: %v", r.target, err)
+	} else {
+		pushLog.Debugf("Error pushing to %s, retrying in %v: %v", r.target, wait, err)
+	}
+}
+
+func (r *pushRetry) succeeded() {
+	if r.retryBackoff.succeeded() {
+		pushLog.Infof("Pushing to %s again", r.target)
+	}
+}
+
+// pushSample is one value of a series at the time it was gathered
+type pushSample struct {
+	labels []labelPair // sorted by name, __name__ included
+	value  float64
+}
+
+type labelPair struct {
+	name, value string
+}
+
+type pushBatch struct {
+	at     time.Time
+	series []pushSample
+}
+
+// remoteWriter sends gathered batches with the prometheus remote_write
+// protocol, oldest first, keeping up to max batches while the endpoint is down
+type remoteWriter struct {
+	pushRetry
+	url     string
+	doer    authDoer
+	max     int
+	pending []pushBatch
+}
+
+func (w *remoteWriter) add(series []pushSample, at time.Time) {
+	w.pending = append(w.pending, pushBatch{at: at, series: series})
+	if over := len(w.pending) - w.max; over > 0 {
+		pushDropped.WithLabelValues("remote_write").Add(float64(over))
+		w.pending = w.pending[over:]
+	}
+	pushBuffered.WithLabelValues("remote_write").Set(float64(len(w.pending)))
+}
+
+func (w *remoteWriter) send() {
+	defer func() { pushBuffered.WithLabelValues("remote_write").Set(float64(len(w.pending))) }()
+	if time.Now().Before(w.next) {
+		return
+	}
+
+	for len(w.pending) > 0 {
+		retry, err := w.write(w.pending[0])
+		if err != nil && retry {
+			w.failed(err)
+			return
+		}
+		if err != nil {
+			// the endpoint won't ever take it, ie a bad label
+			pushLog.Errorf("Dropping push to %s: %v", w.url, err)
+			pushDropped.WithLabelValues("remote_write").Inc()
+		}
+		w.pending = w.pending[1:]
+	}
+	w.succeeded()
+}
+
+// write sends one batch, retry is false when the endpoint rejected it with
+// a 4xx other than 429
+func (w *remoteWriter) write(b pushBatch) (retry bool, err error) {
+	body := snappyEncode(encodeWriteRequest(b))
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := w.doer.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	err = fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	return resp.StatusCode/100 != 4 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// gatherSeries flattens the registry into one sample per series, the way
+// prometheus stores them: histograms and summaries become _bucket/quantile,
+// _sum and _count series. extra labels replace ones with the same name
+func gatherSeries(g prometheus.Gatherer, extra map[string]string) ([]pushSample, error) {
+	families, err := g.Gather() // partial results come with the error
+	var samples []pushSample
+	for _, mf := range families {
+		name := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			add := func(suffix string, value float64, kv ...string) {
+				labels := map[string]string{"__name__": name + suffix}
+				for _, l := range m.GetLabel() {
+					labels[l.GetName()] = l.GetValue()
+				}
+				for i := 0; i+1 < len(kv); i += 2 {
+					labels[kv[i]] = kv[i+1]
+				}
+				for k, v := range extra {
+					labels[k] = v
+				}
+				samples = append(samples, pushSample{labels: sortedLabels(labels), value: value})
+			}
+
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add("", m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add("", m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add("", m.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					add("", q.GetValue(), "quantile", formatFloat(q.GetQuantile()))
+				}
+				add("_sum", s.GetSampleSum())
+				add("_count", float64(s.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, b := range h.GetBucket() {
+					add("_bucket", float64(b.GetCumulativeCount()), "le", formatFloat(b.GetUpperBound()))
+				}
+				add("_bucket", float64(h.GetSampleCount()), "le", "+Inf")
+				add("_sum", h.GetSampleSum())
+				add("_count", float64(h.GetSampleCount()))
+			}
+		}
+	}
+	return samples, err
+}
+
+func sortedLabels(labels map[string]string) []labelPair {
+	pairs := make([]labelPair, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, labelPair{k, v})
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].name < pairs[j].name })
+	return pairs
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// encodeWriteRequest builds the remote_write protobuf:
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label        { string name = 1; string value = 2; }
+//	Sample       { double value = 1; int64 timestamp = 2; } // ms
+func encodeWriteRequest(b pushBatch) []byte {
+	ts := b.at.UnixNano() / int64(time.Millisecond)
+	var req, series, field []byte
+	for _, s := range b.series {
+		series = series[:0]
+		for _, l := range s.labels {
+			field = field[:0]
+			field = protowire.AppendTag(field, 1, protowire.BytesType)
+			field = protowire.AppendString(field, l.name)
+			field = protowire.AppendTag(field, 2, protowire.BytesType)
+			field = protowire.AppendString(field, l.value)
+			series = protowire.AppendTag(series, 1, protowire.BytesType)
+			series = protowire.AppendBytes(series, field)
+		}
+		field = field[:0]
+		field = protowire.AppendTag(field, 1, protowire.Fixed64Type)
+		field = protowire.AppendFixed64(field, math.Float64bits(s.value))
+		field = protowire.AppendTag(field, 2, protowire.VarintType)
+		field = protowire.AppendVarint(field, uint64(ts))
+		series = protowire.AppendTag(series, 2, protowire.BytesType)
+		series = protowire.AppendBytes(series, field)
+
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, series)
+	}
+	return req
+}
+
+// snappyEncode frames src as a snappy block made only of literals. That
+// doesn't compress anything, but it's valid snappy that every remote_write
+// receiver decodes, without pulling in a compression library
+func snappyEncode(src []byte) []byte {
+	dst := protowire.AppendVarint(make([]byte, 0, len(src)+len(src)/65536*3+16), uint64(len(src)))
+	for len(src) > 0 {
+		n := len(src)
+		if n > 65536 {
+			n = 65536
+		}
+		switch l := n - 1; {
+		case l < 60:
+			dst = append(dst, byte(l)<<2)
+		case l < 1<<8:
+			dst = append(dst, 60<<2, byte(l))
+		default:
+			dst = append(dst, 61<<2, byte(l), byte(l>>8))
+		}
+		dst = append(dst, src[:n]...)
+		src = src[n:]
+	}
+	return dst
+}
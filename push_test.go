@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// snappyDecode is a full snappy block decoder, literals and copies, so the
+// test doesn't depend on how snappyEncode frames things
+func snappyDecode(t *testing.T, src []byte) []byte {
+	t.Helper()
+	size, n := protowire.ConsumeVarint(src)
+	if n < 0 {
+		t.Fatalf("bad snappy length")
+	}
+	src = src[n:]
+	var dst []byte
+	for len(src) > 0 {
+		tag := src[0]
+		src = src[1:]
+		var length, offset int
+		switch tag & 3 {
+		case 0:
+			length = int(tag >> 2)
+			if length >= 60 {
+				extra := length - 59
+				length = 0
+				for i := 0; i < extra; i++ {
+					length |= int(src[i]) << (8 * i)
+				}
+				src = src[extra:]
+			}
+			length++
+			if length > len(src) {
+				t.Fatalf("literal of %d bytes, %d left", length, len(src))
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+		case 1:
+			length = 4 + int(tag>>2&7)
+			offset = int(tag>>5)<<8 | int(src[0])
+			src = src[1:]
+		case 2:
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src))
+			src = src[2:]
+		case 3:
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src))
+			src = src[4:]
+		}
+		if offset == 0 || offset > len(dst) {
+			t.Fatalf("copy offset %d with %d bytes decoded", offset, len(dst))
+		}
+		for i := 0; i < length; i++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+	if uint64(len(dst)) != size {
+		t.Fatalf("decoded %d bytes, header says %d", len(dst), size)
+	}
+	return dst
+}
+
+type writtenSample struct {
+	labels map[string]string
+	value  float64
+	ts     int64
+}
+
+// protoFields calls f for every field of the message in b, with the payload
+// of length delimited fields or the value of fixed64 and varint ones
+func protoFields(t *testing.T, b []byte, f func(num protowire.Number, data []byte, v uint64)) {
+	t.Helper()
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatalf("bad tag: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		var data []byte
+		var v uint64
+		switch typ {
+		case protowire.BytesType:
+			data, n = protowire.ConsumeBytes(b)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(b)
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		default:
+			t.Fatalf("unexpected wire type %d", typ)
+		}
+		if n < 0 {
+			t.Fatalf("bad field %d: %v", num, protowire.ParseError(n))
+		}
+		b = b[n:]
+		f(num, data, v)
+	}
+}
+
+// decodeWriteRequest reads the remote_write WriteRequest documented on
+// encodeWriteRequest
+func decodeWriteRequest(t *testing.T, b []byte) []writtenSample {
+	t.Helper()
+	var samples []writtenSample
+	protoFields(t, b, func(num protowire.Number, series []byte, _ uint64) {
+		if num != 1 {
+			t.Fatalf("WriteRequest field %d", num)
+		}
+		s := writtenSample{labels: map[string]string{}}
+		protoFields(t, series, func(num protowire.Number, msg []byte, _ uint64) {
+			switch num {
+			case 1:
+				var name, value string
+				protoFields(t, msg, func(num protowire.Number, data []byte, _ uint64) {
+					if num == 1 {
+						name = string(data)
+					} else {
+						value = string(data)
+					}
+				})
+				s.labels[name] = value
+			case 2:
+				protoFields(t, msg, func(num protowire.Number, _ []byte, v uint64) {
+					if num == 1 {
+						s.value = math.Float64frombits(v)
+					} else {
+						s.ts = int64(v)
+					}
+				})
+			}
+		})
+		samples = append(samples, s)
+	})
+	return samples
+}
+
+func TestSnappyEncode(t *testing.T) {
+	if got, want := snappyEncode([]byte("abc")), []byte{3, 2 << 2, 'a', 'b', 'c'}; !bytes.Equal(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+	for _, n := range []int{0, 1, 60, 61, 256, 257, 65536, 65537, 200000} {
+		src := make([]byte, n)
+		for i := range src {
+			src[i] = byte(i * 7)
+		}
+		if got := snappyDecode(t, snappyEncode(src)); !bytes.Equal(got, src) {
+			t.Errorf("%d bytes didn't round trip", n)
+		}
+	}
+}
+
+func TestEncodeWriteRequest(t *testing.T) {
+	at := time.Unix(1600000000, 123*int64(time.Millisecond))
+	b := pushBatch{at: at, series: []pushSample{
+		{labels: []labelPair{{"__name__", "up"}, {"job", "chia"}}, value: 1},
+		{labels: []labelPair{{"__name__", "plot_seconds"}, {"tag", "ssd0"}}, value: 3.5},
+	}}
+
+	got := decodeWriteRequest(t, encodeWriteRequest(b))
+	want := []writtenSample{
+		{labels: map[string]string{"__name__": "up", "job": "chia"}, value: 1, ts: 1600000000123},
+		{labels: map[string]string{"__name__": "plot_seconds", "tag": "ssd0"}, value: 3.5, ts: 1600000000123},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestGatherSeries(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "c_total", Help: "c"}, []string{"tag"})
+	counter.WithLabelValues("ssd0").Add(2)
+	hist := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "h_seconds", Help: "h", Buckets: []float64{1, 10}})
+	hist.Observe(5)
+	summary := prometheus.NewSummary(prometheus.SummaryOpts{Name: "s", Help: "s", Objectives: map[float64]float64{0.5: 0.05}})
+	summary.Observe(3)
+	reg.MustRegister(counter, hist, summary)
+
+	samples, err := gatherSeries(reg, map[string]string{"instance": "farm1", "tag": "replaced"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]float64{}
+	for _, s := range samples {
+		key := ""
+		for _, l := range s.labels {
+			key += l.name + "=" + l.value + ","
+		}
+		got[key] = s.value
+	}
+	want := map[string]float64{
+		"__name__=c_total,instance=farm1,tag=replaced,":                  2,
+		"__name__=h_seconds_bucket,instance=farm1,le=1,tag=replaced,":    0,
+		"__name__=h_seconds_bucket,instance=farm1,le=10,tag=replaced,":   1,
+		"__name__=h_seconds_bucket,instance=farm1,le=+Inf,tag=replaced,": 1,
+		"__name__=h_seconds_sum,instance=farm1,tag=replaced,":            5,
+		"__name__=h_seconds_count,instance=farm1,tag=replaced,":          1,
+		"__name__=s,instance=farm1,quantile=0.5,tag=replaced,":           3,
+		"__name__=s_sum,instance=farm1,tag=replaced,":                    3,
+		"__name__=s_count,instance=farm1,tag=replaced,":                  1,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+// remoteWriteServer answers with the given statuses in turn, then 200
+type remoteWriteServer struct {
+	*httptest.Server
+	lock     sync.Mutex
+	statuses []int
+	received [][]writtenSample // every request, including the failed ones
+}
+
+func newRemoteWriteServer(t *testing.T, statuses ...int) *remoteWriteServer {
+	s := &remoteWriteServer{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("headers %v", r.Header)
+		}
+		if r.Header.Get("Authorization") != "Bearer t0ken" {
+			t.Errorf("Authorization is '%s'", r.Header.Get("Authorization"))
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.received = append(s.received, decodeWriteRequest(t, snappyDecode(t, body)))
+		status := http.StatusOK
+		if len(s.statuses) > 0 {
+			status, s.statuses = s.statuses[0], s.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// timestamps of the batches the server got, in order
+func (s *remoteWriteServer) batches() []int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var ts []int64
+	for _, r := range s.received {
+		ts = append(ts, r[0].ts)
+	}
+	return ts
+}
+
+func newTestRemoteWriter(url string) *remoteWriter {
+	doer := authDoer{client: &http.Client{Timeout: pushTimeout}, cfg: PushConfig{BearerToken: "t0ken"}}
+	return &remoteWriter{pushRetry: pushRetry{target: "remote_write"}, url: url, doer: doer, max: 3}
+}
+
+func testBatch(sec int64) []pushSample {
+	return []pushSample{{labels: []labelPair{{"__name__", "up"}}, value: float64(sec)}}
+}
+
+func TestRemoteWriterRetries(t *testing.T) {
+	s := newRemoteWriteServer(t, http.StatusInternalServerError, http.StatusTooManyRequests)
+	w := newTestRemoteWriter(s.URL)
+
+	w.add(testBatch(1), time.Unix(1, 0))
+	w.send()
+	if len(w.pending) != 1 || !w.failing || w.backoff != 10*time.Second {
+		t.Fatalf("after a 500: %d pending, failing %v, backoff %v", len(w.pending), w.failing, w.backoff)
+	}
+
+	// still backing off, nothing is sent
+	w.add(testBatch(2), time.Unix(2, 0))
+	w.send()
+	if got := len(s.batches()); got != 1 {
+		t.Fatalf("%d requests while backing off, want 1", got)
+	}
+
+	w.next = time.Time{}
+	w.send()
+	if len(w.pending) != 2 || w.backoff != 20*time.Second {
+		t.Fatalf("after a 429: %d pending, backoff %v", len(w.pending), w.backoff)
+	}
+
+	w.next = time.Time{}
+	w.send()
+	if len(w.pending) != 0 || w.failing || w.backoff != 0 || !w.next.IsZero() {
+		t.Fatalf("after a 200: %d pending, failing %v, backoff %v", len(w.pending), w.failing, w.backoff)
+	}
+	if got, want := s.batches(), []int64{1000, 1000, 1000, 2000}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %v, want %v", got, want)
+	}
+}
+
+func TestRemoteWriterDropsRejected(t *testing.T) {
+	s := newRemoteWriteServer(t, http.StatusBadRequest)
+	w := newTestRemoteWriter(s.URL)
+
+	w.add(testBatch(1), time.Unix(1, 0))
+	w.add(testBatch(2), time.Unix(2, 0))
+	w.send()
+	if len(w.pending) != 0 || w.failing || !w.next.IsZero() {
+		t.Fatalf("after a 400: %d pending, failing %v, next %v", len(w.pending), w.failing, w.next)
+	}
+	if got, want := s.batches(), []int64{1000, 2000}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %v, want %v", got, want)
+	}
+}
+
+func TestRemoteWriterBufferLimit(t *testing.T) {
+	s := newRemoteWriteServer(t, http.StatusServiceUnavailable)
+	w := newTestRemoteWriter(s.URL)
+
+	w.add(testBatch(1), time.Unix(1, 0))
+	w.send()
+	for sec := int64(2); sec <= 5; sec++ {
+		w.add(testBatch(sec), time.Unix(sec, 0))
+	}
+	if len(w.pending) != 3 || w.pending[0].at.Unix() != 3 {
+		t.Fatalf("%d pending starting at %v, want the newest 3", len(w.pending), w.pending[0].at)
+	}
+
+	w.next = time.Time{}
+	w.send()
+	if got, want := s.batches(), []int64{1000, 3000, 4000, 5000}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %v, want %v", got, want)
+	}
+}
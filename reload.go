@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var configLog = newLogger("config")
+
+// how often config.yaml is checked for changes
+const configPollInterval = 5 * time.Second
+
+var configLock sync.Mutex
+var currentConfig MonitorConfig
+
+// applyConfig starts, stops or updates the subsystems that changed between
+// old and cfg. Plot processes are never touched
+func applyConfig(old MonitorConfig, cfg MonitorConfig) {
+	configLock.Lock()
+	currentConfig = cfg
+	configLock.Unlock()
+
+	setLogConfig(cfg.LoggingConfig)
+	if monitorLogFile != nil {
+		monitorLogFile.setConfig(cfg.LoggingConfig.File)
+	}
+
+	switch {
+	case !cfg.DriveMonitorEnabled:
+		stopSubsystem("drives")
+	case !reflect.DeepEqual(old.DriveMonitorConfig, cfg.DriveMonitorConfig):
+		// paths are resolved to devices when the monitor starts
+		stopSubsystem("drives")
+		fallthrough
+	default:
+		startSubsystem("drives", func(ctx context.Context) { startDriveMonitoring(ctx, cfg.DriveMonitorConfig) })
+	}
+
+	if cfg.PlotterEnabled && subsystemRunning("plotter") {
+		setPlotterConfig(cfg.PlotterConfig, cfg.ChiaPath)
+	} else if cfg.PlotterEnabled {
+		startSubsystem("plotter", func(ctx context.Context) { startPlotter(ctx, cfg.PlotterConfig, cfg.ChiaPath) })
+	} else {
+		stopSubsystem("plotter")
+	}
+
+	if cfg.UhaulEnabled && subsystemRunning("uhaul") {
+		updateUhaul(cfg.UhaulConfig)
+	} else if cfg.UhaulEnabled {
+		startSubsystem("uhaul", func(ctx context.Context) { startUhaul(ctx, cfg.UhaulConfig) })
+	} else {
+		stopSubsystem("uhaul")
+	}
+
+	if !cfg.PushConfig.enabled() || !reflect.DeepEqual(old.PushConfig, cfg.PushConfig) {
+		stopSubsystem("push")
+	}
+	if cfg.PushConfig.enabled() {
+		startSubsystem("push", func(ctx context.Context) { startPush(ctx, cfg.PushConfig) })
+	}
+
+	if cfg.MQTTConfig.Broker == "" || !reflect.DeepEqual(old.MQTTConfig, cfg.MQTTConfig) {
+		stopSubsystem("mqtt")
+	}
+	if cfg.MQTTConfig.Broker != "" {
+		startSubsystem("mqtt", func(ctx context.Context) { startMQTT(ctx, cfg.MQTTConfig) })
+	}
+
+	if len(cfg.NotifyConfig) == 0 || !reflect.DeepEqual(old.NotifyConfig, cfg.NotifyConfig) || !reflect.DeepEqual(old.EmailConfig, cfg.EmailConfig) {
+		stopSubsystem("notify")
+	}
+	if len(cfg.NotifyConfig) > 0 {
+		startSubsystem("notify", func(ctx context.Context) { startNotify(ctx, cfg.NotifyConfig, cfg.EmailConfig) })
+	}
+
+	if len(cfg.HooksConfig) == 0 || !reflect.DeepEqual(old.HooksConfig, cfg.HooksConfig) {
+		stopSubsystem("hooks")
+	}
+	if len(cfg.HooksConfig) > 0 {
+		startSubsystem("hooks", func(ctx context.Context) { startHooks(ctx, cfg.HooksConfig) })
+	}
+
+	if cfg.EmailConfig.Report.Every == "" || !reflect.DeepEqual(old.EmailConfig, cfg.EmailConfig) {
+		stopSubsystem("report")
+	}
+	if cfg.EmailConfig.Report.Every != "" {
+		startSubsystem("report", func(ctx context.Context) { startReports(ctx, cfg.EmailConfig) })
+	}
+
+	if !cfg.FarmMonitorEnabled || old.ChiaPath != cfg.ChiaPath {
+		stopSubsystem("farm")
+	}
+	if cfg.FarmMonitorEnabled {
+		startSubsystem("farm", func(ctx context.Context) { startFarmMonitor(ctx, cfg.ChiaPath) })
+	}
+}
+
+// watchConfig reloads the config at path on SIGHUP or when the file changes
+func watchConfig(ctx context.Context, path string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	modTime := func() time.Time {
+		if info, err := os.Stat(path); err == nil {
+			return info.ModTime()
+		}
+		return time.Time{}
+	}
+	last := modTime()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			configLog.Infof("SIGHUP, reloading '%s'", path)
+		case <-time.After(configPollInterval):
+			if m := modTime(); m.Equal(last) || m.IsZero() {
+				continue
+			}
+			configLog.Infof("'%s' changed, reloading", path)
+		}
+		last = modTime()
+		reloadConfig(path)
+	}
+}
+
+func reloadConfig(path string) {
+	cfg, err := loadConfig(path)
+	if err != nil {
+		configLog.Warnf("Keeping the running config, '%s' is invalid", path)
+		if errs, ok := err.(ConfigErrors); ok {
+			for _, e := range errs {
+				configLog.Warnf("%s", e.Error())
+			}
+		} else {
+			configLog.Warnf("%v", err)
+		}
+		return
+	}
+
+	configLock.Lock()
+	old := currentConfig
+	configLock.Unlock()
+
+	diff := diffConfig(old, cfg)
+	if len(diff) == 0 {
+		configLog.Infof("No changes")
+		return
+	}
+	for _, line := range diff {
+		configLog.Infof("%s", line)
+	}
+	if !reflect.DeepEqual(old.ControlConfig, cfg.ControlConfig) {
+		configLog.Warnf("Control api changes take effect after a restart")
+	}
+	if !reflect.DeepEqual(old.MetricsConfig, cfg.MetricsConfig) {
+		configLog.Warnf("Metrics listener changes take effect after a restart")
+	}
+	applyConfig(old, cfg)
+}
+
+// diffConfig describes every setting that differs between a and b
+func diffConfig(a MonitorConfig, b MonitorConfig) []string {
+	before, after := map[string]string{}, map[string]string{}
+	flattenConfig("", reflect.ValueOf(a), before)
+	flattenConfig("", reflect.ValueOf(b), after)
+
+	// a plotter that was added or removed is a single line
+	element := func(k string, other map[string]string) (string, bool) {
+		i := strings.Index(k, "].")
+		if i < 0 {
+			return k, false
+		}
+		for o := range other {
+			if strings.HasPrefix(o, k[:i+2]) {
+				return k, false
+			}
+		}
+		return k[:i+1], true
+	}
+
+	seen := map[string]bool{}
+	var diff []string
+	show := func(v string) string {
+		if strings.HasPrefix(v, secretMark) {
+			return "(hidden)"
+		}
+		return v
+	}
+	for k, v := range after {
+		if old, exists := before[k]; exists {
+			if old != v {
+				diff = append(diff, fmt.Sprintf("%s: %s => %s", k, show(old), show(v)))
+			}
+		} else if e, whole := element(k, before); !whole {
+			diff = append(diff, strings.TrimSpace(fmt.Sprintf("+ %s %s", k, show(v))))
+		} else if !seen[e] {
+			seen[e] = true
+			diff = append(diff, "+ "+e)
+		}
+	}
+	for k := range before {
+		if _, exists := after[k]; exists {
+			continue
+		}
+		if e, _ := element(k, after); !seen[e] {
+			seen[e] = true
+			diff = append(diff, "- "+e)
+		}
+	}
+	sort.Slice(diff, func(i, j int) bool {
+		return strings.TrimLeft(diff[i], "+- ") < strings.TrimLeft(diff[j], "+- ")
+	})
+	return diff
+}
+
+// values of secret settings start with this, the diff only says they changed
+const secretMark = "\x00secret:"
+
+// secretSetting tells if the setting at path holds credentials, chat webhook
+// urls carry their token. Keys are matched in any case, some sections use
+// lowercase ones
+func secretSetting(path string) bool {
+	key := strings.ToLower(path[strings.LastIndex(path, ".")+1:])
+	switch key {
+	case "password", "token", "tokens", "bearertoken":
+		return true
+	case "url", "headers":
+		return strings.HasPrefix(path, "Notify[")
+	}
+	return false
+}
+
+// flattenConfig maps every setting to its value keyed by yaml path. Lists of
+// paths become sets and plotters are keyed by tag, so reordering isn't a change
+func flattenConfig(prefix string, v reflect.Value, out map[string]string) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			flattenConfig(prefix, v.Elem(), out)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			name := strings.Split(v.Type().Field(i).Tag.Get("yaml"), ",")[0]
+			if name == "" {
+				name = v.Type().Field(i).Name
+			}
+			if prefix != "" {
+				name = prefix + "." + name
+			}
+			if name == "Control.Tokens" { // no secrets in the log
+				out[name] = fmt.Sprintf("%d tokens", v.Field(i).Len())
+				continue
+			}
+			if secretSetting(name) {
+				out[name] = secretMark + fmt.Sprint(v.Field(i).Interface())
+				continue
+			}
+			flattenConfig(name, v.Field(i), out)
+		}
+	case reflect.Map:
+		for _, k := range v.MapKeys() {
+			flattenConfig(fmt.Sprintf("%s[%v]", prefix, k.Interface()), v.MapIndex(k), out)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			e := reflect.Indirect(v.Index(i))
+			switch {
+			case e.Kind() == reflect.String:
+				out[fmt.Sprintf("%s[%s]", prefix, e.String())] = ""
+			case e.Kind() == reflect.Struct && e.FieldByName("Tag").IsValid():
+				flattenConfig(fmt.Sprintf("%s[%s]", prefix, e.FieldByName("Tag").String()), e, out)
+			case e.Kind() == reflect.Struct && e.FieldByName("Name").IsValid():
+				flattenConfig(fmt.Sprintf("%s[%s]", prefix, e.FieldByName("Name").String()), e, out)
+			default:
+				flattenConfig(fmt.Sprintf("%s[%d]", prefix, i), e, out)
+			}
+		}
+	default:
+		out[prefix] = fmt.Sprint(v.Interface())
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func secretsConfig(n string) MonitorConfig {
+	s := func(name string) string { return "secret-" + name + "-" + n }
+	return MonitorConfig{
+		ControlConfig: ControlConfig{Tokens: []ControlToken{{Name: "ops", Token: s("control")}}},
+		MetricsConfig: MetricsConfig{
+			Users:  []MetricsUser{{Name: "prometheus", Password: s("metrics-user")}},
+			Tokens: []string{s("metrics-token")},
+		},
+		PushConfig: PushConfig{
+			Password:    s("push-password"),
+			BearerToken: s("push-bearer"),
+			Influx:      InfluxConfig{Token: s("influx-token"), Password: s("influx-password")},
+		},
+		MQTTConfig:  MQTTConfig{Password: s("mqtt")},
+		EmailConfig: EmailConfig{Password: s("email")},
+		NotifyConfig: []*NotifyConfig{
+			{Name: "discord", Type: "discord", URL: "https://discord.com/api/webhooks/1/" + s("discord")},
+			{Name: "telegram", Type: "telegram", Token: s("telegram"), ChatID: "42"},
+			{Name: "webhook", Type: "webhook", URL: "https://example.com/" + s("webhook"), Headers: map[string]string{"Authorization": s("header")}},
+		},
+	}
+}
+
+func TestDiffConfigHidesSecrets(t *testing.T) {
+	diff := diffConfig(secretsConfig("old"), secretsConfig("new"))
+	if len(diff) == 0 {
+		t.Fatal("no changes found")
+	}
+	for _, line := range diff {
+		if strings.Contains(line, "secret-") {
+			t.Errorf("secret in the diff: %s", line)
+		}
+	}
+	for _, want := range []string{
+		"Metrics.Users[prometheus].password: (hidden) => (hidden)",
+		"Notify[telegram].Token: (hidden) => (hidden)",
+	} {
+		found := false
+		for _, line := range diff {
+			found = found || line == want
+		}
+		if !found {
+			t.Errorf("missing '%s' in %q", want, diff)
+		}
+	}
+
+	// settings appearing for the first time
+	diff = diffConfig(MonitorConfig{}, secretsConfig("new"))
+	for _, line := range diff {
+		if strings.Contains(line, "secret-") {
+			t.Errorf("secret in the diff: %s", line)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var reportLog = newLogger("report")
+
+var (
+	reportsSent = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "reports_sent_total",
+		Help: "Summary reports mailed",
+	})
+
+	reportsFailed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "reports_failed_total",
+		Help: "Attempts to mail a summary report that failed",
+	})
+)
+
+// columns of the phase time table
+var reportPhases = []string{"1", "2", "3", "4", "copy"}
+
+type tagReport struct {
+	Tag          string             `json:"tag"`
+	Completed    int                `json:"completed"`
+	Failed       int                `json:"failed"`
+	PhaseSeconds map[string]float64 `json:"phaseSeconds"` // average by phase
+}
+
+type driveReport struct {
+	Path        string  `json:"path"`
+	FreeBytes   uint64  `json:"freeBytes"`
+	UsedPercent float64 `json:"usedPercent"`
+	Plots       int     `json:"plots"`
+	MovedBytes  int64   `json:"movedBytes"` // within the report
+	DaysLeft    float64 `json:"daysLeft"`   // until full at that rate, -1 if nothing was moved
+}
+
+// Report summarizes plotting, uhaul and farming between From and To
+type Report struct {
+	Title      string          `json:"title"`
+	Host       string          `json:"host"`
+	From       time.Time       `json:"from"`
+	To         time.Time       `json:"to"`
+	Tags       []tagReport     `json:"tags"`
+	Failed     []PlotLifecycle `json:"failed"`
+	Moved      int             `json:"moved"`
+	MovedBytes int64           `json:"movedBytes"`
+	Drives     []driveReport   `json:"drives"`
+	Farm       *FarmSummary    `json:"farm,omitempty"` // nil until the farm monitor has a summary
+}
+
+// buildReport collects the report from the plot history, drives and farm
+// summary
+func buildReport(title string, from time.Time, to time.Time) Report {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	report := Report{Title: title, Host: host, From: from, To: to, Failed: []PlotLifecycle{}}
+	within := func(t time.Time) bool { return !t.Before(from) && t.Before(to) }
+
+	tags := map[string]*tagReport{}
+	phaseCounts := map[string]map[string]int{}
+	tag := func(name string) *tagReport {
+		if name == "" {
+			name = "unknown"
+		}
+		if _, exists := tags[name]; !exists {
+			tags[name] = &tagReport{Tag: name, PhaseSeconds: map[string]float64{}}
+			phaseCounts[name] = map[string]int{}
+		}
+		return tags[name]
+	}
+
+	moved := map[string]int64{}
+	for _, r := range lifecycle.Records() {
+		if within(r.Staged) {
+			t := tag(r.Tag)
+			t.Completed++
+			for phase, secs := range r.Phases {
+				t.PhaseSeconds[phase] += secs
+				phaseCounts[t.Tag][phase]++
+			}
+		}
+		if within(r.Failed) {
+			tag(r.Tag).Failed++
+			report.Failed = append(report.Failed, r)
+		}
+		if within(r.Farmed) {
+			// plots moved before sizes were recorded count as k32
+			size := r.Bytes
+			if size == 0 {
+				size = int64(k32PlotBytes)
+			}
+			report.Moved++
+			report.MovedBytes += size
+			moved[filepath.Clean(r.Destination)] += size
+		}
+	}
+
+	for name, t := range tags {
+		for phase, n := range phaseCounts[name] {
+			t.PhaseSeconds[phase] /= float64(n)
+		}
+		report.Tags = append(report.Tags, *t)
+	}
+	sort.Slice(report.Tags, func(i, j int) bool { return report.Tags[i].Tag < report.Tags[j].Tag })
+
+	days := to.Sub(from).Hours() / 24
+	for _, d := range DriveSnapshot() {
+		if !driveKind(d, "final") || d.Error != "" {
+			continue
+		}
+		drive := driveReport{Path: d.Path, FreeBytes: d.FreeBytes, Plots: d.Plots, DaysLeft: -1}
+		if total := d.FreeBytes + d.UsedBytes; total > 0 {
+			drive.UsedPercent = float64(d.UsedBytes) / float64(total) * 100
+		}
+		drive.MovedBytes = moved[filepath.Clean(d.Path)]
+		if drive.MovedBytes > 0 && days > 0 {
+			drive.DaysLeft = float64(d.FreeBytes) / (float64(drive.MovedBytes) / days)
+		}
+		report.Drives = append(report.Drives, drive)
+	}
+
+	if farm := CurrentFarmSummary(); !farm.Updated.IsZero() {
+		report.Farm = &farm
+	}
+	return report
+}
+
+// Completed is the number of plots finished by every tag
+func (r Report) Completed() int {
+	n := 0
+	for _, t := range r.Tags {
+		n += t.Completed
+	}
+	return n
+}
+
+func (r Report) Subject() string {
+	return fmt.Sprintf("%s: %s, %d plot(s) completed, %d failed", r.Host, r.Title, r.Completed(), len(r.Failed))
+}
+
+var reportFuncs = map[string]interface{}{
+	"phases":   func() []string { return reportPhases },
+	"duration": formatDuration,
+	"bytes":    func(b int64) string { return formatBytes(uint64(b)) },
+	"free":     formatBytes,
+	"time":     func(t time.Time) string { return t.Local().Format("2006-01-02 15:04") },
+	"short": func(id string) string {
+		if len(id) > 12 {
+			return id[:12]
+		}
+		return id
+	},
+	"phase": func(t tagReport, phase string) string {
+		return formatDuration(time.Duration(t.PhaseSeconds[phase] * float64(time.Second)))
+	},
+	"days": func(d float64) string {
+		if d < 0 {
+			return "-"
+		}
+		return fmt.Sprintf("%.1f", d)
+	},
+}
+
+// rendered through a tabwriter, lines with tabs line up as tables
+var reportText = texttemplate.Must(texttemplate.New("report").Funcs(reportFuncs).Parse(`{{.Title}} for {{.Host}}
+{{time .From}} to {{time .To}}
+
+PLOTS
+{{if .Tags}}tag	completed	failed{{range phases}}	{{if eq . "copy"}}copy{{else}}phase {{.}}{{end}}{{end}}
+{{range $t := .Tags}}{{.Tag}}	{{.Completed}}	{{.Failed}}{{range phases}}	{{phase $t .}}{{end}}
+{{end}}{{else}}No plots completed or failed.
+{{end}}
+{{if .Failed}}FAILED PLOTS
+plot	tag	temp dir	phase	failed	error
+{{range .Failed}}{{short .ID}}	{{.Tag}}	{{.TempDir}}	{{.FailedPhase}}	{{time .Failed}}	{{.Error}}
+{{end}}
+{{end}}UHAUL
+{{.Moved}} plot(s) moved, {{bytes .MovedBytes}}
+
+FINAL DRIVES
+{{if .Drives}}path	used	free	plots	moved	days until full
+{{range .Drives}}{{.Path}}	{{printf "%.1f" .UsedPercent}}%	{{free .FreeBytes}}	{{.Plots}}	{{bytes .MovedBytes}}	{{days .DaysLeft}}
+{{end}}{{else}}No final drives are monitored.
+{{end}}
+FARM
+{{with .Farm}}{{if .Error}}The last farm summary failed: {{.Error}}
+{{else}}{{printf "%.4f" .Farmed}} XCH farmed, netspace {{printf "%.3f" .NetspacePiB}} PiB{{if .Plots}}, {{.Plots}} plots{{end}}
+{{end}}{{else}}No farm summary, the farm monitor is disabled or hasn't run yet.
+{{end}}`))
+
+var reportHTML = htmltemplate.Must(htmltemplate.New("report").Funcs(reportFuncs).Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Title}} for {{.Host}}</title></head>
+<body style="font-family: sans-serif; font-size: 14px; color: #222">
+<h2>{{.Title}} for {{.Host}}</h2>
+<p>{{time .From}} to {{time .To}}</p>
+
+<h3>Plots</h3>
+{{if .Tags}}<table cellpadding="4" style="border-collapse: collapse">
+<tr style="background: #eee"><th align="left">Tag</th><th>Completed</th><th>Failed</th>{{range phases}}<th>{{if eq . "copy"}}Copy{{else}}Phase {{.}}{{end}}</th>{{end}}</tr>
+{{range $t := .Tags}}<tr><td>{{.Tag}}</td><td align="right">{{.Completed}}</td><td align="right">{{.Failed}}</td>{{range phases}}<td align="right">{{phase $t .}}</td>{{end}}</tr>
+{{end}}</table>
+{{else}}<p>No plots completed or failed.</p>
+{{end}}
+{{if .Failed}}<h3>Failed plots</h3>
+<table cellpadding="4" style="border-collapse: collapse">
+<tr style="background: #eee"><th align="left">Plot</th><th align="left">Tag</th><th align="left">Temp dir</th><th>Phase</th><th>Failed</th><th align="left">Error</th></tr>
+{{range .Failed}}<tr><td>{{short .ID}}</td><td>{{.Tag}}</td><td>{{.TempDir}}</td><td align="center">{{.FailedPhase}}</td><td>{{time .Failed}}</td><td>{{.Error}}</td></tr>
+{{end}}</table>
+{{end}}
+<h3>Uhaul</h3>
+<p>{{.Moved}} plot(s) moved, {{bytes .MovedBytes}}</p>
+
+<h3>Final drives</h3>
+{{if .Drives}}<table cellpadding="4" style="border-collapse: collapse">
+<tr style="background: #eee"><th align="left">Path</th><th>Used</th><th>Free</th><th>Plots</th><th>Moved</th><th>Days until full</th></tr>
+{{range .Drives}}<tr><td>{{.Path}}</td><td align="right">{{printf "%.1f" .UsedPercent}}%</td><td align="right">{{free .FreeBytes}}</td><td align="right">{{.Plots}}</td><td align="right">{{bytes .MovedBytes}}</td><td align="right">{{days .DaysLeft}}</td></tr>
+{{end}}</table>
+{{else}}<p>No final drives are monitored.</p>
+{{end}}
+<h3>Farm</h3>
+{{with .Farm}}{{if .Error}}<p>The last farm summary failed: {{.Error}}</p>
+{{else}}<p>{{printf "%.4f" .Farmed}} XCH farmed, netspace {{printf "%.3f" .NetspacePiB}} PiB{{if .Plots}}, {{.Plots}} plots{{end}}</p>
+{{end}}{{else}}<p>No farm summary, the farm monitor is disabled or hasn't run yet.</p>
+{{end}}</body>
+</html>
+`))
+
+// Text renders the report as plain text
+func (r Report) Text() (string, error) {
+	b := bytes.Buffer{}
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	if err := reportText.Execute(w, r); err != nil {
+		return "", err
+	}
+	w.Flush()
+	return b.String(), nil
+}
+
+// HTML renders the report as an html page
+func (r Report) HTML() (string, error) {
+	b := bytes.Buffer{}
+	if err := reportHTML.Execute(&b, r); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// mailReport sends r to the recipients of the email config
+func mailReport(cfg EmailConfig, r Report) error {
+	text, err := r.Text()
+	if err != nil {
+		return err
+	}
+	html, err := r.HTML()
+	if err != nil {
+		return err
+	}
+	if err := sendMail(cfg, cfg.To, r.Subject(), text, html); err != nil {
+		reportsFailed.Inc()
+		return err
+	}
+	reportsSent.Inc()
+	reportLog.Infof("Mailed the %s to %s", strings.ToLower(r.Title), strings.Join(cfg.To, ", "))
+	return nil
+}
+
+// reportTitle and reportStart describe the period of a daily or weekly
+// report ending at end
+func reportTitle(every string) string {
+	if every == "weekly" {
+		return "Weekly report"
+	}
+	return "Daily report"
+}
+
+func reportStart(every string, end time.Time) time.Time {
+	if every == "weekly" {
+		return end.AddDate(0, 0, -7)
+	}
+	return end.AddDate(0, 0, -1)
+}
+
+// nextReport is when the first report after now is due
+func nextReport(cfg ReportConfig, now time.Time) time.Time {
+	next := nextDigest(cfg.At, now)
+	if cfg.Every == "weekly" {
+		day, _ := parseWeekday(cfg.Weekday)
+		for next.Weekday() != day {
+			next = next.AddDate(0, 0, 1)
+		}
+	}
+	return next
+}
+
+func parseWeekday(s string) (time.Weekday, bool) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(d.String(), s) {
+			return d, true
+		}
+	}
+	return time.Sunday, false
+}
+
+// startReports mails the report on schedule until ctx is done. Failed sends
+// are retried with backoff until the next report is due
+func startReports(ctx context.Context, cfg EmailConfig) {
+	for ctx.Err() == nil {
+		due := nextReport(cfg.Report, time.Now())
+		reportLog.Infof("Next %s report at %s", cfg.Report.Every, due.Format("Mon 2006-01-02 15:04"))
+		sleepContext(ctx, time.Until(due))
+		if ctx.Err() != nil {
+			break
+		}
+
+		report := buildReport(reportTitle(cfg.Report.Every), reportStart(cfg.Report.Every, due), due)
+		giveUp := nextReport(cfg.Report, due)
+		retry := retryBackoff{}
+		for ctx.Err() == nil {
+			err := mailReport(cfg, report)
+			if err == nil {
+				break
+			}
+			wait, _ := retry.failed()
+			if time.Now().Add(wait).After(giveUp) {
+				reportLog.Errorf("Giving up on the report due %s: %v", due.Format("2006-01-02 15:04"), err)
+				break
+			}
+			reportLog.Warnf("Error mailing the report, retrying in %v: %v", wait, err)
+			sleepContext(ctx, wait)
+		}
+	}
+	reportLog.Infof("Stopped")
+}
+
+// SendReport mails a report covering the configured period up to now
+func SendReport() (string, error) {
+	configLock.Lock()
+	cfg := currentConfig.EmailConfig
+	configLock.Unlock()
+	if cfg.Server == "" || len(cfg.To) == 0 {
+		return "", errors.New("no Email server or recipients configured")
+	}
+
+	now := time.Now()
+	report := buildReport(reportTitle(cfg.Report.Every), reportStart(cfg.Report.Every, now), now)
+	if err := mailReport(cfg, report); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("mailed the %s to %s", strings.ToLower(report.Title), strings.Join(cfg.To, ", ")), nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestNextReport(t *testing.T) {
+	at := func(s string) time.Time {
+		v, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	for _, c := range []struct {
+		cfg  ReportConfig
+		now  string
+		want string
+	}{
+		{ReportConfig{Every: "daily", At: "07:00"}, "2021-06-09 06:59", "2021-06-09 07:00"},
+		{ReportConfig{Every: "daily", At: "07:00"}, "2021-06-09 07:00", "2021-06-10 07:00"},
+		{ReportConfig{Every: "daily", At: "07:00"}, "2021-06-30 23:00", "2021-07-01 07:00"},
+		// 2021-06-07 is a monday
+		{ReportConfig{Every: "weekly", At: "07:00", Weekday: "Monday"}, "2021-06-07 06:00", "2021-06-07 07:00"},
+		{ReportConfig{Every: "weekly", At: "07:00", Weekday: "Monday"}, "2021-06-07 07:00", "2021-06-14 07:00"},
+		{ReportConfig{Every: "weekly", At: "07:00", Weekday: "monday"}, "2021-06-09 12:00", "2021-06-14 07:00"},
+		{ReportConfig{Every: "weekly", At: "07:00", Weekday: "Sunday"}, "2021-06-12 08:00", "2021-06-13 07:00"},
+		{ReportConfig{Every: "weekly", At: "18:30", Weekday: "Saturday"}, "2021-12-26 10:00", "2022-01-01 18:30"},
+	} {
+		if got := nextReport(c.cfg, at(c.now)); !got.Equal(at(c.want)) {
+			t.Errorf("%+v at %s: got %s, want %s", c.cfg, c.now, got.Format("Mon 2006-01-02 15:04"), c.want)
+		}
+	}
+}
+
+func TestBuildReportDaysUntilFull(t *testing.T) {
+	saved := lifecycle
+	t.Cleanup(func() { lifecycle = saved })
+	lifecycle = NewLifecycleTracker("")
+
+	busy, idle := t.TempDir(), t.TempDir()
+	for _, path := range []string{busy, idle} {
+		updateDriveInfo(path, func(info *DriveInfo) { info.Kinds = []string{"final"} })
+	}
+	t.Cleanup(func() {
+		driveInfoLock.Lock()
+		delete(driveInfos, busy)
+		delete(driveInfos, idle)
+		driveInfoLock.Unlock()
+	})
+
+	to := time.Date(2021, 6, 14, 7, 0, 0, 0, time.Local)
+	from := reportStart("weekly", to)
+	// plots moved before sizes were recorded count as k32
+	lifecycle.plots["a"] = &PlotLifecycle{ID: "a", Destination: busy, Bytes: 100 << 30, Farmed: from.Add(time.Hour)}
+	lifecycle.plots["b"] = &PlotLifecycle{ID: "b", Destination: busy + "/", Farmed: to.Add(-time.Hour)}
+	lifecycle.plots["c"] = &PlotLifecycle{ID: "c", Destination: busy, Bytes: 100 << 30, Farmed: from.Add(-time.Hour)}
+
+	report := buildReport(reportTitle("weekly"), from, to)
+	moved := int64(100<<30) + int64(k32PlotBytes)
+	if report.Moved != 2 || report.MovedBytes != moved {
+		t.Errorf("moved %d plots, %d bytes, want 2 and %d", report.Moved, report.MovedBytes, moved)
+	}
+	drives := map[string]driveReport{}
+	for _, d := range report.Drives {
+		drives[d.Path] = d
+	}
+	d, exists := drives[busy]
+	if !exists {
+		t.Fatalf("%s isn't in the report: %+v", busy, report.Drives)
+	}
+	want := float64(d.FreeBytes) / (float64(moved) / 7)
+	if d.MovedBytes != moved || math.Abs(d.DaysLeft-want) > 1e-9 {
+		t.Errorf("got %d bytes moved, %v days left, want %d and %v", d.MovedBytes, d.DaysLeft, moved, want)
+	}
+	if d := drives[idle]; d.MovedBytes != 0 || d.DaysLeft != -1 {
+		t.Errorf("idle drive got %d bytes moved, %v days left, want 0 and -1", d.MovedBytes, d.DaysLeft)
+	}
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// placeholders in simulated log lines, filled in per plot as lines are emitted
+const (
+	simTime  = "{TIME}"
+	simTemp  = "{TEMP}"
+	simID    = "{ID}"
+	simFinal = "{FINAL}"
+)
+
+// chiapos k32 temp space without the final file
+const defaultWorkingSpaceGiB = 239.0
+
+var simPhases = []string{"1", "2", "3", "4", "copy"}
+
+var simPhaseNames = map[string]string{
+	"1": "Forward Propagation into tmp files...",
+	"2": "Backpropagation into tmp files...",
+	"3": "Compression from tmp files...",
+	"4": "Write Checkpoint tables...",
+}
+
+type simLine struct {
+	offset time.Duration // plotting time into the plot
+	msg    string
+}
+
+// simScript is the output of a single plot, either recorded or synthesized
+// from the timing model
+type simScript struct {
+	name         string
+	tag          string
+	lines        []simLine
+	phases       map[string][2]time.Duration // start/end offset per phase
+	workingSpace float64                     // GiB
+}
+
+func (s *simScript) length() time.Duration {
+	if len(s.lines) == 0 {
+		return 0
+	}
+	return s.lines[len(s.lines)-1].offset
+}
+
+// indexPhases finds where each phase starts and ends in the script
+func (s *simScript) indexPhases() {
+	s.phases = map[string][2]time.Duration{}
+	var starts []string
+	startAt := map[string]time.Duration{}
+	for _, l := range s.lines {
+		phase := ""
+		if val, valid := checkRegexes(l.msg, processors["phase"]); valid {
+			phase = val[0]
+		} else if val, valid := checkRegex(l.msg, phaseTime); valid && val[0] == "4" {
+			phase = "copy"
+		}
+		if _, seen := startAt[phase]; phase != "" && !seen {
+			startAt[phase] = l.offset
+			starts = append(starts, phase)
+		}
+	}
+
+	for i, phase := range starts {
+		end := s.length()
+		if i+1 < len(starts) {
+			end = startAt[starts[i+1]]
+		}
+		s.phases[phase] = [2]time.Duration{startAt[phase], end}
+	}
+}
+
+// tempUsage approximates the temp space in GiB used by the plot after worked:
+// it grows through phase 1, stays full through phase 2, shrinks while phase 3
+// compresses tables and is released once the copy finishes
+func (s *simScript) tempUsage(worked time.Duration) float64 {
+	current := ""
+	for _, phase := range simPhases {
+		if b, exists := s.phases[phase]; exists && b[0] <= worked {
+			current = phase
+		}
+	}
+
+	b := s.phases[current]
+	f := float64(1)
+	if b[1] > b[0] {
+		f = float64(worked-b[0]) / float64(b[1]-b[0])
+	}
+	if f > 1 {
+		f = 1
+	}
+
+	switch current {
+	case "1":
+		return s.workingSpace * (0.2 + 0.8*f)
+	case "2":
+		return s.workingSpace
+	case "3":
+		return s.workingSpace * (1 - 0.55*f)
+	case "4":
+		return s.workingSpace * 0.45
+	case "copy":
+		return s.workingSpace * 0.45 * (1 - f)
+	}
+	return 0
+}
+
+// recordedScript turns a chiapos log into a script, timing comes from the
+// timestamps chiapos prints at phase starts and after each table
+func recordedScript(path string) (*simScript, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	script := &simScript{name: filepath.Base(path), workingSpace: defaultWorkingSpaceGiB}
+	var base time.Time
+	offset := time.Duration(0)
+	finished := false
+
+	r := bufio.NewReader(fd)
+	for {
+		s, err := r.ReadString('\n')
+		if len(s) > 0 {
+			if stamp, stamped := parseCtime(s); stamped {
+				if base.IsZero() {
+					base = stamp
+				}
+				offset = stamp.Sub(base)
+				s = ctimeRegex.ReplaceAllString(s, simTime)
+			}
+
+			if val, valid := checkRegexes(s, processors["temp_drive"]); valid {
+				script.tag = tempDirTag(val[0])
+				s = fmt.Sprintf("Starting plotting progress into temporary dirs: %s and %s\n", simTemp, simTemp)
+			}
+			if _, valid := checkRegexes(s, processors["plot_id"]); valid {
+				s = fmt.Sprintf("ID: %s\n", simID)
+			}
+			if val, valid := checkRegexes(s, processors["working_space"]); valid {
+				script.workingSpace = parseNumber(val[0])
+			}
+			if _, valid := checkRegexes(s, processors["final_file"]); valid {
+				s = fmt.Sprintf("Renamed final file from \"%s.tmp\" to \"%s\"\n", simFinal, simFinal)
+				finished = true
+			}
+
+			script.lines = append(script.lines, simLine{offset: offset, msg: s})
+		}
+		if err != nil {
+			if err != io.EOF {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	if !finished {
+		return nil, fmt.Errorf("'%s' is not a finished plot", path)
+	}
+
+	script.indexPhases()
+	return script, nil
+}
+
+// syntheticScript builds chiapos output for the tag from the timing model
+func syntheticScript(tag string) *simScript {
+	script := &simScript{name: "synthetic", tag: tag, workingSpace: defaultWorkingSpaceGiB}
+	durations := timingModel.StepDurations(tag)
+
+	offset := time.Duration(0)
+	add := func(format string, a ...interface{}) {
+		script.lines = append(script.lines, simLine{offset: offset, msg: fmt.Sprintf(format, a...)})
+	}
+	cpu := "CPU (100.000%) " + simTime
+
+	add("Starting plotting progress into temporary dirs: %s and %s", simTemp, simTemp)
+	add("ID: %s", simID)
+	add("Using 128 buckets")
+
+	phaseSecs := map[string]float64{}
+	total := float64(0)
+	prevPhase := ""
+	for i, step := range plotSteps {
+		d := durations[i]
+		if step.phase != prevPhase {
+			if prevPhase != "" {
+				add("Time for phase %s = %.3f seconds. %s", prevPhase, phaseSecs[prevPhase], cpu)
+			}
+			if step.phase != "copy" {
+				add("Starting phase %s/4: %s %s", step.phase, simPhaseNames[step.phase], simTime)
+			}
+		}
+
+		switch step.phase {
+		case "1":
+			add("Computing table %s", step.table)
+			offset += time.Duration(d * float64(time.Second))
+			if step.table == "1" {
+				add("F1 complete, time: %.3f seconds. %s", d, cpu)
+			} else {
+				add("Forward propagation table time: %.3f seconds. %s", d, cpu)
+			}
+		case "2":
+			add("Backpropagating on table %s", step.table)
+			offset += time.Duration(d * float64(time.Second))
+		case "3":
+			add("Compressing tables %s and %d", step.table, int(parseNumber(step.table))+1)
+			offset += time.Duration(d * float64(time.Second))
+			add("Total compress table time: %.3f seconds. %s", d, cpu)
+		case "4":
+			if step.table == "1" {
+				add("\tStarting to write C1 and C3 tables")
+			} else {
+				add("\tWriting C2 table")
+			}
+			offset += time.Duration(d * float64(time.Second))
+		case "copy":
+			add("Approximate working space used (without final file): %.3f GiB", script.workingSpace)
+			add("Final File size: 101.366 GiB")
+			add("Total time = %.3f seconds. %s", total, cpu)
+			offset += time.Duration(d * float64(time.Second))
+			add("Copy time = %.3f seconds. %s", d, cpu)
+			add("Renamed final file from \"%s.tmp\" to \"%s\"", simFinal, simFinal)
+		}
+
+		phaseSecs[step.phase] += d
+		total += d
+		prevPhase = step.phase
+	}
+
+	script.indexPhases()
+	return script
+}
+
+// scriptSet hands out scripts per tag, recorded plots are preferred and
+// rotated through, tags without any fall back to the timing model
+type scriptSet struct {
+	recorded  []*simScript
+	synthetic map[string]*simScript
+	next      map[string]int
+}
+
+func (s *scriptSet) forTag(tag string) *simScript {
+	var candidates []*simScript
+	for _, r := range s.recorded {
+		if r.tag == tag {
+			candidates = append(candidates, r)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = s.recorded
+	}
+	if len(candidates) == 0 {
+		return s.synthetic[tag]
+	}
+
+	i := s.next[tag] % len(candidates)
+	s.next[tag]++
+	return candidates[i]
+}
+
+type simOptions struct {
+	duration   time.Duration
+	step       time.Duration
+	contention float64 // slowdown per extra plot sharing a temp path
+}
+
+type simPlot struct {
+	pid      int
+	state    *PlotterState
+	script   *simScript
+	cfg      PlotterConfig
+	replacer *strings.Replacer
+	worked   time.Duration
+	next     int
+	launched time.Time
+}
+
+type simTagStats struct {
+	tempPath    string
+	launched    int
+	completed   int
+	plotTime    time.Duration // over completed plots
+	phase1Time  time.Duration // summed over plots in phase 1
+	overlapTime time.Duration // time with more than one plot in phase 1
+	maxPhase1   int
+	peakTemp    float64 // GiB
+}
+
+type simResult struct {
+	config   string
+	duration time.Duration
+	tags     map[string]*simTagStats
+}
+
+// simulate runs the plotter scheduler for cfg against simulated plots on a
+// virtual clock
+func simulate(name string, cfg MonitorConfig, scripts *scriptSet, opts simOptions) simResult {
+	result := simResult{config: name, duration: opts.duration, tags: map[string]*simTagStats{}}
+
+	cfgMap := map[string]PlotterConfig{}
+	for _, v := range cfg.PlotterConfig {
+		cfgMap[v.TempPath] = *v
+		result.tags[v.Tag] = &simTagStats{tempPath: v.TempPath}
+	}
+
+	start := time.Now().Truncate(time.Hour)
+	now := start
+	clock = func() time.Time { return now }
+	defer func() { clock = time.Now }()
+	lastLaunched = map[string]time.Time{}
+
+	states := PlotterStates{}
+	plots := map[int]*simPlot{}
+	nextPid := 1
+
+	launch := func(c PlotterConfig) {
+		script := scripts.forTag(c.Tag)
+		id := make([]byte, 32)
+		rand.Read(id)
+		plotID := hex.EncodeToString(id)
+		tempDir := fmt.Sprintf("%s/%s_%d", c.TempPath, c.Tag, now.Unix())
+		final := fmt.Sprintf("%s/plot-k32-%s-%s.plot", c.FinalPath, now.Format("2006-01-02-15-04"), plotID)
+
+		p := &simPlot{
+			pid:      nextPid,
+			state:    &PlotterState{Pid: nextPid, State: map[string]string{"phase": "init", "table": "0"}},
+			script:   script,
+			cfg:      c,
+			replacer: strings.NewReplacer(simTemp, tempDir, simID, plotID, simFinal, final),
+			launched: now,
+		}
+		plots[p.pid] = p
+		states[p.pid] = p.state
+		result.tags[c.Tag].launched++
+		nextPid++
+	}
+
+	// the monitor waits a minute before its first scheduling pass
+	nextSchedule := start.Add(time.Minute)
+	end := start.Add(opts.duration)
+	for now.Before(end) {
+		perPath := map[string]int{}
+		for _, p := range plots {
+			perPath[p.cfg.TempPath]++
+		}
+
+		for pid, p := range plots {
+			rate := 1 / (1 + opts.contention*float64(perPath[p.cfg.TempPath]-1))
+			p.worked += time.Duration(float64(opts.step) * rate)
+
+			for p.next < len(p.script.lines) && p.script.lines[p.next].offset <= p.worked {
+				msg := p.replacer.Replace(p.script.lines[p.next].msg)
+				msg = strings.ReplaceAll(msg, simTime, now.Format(time.ANSIC))
+				p.state.Update(&logEntry{pid: pid, msg: msg, live: true})
+				p.next++
+			}
+
+			if p.next >= len(p.script.lines) { // process exits once the plot is renamed
+				stats := result.tags[p.cfg.Tag]
+				stats.completed++
+				stats.plotTime += now.Sub(p.launched)
+				delete(plots, pid)
+				delete(states, pid)
+			}
+		}
+
+		phase1 := map[string]int{}
+		temp := map[string]float64{}
+		for _, p := range plots {
+			if p.state.State["phase"] == "1" {
+				phase1[p.cfg.Tag]++
+			}
+			temp[p.cfg.Tag] += p.script.tempUsage(p.worked)
+		}
+		for tag, stats := range result.tags {
+			stats.phase1Time += time.Duration(phase1[tag]) * opts.step
+			if phase1[tag] > 1 {
+				stats.overlapTime += opts.step
+			}
+			if phase1[tag] > stats.maxPhase1 {
+				stats.maxPhase1 = phase1[tag]
+			}
+			if temp[tag] > stats.peakTemp {
+				stats.peakTemp = temp[tag]
+			}
+		}
+
+		if !now.Before(nextSchedule) {
+			schedule(cfgMap, byTempPath(states), start, now, launch)
+			nextSchedule = nextSchedule.Add(scheduleInterval)
+		}
+
+		now = now.Add(opts.step)
+	}
+
+	return result
+}
+
+func printSimResult(w io.Writer, r simResult) {
+	days := r.duration.Hours() / 24
+	fmt.Fprintf(w, "=== %s: %.1f days simulated ===\n", r.config, days)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "tag\ttemp path\tlaunched\tcompleted\tplots/day\tavg plot time\tavg phase 1\tphase 1 overlap\tmax phase 1\tpeak temp GiB")
+
+	var tags []string
+	for tag := range r.tags {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	launched, completed := 0, 0
+	peak := float64(0)
+	for _, tag := range tags {
+		s := r.tags[tag]
+		avgPlot := time.Duration(0)
+		if s.completed > 0 {
+			avgPlot = s.plotTime / time.Duration(s.completed)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%.2f\t%s\t%.2f\t%.1f%%\t%d\t%.0f\n",
+			tag, s.tempPath, s.launched, s.completed, float64(s.completed)/days,
+			avgPlot.Round(time.Minute),
+			s.phase1Time.Seconds()/r.duration.Seconds(),
+			s.overlapTime.Seconds()/r.duration.Seconds()*100,
+			s.maxPhase1, s.peakTemp)
+
+		launched += s.launched
+		completed += s.completed
+		peak += s.peakTemp
+	}
+	fmt.Fprintf(tw, "total\t\t%d\t%d\t%.2f\t\t\t\t\t%.0f\n", launched, completed, float64(completed)/days, peak)
+	tw.Flush()
+	fmt.Fprintln(w)
+}
+
+// runSimulation implements `chia-monitor simulate [flags] [config.yaml...]`
+func runSimulation(args []string) {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	days := fs.Float64("days", 7, "days of plotting to simulate")
+	step := fs.Duration("step", time.Minute, "virtual time step")
+	contention := fs.Float64("contention", 0.15, "slowdown per extra plot sharing a temp path")
+	logs := fs.String("logs", "plotter_logs", "dir of recorded chiapos logs used for timings")
+	replay := fs.Bool("replay", false, "replay the recorded logs as-is instead of synthesizing plots from their timings")
+	verbose := fs.Bool("v", false, "show scheduler output")
+	fs.Parse(args)
+
+	configs := fs.Args()
+	if len(configs) == 0 {
+		configs = []string{"config.yaml"}
+	}
+
+	if !*verbose {
+		setLogOutput(ioutil.Discard)
+	}
+
+	timingModel.LoadLogs(*logs)
+	scripts := &scriptSet{synthetic: map[string]*simScript{}, next: map[string]int{}}
+	if *replay {
+		files, _ := filepath.Glob(filepath.Join(*logs, "*.log"))
+		for _, f := range files {
+			script, err := recordedScript(f)
+			if err != nil {
+				continue
+			}
+			scripts.recorded = append(scripts.recorded, script)
+		}
+		fmt.Printf("Replaying %d recorded plots from '%s'\n\n", len(scripts.recorded), *logs)
+	}
+
+	var cfgs []MonitorConfig
+	for _, path := range configs {
+		cfg, err := parseConfig(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading config '%s': %v\n", path, err)
+			os.Exit(1)
+		}
+		// synthesize up front, the simulated plots feed back into the model
+		for _, v := range cfg.PlotterConfig {
+			if _, exists := scripts.synthetic[v.Tag]; !exists {
+				scripts.synthetic[v.Tag] = syntheticScript(v.Tag)
+			}
+		}
+		cfgs = append(cfgs, cfg)
+	}
+
+	opts := simOptions{
+		duration:   time.Duration(*days * 24 * float64(time.Hour)),
+		step:       *step,
+		contention: *contention,
+	}
+	for i, cfg := range cfgs {
+		printSimResult(os.Stdout, simulate(configs[i], cfg, scripts, opts))
+	}
+}
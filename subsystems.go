@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// subsystem is a long running part of the monitor, it runs until its context
+// is cancelled
+type subsystem struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+var subsystemsLock sync.Mutex
+var subsystems = map[string]*subsystem{}
+
+// subsystems are stopped in this order on shutdown, anything else after
+// them. Alerts stop before what they watch so nothing resolves on the way
+// down, launching and moving plots stops next, push, mqtt and notify send
+// their last values and events after everything else stopped updating them
+// and the http server goes last
+var shutdownOrder = []string{
+	"config", "control", "alerts", "report", "plotter", "uhaul", "farm", "drives",
+	"processes", "history", "push", "mqtt", "notify", "hooks", "lifecycle", "metrics", "events", "http",
+}
+
+// startSubsystem runs f in the background until stopSubsystem is called
+func startSubsystem(name string, f func(ctx context.Context)) {
+	subsystemsLock.Lock()
+	defer subsystemsLock.Unlock()
+	if _, running := subsystems[name]; running {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &subsystem{cancel: cancel, done: make(chan struct{})}
+	subsystems[name] = s
+	go func() {
+		defer close(s.done)
+		f(ctx)
+	}()
+}
+
+// stopSubsystem stops name and waits for it to return
+func stopSubsystem(name string) {
+	subsystemsLock.Lock()
+	s, running := subsystems[name]
+	delete(subsystems, name)
+	subsystemsLock.Unlock()
+
+	if running {
+		s.cancel()
+		<-s.done
+	}
+}
+
+func subsystemRunning(name string) bool {
+	subsystemsLock.Lock()
+	defer subsystemsLock.Unlock()
+	_, running := subsystems[name]
+	return running
+}
+
+// stopSubsystems stops everything that's running, in shutdownOrder
+func stopSubsystems() {
+	for _, name := range shutdownOrder {
+		if subsystemRunning(name) {
+			mainLog.Infof("Stopping %s", name)
+			stopSubsystem(name)
+		}
+	}
+
+	subsystemsLock.Lock()
+	var rest []string
+	for name := range subsystems {
+		rest = append(rest, name)
+	}
+	subsystemsLock.Unlock()
+	sort.Strings(rest)
+	for _, name := range rest {
+		mainLog.Infof("Stopping %s", name)
+		stopSubsystem(name)
+	}
+}
+
+// sleepContext sleeps for d or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
+
+// serveHTTP serves h on l until ctx is done, then gives open requests a few
+// seconds to finish
+func serveHTTP(ctx context.Context, l net.Listener, h http.Handler) error {
+	srv := &http.Server{Handler: h}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	if err := srv.Serve(l); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
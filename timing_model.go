@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var timingLog = newLogger("timing")
+
+// number of recent samples kept per step, older samples fall off so the model
+// follows changes in hardware/config
+const timingSamples = 20
+
+// plots whose recorded steps are remembered, finished plots are forgotten
+// when their copy time is seen, this bounds the ones that never finish
+const seenPlots = 200
+
+// rough length of a k32 plot, only used until we've seen real timings
+const defaultPlotSeconds = 10 * 60 * 60
+
+type plotStep struct {
+	phase string
+	table string
+	// default share of the total plot time, used when there's no history
+	share float64
+	// step starts without a log line once the previous step finishes
+	implicit bool
+}
+
+func (s plotStep) key() string {
+	if s.table == "" {
+		return s.phase
+	}
+	return s.phase + "/" + s.table
+}
+
+// every step a chiapos plot goes through in order
+var plotSteps = []plotStep{
+	{phase: "1", table: "1", share: 0.015},
+	{phase: "1", table: "2", share: 0.0675},
+	{phase: "1", table: "3", share: 0.0675},
+	{phase: "1", table: "4", share: 0.0675},
+	{phase: "1", table: "5", share: 0.0675},
+	{phase: "1", table: "6", share: 0.0675},
+	{phase: "1", table: "7", share: 0.0675},
+	{phase: "2", table: "7", share: 0.03},
+	{phase: "2", table: "6", share: 0.028},
+	{phase: "2", table: "5", share: 0.028},
+	{phase: "2", table: "4", share: 0.028},
+	{phase: "2", table: "3", share: 0.028},
+	{phase: "2", table: "2", share: 0.028},
+	{phase: "3", table: "1", share: 0.055},
+	{phase: "3", table: "2", share: 0.055},
+	{phase: "3", table: "3", share: 0.055},
+	{phase: "3", table: "4", share: 0.055},
+	{phase: "3", table: "5", share: 0.055},
+	{phase: "3", table: "6", share: 0.055},
+	{phase: "4", table: "1", share: 0.02},
+	{phase: "4", table: "2", share: 0.01},
+	{phase: "copy", share: 0.05, implicit: true},
+}
+
+func phaseShare(phase string) float64 {
+	share := float64(0)
+	for _, s := range plotSteps {
+		if s.phase == phase {
+			share += s.share
+		}
+	}
+	return share
+}
+
+type durationSamples []float64
+
+func (d *durationSamples) add(v float64) {
+	*d = append(*d, v)
+	if len(*d) > timingSamples {
+		*d = (*d)[1:]
+	}
+}
+
+func (d durationSamples) mean() (float64, bool) {
+	if len(d) == 0 {
+		return 0, false
+	}
+	sum := float64(0)
+	for _, v := range d {
+		sum += v
+	}
+	return sum / float64(len(d)), true
+}
+
+// durations in seconds by step key, phase totals are keyed by the phase alone
+type stepTimings map[string]*durationSamples
+
+func (t stepTimings) add(key string, secs float64) {
+	if _, exists := t[key]; !exists {
+		t[key] = &durationSamples{}
+	}
+	t[key].add(secs)
+}
+
+func (t stepTimings) mean(key string) (float64, bool) {
+	if d, exists := t[key]; exists {
+		return d.mean()
+	}
+	return 0, false
+}
+
+// TimingModel tracks historical phase and table durations per plotter tag and
+// uses them to estimate progress and time remaining for running plots
+type TimingModel struct {
+	lock     sync.Mutex
+	tags     map[string]stepTimings
+	all      stepTimings
+	seen     map[string]map[string]bool // steps already recorded by plot_id
+	plots    []string                   // plot_ids in seen, oldest first
+	observed int
+}
+
+var timingModel = NewTimingModel()
+
+// chiapos appends a ctime timestamp to phase starts and timing lines,
+// ie 'Sun Jun  6 10:00:00 2021'
+var ctimeRegex = regexp.MustCompile(`\w{3} \w{3}\s+\d{1,2} \d{2}:\d{2}:\d{2} \d{4}`)
+var tableTime = regexp.MustCompile(`(?:F1 complete, time|Forward propagation table time|Total compress table time): ([\d.]+) seconds`)
+
+func NewTimingModel() *TimingModel {
+	return &TimingModel{
+		tags: map[string]stepTimings{},
+		all:  stepTimings{},
+		seen: map[string]map[string]bool{},
+	}
+}
+
+// Observe records a finished phase (table == "") or table for the given tag
+func (m *TimingModel) Observe(tag string, plotID string, phase string, table string, secs float64) {
+	if secs <= 0 {
+		return
+	}
+
+	key := plotStep{phase: phase, table: table}.key()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if plotID != "" {
+		// the same plot can be seen from both the live process and its log file
+		if m.seen[plotID][key] {
+			return
+		}
+		if key == "copy" { // the last step, the plot won't be seen again
+			m.forget(plotID)
+		} else {
+			m.remember(plotID, key)
+		}
+	}
+	m.observed++
+
+	if _, exists := m.tags[tag]; !exists {
+		m.tags[tag] = stepTimings{}
+	}
+	m.tags[tag].add(key, secs)
+	m.all.add(key, secs)
+}
+
+// remember marks a step of plotID as recorded, must be called with the lock
+// held
+func (m *TimingModel) remember(plotID string, key string) {
+	if _, exists := m.seen[plotID]; !exists {
+		if len(m.plots) >= seenPlots {
+			m.forget(m.plots[0])
+		}
+		m.seen[plotID] = map[string]bool{}
+		m.plots = append(m.plots, plotID)
+	}
+	m.seen[plotID][key] = true
+}
+
+// forget drops the recorded steps of plotID, must be called with the lock held
+func (m *TimingModel) forget(plotID string) {
+	delete(m.seen, plotID)
+	for i, id := range m.plots {
+		if id == plotID {
+			m.plots = append(m.plots[:i], m.plots[i+1:]...)
+			break
+		}
+	}
+}
+
+// expected duration in seconds of a single step for the given tag, falls back
+// to the phase totals and then the other tags before using the defaults
+func (m *TimingModel) expected(tag string, step plotStep) float64 {
+	for _, t := range []stepTimings{m.tags[tag], m.all} {
+		if t == nil {
+			continue
+		}
+		if v, ok := t.mean(step.key()); ok {
+			return v
+		}
+		if step.table != "" {
+			if v, ok := t.mean(step.phase); ok {
+				return v * step.share / phaseShare(step.phase)
+			}
+		}
+	}
+
+	return defaultPlotSeconds * step.share
+}
+
+// StepDurations returns the expected seconds for each of plotSteps
+func (m *TimingModel) StepDurations(tag string) []float64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	durations := make([]float64, len(plotSteps))
+	for i, s := range plotSteps {
+		durations[i] = m.expected(tag, s)
+	}
+	return durations
+}
+
+// Estimate returns the expected progress (0-100) and time remaining for a plot
+// that has spent elapsed in the given phase/table
+func (m *TimingModel) Estimate(tag string, phase string, table string, elapsed time.Duration) (float64, time.Duration) {
+	if phase == "copy" { // copy time is the last thing chiapos reports
+		return 100, 0
+	}
+
+	idx := -1
+	for i, s := range plotSteps {
+		if s.phase != phase {
+			continue
+		}
+		if idx == -1 { // tables that haven't started yet map to the first one
+			idx = i
+		}
+		if s.table == "" || s.table == table {
+			idx = i
+			break
+		}
+	}
+	if idx == -1 { // init
+		idx = 0
+	}
+
+	durations := m.StepDurations(tag)
+	total := float64(0)
+	for _, d := range durations {
+		total += d
+	}
+
+	into := elapsed.Seconds()
+	for idx+1 < len(plotSteps) && plotSteps[idx+1].implicit && into > durations[idx] {
+		into -= durations[idx]
+		idx++
+	}
+
+	done := float64(0)
+	for _, d := range durations[:idx] {
+		done += d
+	}
+	if into > durations[idx] {
+		into = durations[idx]
+	}
+	done += into
+
+	progress := done / total * 100
+	remaining := time.Duration(total-done) * time.Second
+
+	return progress, remaining
+}
+
+// LoadLogs seeds the model from previous plots logged to the given dir,
+// including logs that were compressed
+func (m *TimingModel) LoadLogs(dir string) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	compressed, _ := filepath.Glob(filepath.Join(dir, "*.log.gz"))
+	files = append(files, compressed...)
+	if err != nil {
+		timingLog.Errorf("Error listing plotter logs in '%s': %v", dir, err)
+		return
+	}
+
+	m.lock.Lock()
+	before := m.observed
+	m.lock.Unlock()
+
+	for _, f := range files {
+		fd, err := os.Open(f)
+		if err != nil {
+			timingLog.Errorf("Error opening plotter log '%s': %v", f, err)
+			continue
+		}
+
+		var in io.Reader = fd
+		if strings.HasSuffix(f, ".gz") {
+			zr, err := gzip.NewReader(fd)
+			if err != nil {
+				timingLog.Errorf("Error opening plotter log '%s': %v", f, err)
+				fd.Close()
+				continue
+			}
+			in = zr
+		}
+
+		// replay through a scratch state, non-live entries only update the model
+		ps := &PlotterState{State: map[string]string{"phase": "init", "table": "0"}}
+		r := bufio.NewReader(in)
+		for {
+			s, err := r.ReadString('\n')
+			if len(s) > 0 {
+				ps.Update(&logEntry{msg: s})
+			}
+			if err != nil {
+				if err != io.EOF {
+					timingLog.Errorf("Error reading plotter log '%s': %v", f, err)
+				}
+				break
+			}
+		}
+		fd.Close()
+	}
+
+	m.lock.Lock()
+	timingLog.Infof("Loaded %d step timings from %d plotter logs", m.observed-before, len(files))
+	m.lock.Unlock()
+}
+
+func parseCtime(s string) (time.Time, bool) {
+	stamp := ctimeRegex.FindString(s)
+	if stamp == "" {
+		return time.Time{}, false
+	}
+	t, err := time.ParseInLocation(time.ANSIC, stamp, time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+func parseNumber(s string) float64 {
+	v, _ := strconv.ParseFloat(s, 64)
+	return v
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestTimingModelSeen(t *testing.T) {
+	m := NewTimingModel()
+	samples := func(key string) int {
+		if d := m.all[key]; d != nil {
+			return len(*d)
+		}
+		return 0
+	}
+
+	// the live process and its log file report the same steps
+	for i := 0; i < 2; i++ {
+		m.Observe("ssd", "a", "1", "1", 100)
+		m.Observe("ssd", "a", "1", "", 1000)
+	}
+	if got := samples("1/1"); got != 1 {
+		t.Errorf("1/1 recorded %d times, want 1", got)
+	}
+	if len(m.seen["a"]) != 2 {
+		t.Errorf("seen %v, want both steps of a", m.seen["a"])
+	}
+
+	m.Observe("ssd", "a", "copy", "", 60)
+	if _, exists := m.seen["a"]; exists || len(m.plots) != 0 {
+		t.Errorf("a is still remembered after its copy: %v %v", m.seen, m.plots)
+	}
+
+	// plots that never finish are dropped oldest first
+	for i := 0; i < seenPlots+10; i++ {
+		m.Observe("ssd", fmt.Sprint("failed", i), "1", "1", 100)
+	}
+	if len(m.seen) != seenPlots || len(m.plots) != seenPlots {
+		t.Errorf("remembering %d plots (%d ordered), want %d", len(m.seen), len(m.plots), seenPlots)
+	}
+	if _, exists := m.seen["failed9"]; exists {
+		t.Errorf("oldest plots weren't forgotten")
+	}
+	if _, exists := m.seen[fmt.Sprint("failed", seenPlots+9)]; !exists {
+		t.Errorf("newest plot was forgotten")
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/mattn/go-runewidth"
+)
+
+var topSorts = []string{"pid", "tag", "progress", "eta"}
+
+type topView struct {
+	screen  tcell.Screen
+	sortBy  int
+	reverse bool
+	filter  string // only show plots whose tag contains this
+	editing bool   // typing a new filter
+	input   string
+}
+
+// runTop implements `chia-monitor top`, a read-only terminal view of the
+// plotters, drives and transfers on this host. It never launches plots or
+// moves files, so it's safe to run next to the monitor
+func runTop(args []string) {
+	fs := flag.NewFlagSet("top", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "monitor config to read paths from")
+	logPath := fs.String("log", "", "write monitor output to this file")
+	state := fs.String("state-dir", ".", "dir with the plotter logs used for ETAs")
+	fs.Parse(args)
+	stateDir = *state
+
+	setLogOutput(ioutil.Discard)
+	if *logPath != "" {
+		logFile, err := os.OpenFile(*logPath, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0666)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		setLogOutput(logFile)
+	}
+
+	cfg, err := parseConfig(*configPath)
+	if err != nil {
+		mainLog.Errorf("%v", err)
+	}
+
+	timingModel.LoadLogs(statePath("plotter_logs"))
+	processMonitor = NewProcessMonitor()
+	startSubsystem("processes", processMonitor.Run)
+	if cfg.DriveMonitorEnabled {
+		startSubsystem("drives", func(ctx context.Context) { startDriveMonitoring(ctx, cfg.DriveMonitorConfig) })
+	}
+	if cfg.FarmMonitorEnabled {
+		startSubsystem("farm", func(ctx context.Context) { startFarmMonitor(ctx, cfg.ChiaPath) })
+	}
+
+	screen, err := tcell.NewScreen()
+	if err == nil {
+		err = screen.Init()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening terminal: %v\n", err)
+		os.Exit(1)
+	}
+	defer screen.Fini()
+
+	view := &topView{screen: screen, sortBy: 3}
+	view.run()
+}
+
+func (v *topView) run() {
+	input := make(chan tcell.Event)
+	go func() {
+		for {
+			ev := v.screen.PollEvent()
+			if ev == nil { // screen closed
+				return
+			}
+			input <- ev
+		}
+	}()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		v.draw()
+		select {
+		case ev := <-input:
+			if v.handle(ev) {
+				return
+			}
+		case <-ticker.C:
+		}
+	}
+}
+
+// handle processes a terminal event, returns true when we should exit
+func (v *topView) handle(ev tcell.Event) bool {
+	switch ev := ev.(type) {
+	case *tcell.EventResize:
+		v.screen.Sync()
+	case *tcell.EventKey:
+		if v.editing {
+			switch ev.Key() {
+			case tcell.KeyEnter:
+				v.filter, v.editing = v.input, false
+			case tcell.KeyEscape:
+				v.editing = false
+			case tcell.KeyBackspace, tcell.KeyBackspace2:
+				if len(v.input) > 0 {
+					v.input = v.input[:len(v.input)-1]
+				}
+			case tcell.KeyRune:
+				v.input += string(ev.Rune())
+			}
+			return false
+		}
+
+		switch ev.Key() {
+		case tcell.KeyEscape, tcell.KeyCtrlC:
+			return true
+		case tcell.KeyRune:
+			switch ev.Rune() {
+			case 'q':
+				return true
+			case 's':
+				v.sortBy = (v.sortBy + 1) % len(topSorts)
+			case 'r':
+				v.reverse = !v.reverse
+			case 't':
+				v.filter = v.nextTag()
+			case '/':
+				v.editing, v.input = true, v.filter
+			case 'c':
+				v.filter = ""
+			}
+		}
+	}
+	return false
+}
+
+// nextTag cycles the filter through the tags currently plotting
+func (v *topView) nextTag() string {
+	seen := map[string]bool{}
+	var tags []string
+	for _, p := range processMonitor.Snapshot() {
+		if !seen[p.Tag] {
+			seen[p.Tag] = true
+			tags = append(tags, p.Tag)
+		}
+	}
+	sort.Strings(tags)
+
+	for i, t := range tags {
+		if t == v.filter {
+			if i+1 < len(tags) {
+				return tags[i+1]
+			}
+			return ""
+		}
+	}
+	if len(tags) > 0 {
+		return tags[0]
+	}
+	return ""
+}
+
+func (v *topView) plots() []PlotterInfo {
+	var plots []PlotterInfo
+	for _, p := range processMonitor.Snapshot() {
+		if v.filter == "" || strings.Contains(p.Tag, v.filter) {
+			plots = append(plots, p)
+		}
+	}
+
+	less := map[string]func(a, b PlotterInfo) bool{
+		"pid":      func(a, b PlotterInfo) bool { return a.Pid < b.Pid },
+		"tag":      func(a, b PlotterInfo) bool { return a.Tag < b.Tag || (a.Tag == b.Tag && a.Pid < b.Pid) },
+		"progress": func(a, b PlotterInfo) bool { return a.Progress > b.Progress },
+		"eta":      func(a, b PlotterInfo) bool { return a.EtaSeconds < b.EtaSeconds },
+	}[topSorts[v.sortBy]]
+	sort.SliceStable(plots, func(i, j int) bool {
+		if v.reverse {
+			return less(plots[j], plots[i])
+		}
+		return less(plots[i], plots[j])
+	})
+	return plots
+}
+
+func (v *topView) draw() {
+	s := v.screen
+	s.Clear()
+	width, height := s.Size()
+
+	y := 0
+	line := func(style tcell.Style, format string, a ...interface{}) {
+		if y >= height-1 { // last row is kept for the key help
+			return
+		}
+		text := runewidth.Truncate(fmt.Sprintf(format, a...), width, "")
+		for x, r := range []rune(runewidth.FillRight(text, width)) {
+			s.SetContent(x, y, r, nil, style)
+		}
+		y++
+	}
+
+	normal := tcell.StyleDefault
+	bold := normal.Bold(true)
+	header := normal.Reverse(true)
+
+	host, _ := os.Hostname()
+	order := "asc"
+	if v.reverse {
+		order = "desc"
+	}
+	filter := v.filter
+	if filter == "" {
+		filter = "all"
+	}
+	line(header, " chia-monitor top  %s  %s  sort: %s %s  tag: %s", host, time.Now().Format("2006-01-02 15:04:05"), topSorts[v.sortBy], order, filter)
+
+	mem := currentMeminfo()
+	farm := CurrentFarmSummary()
+	farmText := "farm summary: n/a"
+	if !farm.Updated.IsZero() {
+		farmText = fmt.Sprintf("farmed: %.2f XCH  netspace: %.0f PiB", farm.Farmed, farm.NetspacePiB)
+	}
+	if farm.Error != "" {
+		farmText += "  (error: " + farm.Error + ")"
+	}
+	line(normal, " ram: %s / %s  swap: %s / %s  %s",
+		formatBytes((mem["MemTotal"]-mem["MemAvailable"])*1024), formatBytes(mem["MemTotal"]*1024),
+		formatBytes((mem["SwapTotal"]-mem["SwapFree"])*1024), formatBytes(mem["SwapTotal"]*1024),
+		farmText)
+	line(normal, "")
+
+	plots := v.plots()
+	line(bold, " PLOTS (%d)", len(plots))
+	line(bold, " %-8s %-10s %-6s %-6s %-9s %-30s %-9s %s", "PID", "TAG", "PHASE", "TABLE", "BUCKET", "PROGRESS", "ETA", "FINISH")
+	for _, p := range plots {
+		finish := ""
+		if t, err := time.Parse(time.RFC3339, p.Eta); err == nil && p.EtaSeconds > 0 {
+			finish = t.Local().Format("Mon 15:04")
+		}
+		bucket := p.Bucket
+		if p.Buckets != "" {
+			bucket += "/" + p.Buckets
+		}
+		line(normal, " %-8d %-10s %-6s %-6s %-9s %-30s %-9s %s", p.Pid, p.Tag, p.Phase, p.Table, bucket,
+			progressBar(p.Progress, 20), formatDuration(time.Duration(p.EtaSeconds)*time.Second), finish)
+	}
+	line(normal, "")
+
+	drives := DriveSnapshot()
+	line(bold, " DRIVES (%d)", len(drives))
+	line(bold, " %-36s %-14s %-10s %-10s %-6s %-10s %s", "PATH", "KIND", "FREE", "USED", "PLOTS", "READ/s", "WRITE/s")
+	for _, d := range drives {
+		free := formatBytes(d.FreeBytes)
+		if d.Low {
+			free += " !"
+		}
+		line(normal, " %-36s %-14s %-10s %-10s %-6d %-10s %s", d.Path, strings.Join(d.Kinds, ","), free,
+			formatBytes(d.UsedBytes), d.Plots, formatBytes(uint64(d.ReadRate)), formatBytes(uint64(d.WriteRate)))
+	}
+	line(normal, "")
+
+	transfers := scanTransfers()
+	line(bold, " TRANSFERS (%d)", len(transfers))
+	for _, t := range transfers {
+		line(normal, " %s => %s  %s  %s", t.Source, t.Destination, formatBytes(uint64(t.Bytes)), formatDuration(time.Since(t.Started)))
+	}
+
+	help := " q quit  s sort  r reverse  t next tag  / filter  c clear filter"
+	if v.editing {
+		help = " filter by tag: " + v.input + "_"
+	}
+	text := runewidth.FillRight(runewidth.Truncate(help, width, ""), width)
+	for x, r := range []rune(text) {
+		s.SetContent(x, height-1, r, nil, header)
+	}
+
+	s.Show()
+}
+
+func progressBar(progress float64, width int) string {
+	filled := int(progress / 100 * float64(width))
+	if filled > width {
+		filled = width
+	}
+	if filled < 0 {
+		filled = 0
+	}
+	return fmt.Sprintf("[%s%s] %5.1f%%", strings.Repeat("#", filled), strings.Repeat(".", width-filled), progress)
+}
+
+func formatBytes(b uint64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}
+	v := float64(b)
+	i := 0
+	for v >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", v, units[i])
+}
+
+func formatDuration(d time.Duration) string {
+	if d <= 0 {
+		return "-"
+	}
+	d = d.Round(time.Minute)
+	h := int(d.Hours())
+	m := int(d.Minutes()) % 60
+	if h >= 24 {
+		return fmt.Sprintf("%dd%dh", h/24, h%24)
+	}
+	return fmt.Sprintf("%dh%02dm", h, m)
+}
@@ -1,44 +1,312 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
-	"log"
+	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
+var uhaulLog = newLogger("uhaul")
+
 type outputDir struct {
 	path string
 	lock int32
 }
 
+// guards the staging and final paths, they change when the config is reloaded
+var uhaulLock sync.Mutex
 var outdirs = []*outputDir{}
+var stagingPaths []string
+
+// wakes the staging folder monitor up early, keyed by staging path
+var stagingTriggers = map[string]chan struct{}{}
+var stagingCancels = map[string]context.CancelFunc{}
+var uhaulCtx context.Context
+var uhaulWg *sync.WaitGroup
+
+// transfers still running when uhaul stops get transferTimeout to finish,
+// then transferCtx is cancelled and their partial copies are removed
+var transferTimeout = 5 * time.Minute
+var transferCtx = context.Background()
+
+// TransferInfo describes a plot currently being moved
+type TransferInfo struct {
+	Source      string    `json:"source"`
+	Destination string    `json:"destination"`
+	Bytes       int64     `json:"bytes"`
+	Started     time.Time `json:"started"`
+}
+
+var transfersLock sync.Mutex
+var activeTransfers = map[string]TransferInfo{} // by source
+
+// staging or final paths uhaul leaves alone until resumed
+var pausedLock sync.Mutex
+var pausedPaths = map[string]bool{}
+
+// PauseUhaul stops (or resumes) moving plots out of a staging path or into
+// a final path, transfers already running are left to finish
+func PauseUhaul(path string, pause bool) error {
+	path = filepath.Clean(path)
+	known := false
+	for _, k := range uhaulStagingPaths() {
+		known = known || filepath.Clean(k) == path
+	}
+	for _, o := range uhaulOutdirs() {
+		known = known || filepath.Clean(o.path) == path
+	}
+	if !known {
+		return fmt.Errorf("%w: '%s' is not a uhaul staging or final path", errNotFound, path)
+	}
+
+	pausedLock.Lock()
+	defer pausedLock.Unlock()
+	if pause {
+		pausedPaths[path] = true
+	} else {
+		delete(pausedPaths, path)
+	}
+	return nil
+}
+
+func uhaulPaused(path string) bool {
+	pausedLock.Lock()
+	defer pausedLock.Unlock()
+	return pausedPaths[filepath.Clean(path)]
+}
+
+// PausedPaths returns the paths uhaul is currently paused for
+func PausedPaths() []string {
+	pausedLock.Lock()
+	defer pausedLock.Unlock()
+
+	paths := []string{}
+	for k := range pausedPaths {
+		paths = append(paths, k)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// ActiveTransfers returns the moves uhaul currently has in flight
+func ActiveTransfers() []TransferInfo {
+	transfersLock.Lock()
+	defer transfersLock.Unlock()
+
+	transfers := make([]TransferInfo, 0, len(activeTransfers))
+	for _, t := range activeTransfers {
+		transfers = append(transfers, t)
+	}
+	sort.Slice(transfers, func(i, j int) bool { return transfers[i].Started.Before(transfers[j].Started) })
+	return transfers
+}
+
+// UhaulQueue returns the plots waiting in staging that aren't being moved yet
+func UhaulQueue() []string {
+	paths := uhaulStagingPaths()
+
+	transfersLock.Lock()
+	defer transfersLock.Unlock()
+
+	queue := []string{}
+	for _, path := range paths {
+		info, err := ioutil.ReadDir(path)
+		if err != nil {
+			continue
+		}
+		for _, f := range info {
+			srcPath := path + "/" + f.Name()
+			if _, moving := activeTransfers[srcPath]; !f.IsDir() && filepath.Ext(f.Name()) == ".plot" && !moving {
+				queue = append(queue, srcPath)
+			}
+		}
+	}
+	return queue
+}
+
+// scanTransfers finds uhaul moves from the running rsync processes, for
+// when uhaul runs in another process
+func scanTransfers() []TransferInfo {
+	o, err := exec.Command("/usr/bin/pgrep", "-a", "-f", "rsync --remove-source-files").Output()
+	if err != nil {
+		return nil
+	}
+
+	bySource := map[string]TransferInfo{}
+	for _, line := range strings.Split(string(o), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		// rsync forks, so the same move shows up more than once
+		src, dest := fields[len(fields)-2], fields[len(fields)-1]
+		if _, exists := bySource[src]; exists {
+			continue
+		}
+
+		t := TransferInfo{Source: src, Destination: filepath.Dir(dest)}
+		if pid, err := strconv.Atoi(fields[0]); err == nil {
+			if proc, err := os.Stat(fmt.Sprintf("/proc/%d", pid)); err == nil {
+				t.Started = proc.ModTime()
+			}
+		}
+		if f, err := os.Stat(src); err == nil {
+			t.Bytes = f.Size()
+		}
+		bySource[src] = t
+	}
+
+	var transfers []TransferInfo
+	for _, t := range bySource {
+		transfers = append(transfers, t)
+	}
+	sort.Slice(transfers, func(i, j int) bool { return transfers[i].Started.Before(transfers[j].Started) })
+	return transfers
+}
+
+func uhaulStagingPaths() []string {
+	uhaulLock.Lock()
+	defer uhaulLock.Unlock()
+	return append([]string{}, stagingPaths...)
+}
 
-func startUhaul(cfg UhaulConfig) {
+func uhaulOutdirs() []*outputDir {
+	uhaulLock.Lock()
+	defer uhaulLock.Unlock()
+	return append([]*outputDir{}, outdirs...)
+}
+
+func startUhaul(ctx context.Context, cfg UhaulConfig) {
+	wg := &sync.WaitGroup{}
+	transfers, abortTransfers := context.WithCancel(context.Background())
+	defer abortTransfers()
+	uhaulLock.Lock()
+	uhaulCtx, uhaulWg, transferCtx = ctx, wg, transfers
+	uhaulLock.Unlock()
+
+	completions := events.Subscribe("uhaul", PlotCompleted)
+	go watchCompletions(completions)
+	updateUhaul(cfg)
+
+	<-ctx.Done()
+	events.Unsubscribe(completions)
+	if n := len(ActiveTransfers()); n > 0 {
+		uhaulLog.Infof("Waiting up to %s for %d transfer(s) to finish", transferTimeout, n)
+	}
+	if !waitTimeout(wg, transferTimeout) {
+		uhaulLog.Warnf("Transfers still running after %s, aborting them", transferTimeout)
+		abortTransfers()
+		wg.Wait()
+	}
+
+	uhaulLock.Lock()
+	defer uhaulLock.Unlock()
+	outdirs, stagingPaths = []*outputDir{}, nil
+	stagingTriggers = map[string]chan struct{}{}
+	stagingCancels = map[string]context.CancelFunc{}
+	uhaulLog.Infof("Stopped")
+}
+
+// updateUhaul switches to the staging and final paths in cfg, staging paths
+// that are still configured keep being monitored
+func updateUhaul(cfg UhaulConfig) {
+	uhaulLock.Lock()
+	defer uhaulLock.Unlock()
+
+	// keep existing final dirs so a move in flight holds on to its lock
+	existing := map[string]*outputDir{}
+	for _, o := range outdirs {
+		existing[filepath.Clean(o.path)] = o
+	}
+	outdirs = []*outputDir{}
 	for _, k := range cfg.FinalPaths {
+		if o, exists := existing[filepath.Clean(k)]; exists {
+			outdirs = append(outdirs, o)
+			continue
+		}
 		outdirs = append(outdirs, &outputDir{
 			path: k,
 			lock: 0,
 		})
 	}
 
+	wanted := map[string]bool{}
 	for _, k := range cfg.StagingPaths {
-		log.Printf("[Uhaul] Starting monitoring %s", k)
-		go monitorFolder(k)
+		k = filepath.Clean(k)
+		wanted[k] = true
+		if _, running := stagingCancels[k]; running {
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(uhaulCtx)
+		trigger := make(chan struct{}, 1)
+		stagingCancels[k], stagingTriggers[k] = cancel, trigger
+
+		uhaulLog.Infof("Starting monitoring %s", k)
+		uhaulWg.Add(1)
+		go func(path string) {
+			defer uhaulWg.Done()
+			monitorFolder(ctx, path, trigger)
+		}(k)
+	}
+	for k, cancel := range stagingCancels {
+		if !wanted[k] {
+			uhaulLog.Infof("Stopping monitoring %s", k)
+			cancel()
+			delete(stagingCancels, k)
+			delete(stagingTriggers, k)
+		}
+	}
+	stagingPaths = cfg.StagingPaths
+}
+
+// watchCompletions rescans a staging folder as soon as a plot lands in it
+func watchCompletions(ch <-chan Event) {
+	for e := range ch {
+		uhaulLock.Lock()
+		trigger, exists := stagingTriggers[filepath.Dir(e.File)]
+		uhaulLock.Unlock()
+		if exists {
+			select {
+			case trigger <- struct{}{}:
+			default: // scan already pending
+			}
+		}
 	}
 }
 
-func monitorFolder(path string) {
+func monitorFolder(ctx context.Context, path string, trigger <-chan struct{}) {
 	for {
+		if uhaulPaused(path) {
+			select {
+			case <-ctx.Done():
+				return
+			case <-trigger:
+			case <-time.After(30 * time.Second):
+			}
+			continue
+		}
+
 		info, err := ioutil.ReadDir(path)
 		if err != nil {
-			log.Printf("[Uhaul] Error checking directory %s, %+v", path, err)
-			break
+			uhaulLog.Errorf("Error checking directory %s, %+v", path, err)
+			return
 		}
 
 		for _, f := range info {
+			if ctx.Err() != nil {
+				return
+			}
 			if f.IsDir() {
 				continue
 			}
@@ -48,12 +316,24 @@ func monitorFolder(path string) {
 			}
 		}
 
-		time.Sleep(30 * time.Second)
+		select {
+		case <-ctx.Done():
+			return
+		case <-trigger:
+		case <-time.After(30 * time.Second):
+		}
 	}
 }
 
 func moveFile(fname string, path string) {
-	for _, o := range outdirs {
+	uhaulLock.Lock()
+	abort := transferCtx
+	uhaulLock.Unlock()
+
+	for _, o := range uhaulOutdirs() {
+		if uhaulPaused(o.path) {
+			continue
+		}
 		if atomic.CompareAndSwapInt32(&o.lock, 0, 1) {
 			defer func() { o.lock = 0 }() // reset at the end
 
@@ -61,14 +341,92 @@ func moveFile(fname string, path string) {
 			now := time.Now()
 			srcPath := path + "/" + fname
 			destPath := o.path + "/" + fname
-			log.Printf("[Uhaul] Moving '%s' => '%s'", srcPath, destPath)
-			_, err := exec.Command("/usr/bin/rsync", "--remove-source-files", srcPath, destPath).Output()
+			transfer := Event{
+				File:        filepath.Clean(srcPath),
+				Destination: o.path,
+			}
+			info := TransferInfo{Source: srcPath, Destination: o.path, Started: now}
+			if f, err := os.Stat(srcPath); err == nil {
+				info.Bytes = f.Size()
+			}
+			transfer.Type, transfer.Time, transfer.Bytes = TransferStarted, now, info.Bytes
+			events.Publish(transfer)
+
+			transfersLock.Lock()
+			activeTransfers[srcPath] = info
+			transfersLock.Unlock()
+
+			err := runTransfer(abort, srcPath, destPath)
+			if abort.Err() != nil {
+				removePartialCopy(o.path, fname)
+				err = fmt.Errorf("aborted on shutdown, '%s' left in place", srcPath)
+			}
+			transfersLock.Lock()
+			delete(activeTransfers, srcPath)
+			transfersLock.Unlock()
+
+			transfer.Time, transfer.Duration = time.Now(), time.Since(now)
 			if err != nil {
-				log.Printf("[Uhaul] Failed moving file '%s' => '%s': %+v", srcPath, destPath, err)
+				transfer.Type, transfer.Error = TransferFailed, err.Error()
+				events.Publish(transfer)
+				if abort.Err() != nil {
+					return
+				}
 				continue
 			}
-			log.Printf("[Uhaul] Moved file '%s' => '%s in %f minutes", srcPath, destPath, time.Since(now).Minutes())
+			transfer.Type = TransferFinished
+			events.Publish(transfer)
 			return // finished
 		}
 	}
 }
+
+// runTransfer rsyncs src to dest, the rsync processes are terminated if
+// abort is cancelled first
+func runTransfer(abort context.Context, src string, dest string) error {
+	cmd := exec.Command("/usr/bin/rsync", "--remove-source-files", src, dest)
+	// in its own process group so a ctrl-c on the terminal doesn't reach it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-abort.Done():
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+		case <-done:
+		}
+	}()
+	return cmd.Wait()
+}
+
+// removePartialCopy removes what an interrupted rsync left in dir, it copies
+// into a hidden temp file and only renames it once complete
+func removePartialCopy(dir string, fname string) {
+	files, _ := filepath.Glob(filepath.Join(dir, "."+fname+".*"))
+	for _, f := range files {
+		if err := os.Remove(f); err != nil {
+			uhaulLog.Errorf("Error removing partial copy '%s': %v", f, err)
+			continue
+		}
+		uhaulLog.Infof("Removed partial copy '%s'", f)
+	}
+}
+
+// waitTimeout waits for wg, returning false if it took longer than d
+func waitTimeout(wg *sync.WaitGroup, d time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}